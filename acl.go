@@ -0,0 +1,130 @@
+package tiddlywikid
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"tiddlywikid/session"
+	"tiddlywikid/store"
+)
+
+func tiddlerTags(td *store.TiddlyWebJSON) []string {
+	if td == nil || td.Tags == nil {
+		return []string{}
+	}
+	return *td.Tags
+}
+
+// per-tiddler rules and title prefix of API token for the session, nil for no restriction
+// tags is nil for unknown, tag rules are skipped
+func (wiki *Wiki) tiddlerCheck(sd *session.SessionData) func(title string, tags []string, write bool) bool {
+	acl := wiki.AuthHandler.TiddlerACL()
+	prefix := ""
+	if sd != nil {
+		prefix, _ = getString(sd, "token-prefix")
+	}
+	if acl == nil && prefix == "" {
+		return nil
+	}
+	login, role := wiki.sessLogin(sd)
+	return func(title string, tags []string, write bool) bool {
+		if !strings.HasPrefix(title, prefix) {
+			return false
+		}
+		return acl.Check(login, role, title, tags, write)
+	}
+}
+
+// td is nil for not exist
+func (wiki *Wiki) canAccess(sd *session.SessionData, title string, td *store.TiddlyWebJSON, write bool) bool {
+	check := wiki.tiddlerCheck(sd)
+	if check == nil {
+		return true
+	}
+	return check(title, tiddlerTags(td), write)
+}
+
+// check with current tiddler in store, tag rules are skipped if not exist
+func (wiki *Wiki) canAccessTitle(sd *session.SessionData, title string, write bool) bool {
+	check := wiki.tiddlerCheck(sd)
+	if check == nil {
+		return true
+	}
+	td, _ := wiki.Store.Get(title)
+	var tags []string // nil for unknown
+	if td != nil {
+		tags = tiddlerTags(td)
+	}
+	return check(title, tags, write)
+}
+
+// read check for deleted tiddler, nil for no restriction
+// tags of the newest kept revision are used, if unknown the title is hidden by tag rules not allowed
+func (wiki *Wiki) deletedCheck(sd *session.SessionData) func(title string) bool {
+	acl := wiki.AuthHandler.TiddlerACL()
+	prefix := ""
+	if sd != nil {
+		prefix, _ = getString(sd, "token-prefix")
+	}
+	if acl == nil && prefix == "" {
+		return nil
+	}
+	login, role := wiki.sessLogin(sd)
+	return func(title string) bool {
+		if !strings.HasPrefix(title, prefix) {
+			return false
+		}
+		if lst := wiki.Store.Revisions(title); len(lst) > 0 {
+			return acl.Check(login, role, title, tiddlerTags(lst[0]), false)
+		}
+		return acl.CheckUnknownTags(login, role, title)
+	}
+}
+
+// remove tiddlers can not read from list output of Store
+func (wiki *Wiki) filterList(buf []byte, sd *session.SessionData) []byte {
+	check := wiki.tiddlerCheck(sd)
+	if check == nil {
+		return buf
+	}
+	checkDeleted := wiki.deletedCheck(sd)
+	var lst []json.RawMessage
+	if err := json.Unmarshal(buf, &lst); err != nil {
+		return []byte(`[]`)
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('[')
+	hasOutput := false
+	for _, raw := range lst {
+		var td struct {
+			Title   string    `json:"title"`
+			Tags    *[]string `json:"tags"`
+			Deleted bool      `json:"_is_deleted"`
+		}
+		if err := json.Unmarshal(raw, &td); err != nil {
+			continue
+		}
+		if td.Deleted {
+			if !checkDeleted(td.Title) {
+				continue
+			}
+		} else {
+			tags := []string{}
+			if td.Tags != nil {
+				tags = *td.Tags
+			}
+			if !check(td.Title, tags, false) {
+				continue
+			}
+		}
+		if hasOutput {
+			b.WriteByte(',')
+		}
+		b.Write(raw)
+		hasOutput = true
+	}
+	b.WriteByte(']')
+	return b.Bytes()
+}
@@ -1,6 +1,7 @@
 package tiddlywikid
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
@@ -12,9 +13,14 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"tiddlywikid/auth"
+	"tiddlywikid/search"
 	"tiddlywikid/session"
 	"tiddlywikid/store"
 	"tiddlywikid/utils"
@@ -32,6 +38,9 @@ const (
 	DefaultTiddlerSizeLimit    = 1024 * 1024 * 8   // 8MB
 
 	COOKIE_CSRF = "csrf_token"
+
+	HEADER_CHANGE_SEQ  = "X-Change-Seq"  // change sequence for `tiddlers.json?since=<seq>`
+	HEADER_CHANGE_FULL = "X-Change-Full" // set if `since` is not honoured, the list is full
 )
 
 var (
@@ -40,29 +49,64 @@ var (
 	_SESSION_COOKIE = "tiddlywiki"
 	_COOKIE_TTL     = session.SESSION_TTL
 	_LOGIN_DELAY    = 500 * time.Millisecond
+
+	_REMEMBER_COOKIE = "tiddlywiki_remember"
+	_REMEMBER_TTL    = DefaultRememberTTL
+	_REMEMBER_GRACE  = 30 * time.Second // used "remember me" token still resume the new session, for parallel requests
+)
+
+const (
+	DefaultRememberTTL = 30 * 24 * time.Hour
 )
 
+// session timeout and cookie lifetime, should be set before serving
+func SetSessionTTL(ttl time.Duration) {
+	session.SESSION_TTL = ttl
+	_COOKIE_TTL = ttl
+}
+
+// absolute session lifetime, 0 for no limit, should be set before serving
+func SetSessionMaxAge(age time.Duration) {
+	session.SESSION_MAX_AGE = age
+}
+
+// lifetime of "remember me" login, 0 for disable, should be set before serving
+func SetRememberTTL(ttl time.Duration) {
+	_REMEMBER_TTL = ttl
+}
+
 type Wiki struct {
 	*Mux
 	Store               store.Store
 	AuthHandler         auth.Auth
 	Sess                session.SessionStore
-	Files               string // path for static file
-	Base                string // base html file with plugin "tiddlywiki/tiddlyweb"
-	Recipe              string // recipe, default: "default"
-	SyncStoryList       bool   // save and put `$:/StoryList` and `$:/HistoryList` (cause some issue when multi-user/multi-window)
+	LoginGuard          *auth.LoginGuard // failed login backoff and lockout, nil for disable
+	Files               string           // path for static file
+	Base                string           // base html file with plugin "tiddlywiki/tiddlyweb"
+	Recipe              string           // recipe, default: "default"
+	SyncStoryList       bool             // save and put `$:/StoryList` and `$:/HistoryList` (cause some issue when multi-user/multi-window)
+	CheckRevision       bool             // reject PUT with outdated `revision` field in body (stock TiddlyWeb client may send stale one)
 	UploadFileSizeLimit int64
 	ParseMemoryLimit    int64
 	TiddlerSizeLimit    int64
 
-	fileRe *regexp.Regexp
+	Search *search.Index // full-text search, nil for disable
+
+	Plugins []string // plugin files (JSON) to inject into base html, with the external attachments plugin
+
+	fileRe    *regexp.Regexp
+	baseCache atomic.Value // *baseCache
+
+	closed    chan struct{} // long-lived requests end when closed
+	closeOnce sync.Once
 }
 
 func (wiki *Wiki) SetupMux(mux *Mux) *Mux {
 	if mux == nil {
 		mux = NewRootMux()
-		wiki.Mux = mux
 	}
+	wiki.Mux = mux
+	wiki.fileRe = fileRegexp(mux.Base())
 
 	mux.HandleFunc("/", wiki.index)
 	mux.HandleFunc("/status", wiki.status)
@@ -71,19 +115,33 @@ func (wiki *Wiki) SetupMux(mux *Mux) *Mux {
 	basePath := fmt.Sprintf("/recipes/%v/", wiki.Recipe)
 	mux.HandleFunc(basePath+"tiddlers.json", wiki.list)                                                      // list
 	mux.Handle(basePath+"tiddlers/", mux.StripPrefix(basePath+"tiddlers/", http.HandlerFunc(wiki.tiddlers))) // get & put tiddler
+	mux.HandleFunc(basePath+"events", wiki.events)                                                           // change notify by SSE
+	mux.HandleFunc(basePath+"search", wiki.searchTiddlers)                                                   // full-text search
+	mux.HandleFunc(basePath+"tagged", wiki.taggedTiddlers)                                                   // titles with a tag
+	mux.HandleFunc(basePath+"recent", wiki.recentTiddlers)                                                   // titles by modified time
 
-	bagPath := fmt.Sprintf("/bags/%v/tiddlers/", wiki.Recipe)
-	mux.Handle(bagPath, mux.StripPrefix(bagPath, http.HandlerFunc(wiki.delTiddler))) // delete tiddler
+	// bags of recipe, only the recipe itself if not a RecipeStore
+	for _, name := range wiki.bagNames() {
+		bagPath := fmt.Sprintf("/bags/%v/tiddlers/", name)
+		mux.Handle(bagPath, mux.StripPrefix(bagPath, wiki.bagTiddlers(name))) // delete tiddler
+	}
 
 	// TODO: use Attachment.ServeContent()
 	// attachments plugin
 	mux.HandleFunc("/upload/", wiki.upload)
 	mux.Handle("/files/", mux.StripPrefix("/files/", http.HandlerFunc(wiki.serveFile))) // static files
-	wiki.fileRe = regexp.MustCompile(`files/(\d){8}T(\d){6}-([A-Za-z0-9\-_]){16}`)
+
+	// single file wiki for offline
+	mux.HandleFunc("/export/wiki.html", wiki.exportWiki)
+
+	// admin
+	mux.HandleFunc("/admin/import", wiki.importWiki)      // import single file wiki
+	mux.HandleFunc("/admin/sessions", wiki.adminSessions) // list and revoke all sessions
 
 	// for login
 	mux.HandleFunc("/challenge/tiddlywebplugins.tiddlyspace.cookie_form", wiki.login)
 	mux.HandleFunc("/logout", wiki.logout)
+	mux.HandleFunc("/sessions", wiki.mySessions) // list and revoke own sessions
 	return mux
 }
 
@@ -101,31 +159,20 @@ func (wiki *Wiki) index(w http.ResponseWriter, r *http.Request) {
 	default:
 	}
 
-	fd, err := os.Open(wiki.Base)
-	if err != nil {
-		http.NotFoundHandler().ServeHTTP(w, r)
-		return
-	}
-	info, err := fd.Stat()
+	// inject plugins, cached by mtime/size of files
+	c, err := wiki.baseHTML()
 	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFoundHandler().ServeHTTP(w, r)
+			return
+		}
+		utils.Vln(2, "[index]err", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// buf, err := io.ReadAll(fd)
-	// if err != nil {
-	// 	http.Error(w, "internal server error", http.StatusInternalServerError)
-	// 	return
-	// }
-	// buf = append(buf, NewPluginBuf()...)
-	// buf = append(NewPluginBuf(), buf...)
-
-	// TODO: better etag
-	etag := fmt.Sprintf(`"%d-%d"`, info.ModTime().Unix(), info.Size())
-	hdr.Set("Etag", etag)
-
-	// http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(buf))
-	http.ServeContent(w, r, "", info.ModTime(), fd)
+	hdr.Set("Etag", c.etag)
+	http.ServeContent(w, r, "", c.modTime, bytes.NewReader(c.buf))
 	// http.ServeFile(w, r, "index.html")
 }
 
@@ -134,7 +181,7 @@ func (wiki *Wiki) index(w http.ResponseWriter, r *http.Request) {
 func (wiki *Wiki) status(w http.ResponseWriter, r *http.Request) {
 
 	// set flag for full tildder @ first fetch
-	setFirstLoad(w, r)
+	wiki.setFirstLoad(w, r)
 
 	isAnno, isLogin, user, sd := wiki.checkAuth(w, r)
 	if !isLogin {
@@ -168,7 +215,7 @@ func (wiki *Wiki) status(w http.ResponseWriter, r *http.Request) {
 	// }
 
 	readOnly := true
-	if isLogin || wiki.AuthHandler.AllowAnonymousEdit(r) {
+	if auth.CanEdit(wiki.sessRole(sd)) || wiki.AuthHandler.AllowAnonymousEdit(r) {
 		readOnly = false
 	}
 
@@ -185,27 +232,38 @@ func (wiki *Wiki) status(w http.ResponseWriter, r *http.Request) {
 	JsonRes(w, status, false)
 }
 
-func (wiki *Wiki) checkAuth(w http.ResponseWriter, r *http.Request) (isAnno bool, isLogin bool, user string, sd *session.SessionData) {
-	isLogin = false
-	isAnno = wiki.AuthHandler.AllowAnonymous(r)
-	sd = getSess(wiki.Sess, w, r)
+// login id and role of session, empty login for not login
+// role is limited by scope of API token
+func (wiki *Wiki) sessLogin(sd *session.SessionData) (login string, role string) {
 	if sd != nil {
-		uid, ok := sd.Get("acc")
-		if ok {
-			isLogin = true
-			user = uid.(string)
+		if v, ok := sd.Get("login"); ok {
+			login, _ = v.(string)
 		}
 	}
-	return
+	role = wiki.AuthHandler.Role(login)
+	if sd != nil {
+		if proxyRole, ok := getString(sd, "proxy-role"); ok && role == "" {
+			role = proxyRole // not in users
+		}
+		if scope, ok := sd.Get("token-scope"); ok && scope == auth.SCOPE_READ && auth.CanRead(role) {
+			role = auth.ROLE_READER
+		}
+	}
+	return login, role
 }
 
-func (wiki *Wiki) checkAuthEdit(w http.ResponseWriter, r *http.Request) (isAnno bool, isLogin bool, user string, sd *session.SessionData) {
-	isLogin = false
-	isAnno = wiki.AuthHandler.AllowAnonymousEdit(r)
-	sd = getSess(wiki.Sess, w, r)
+// role of login user in session, empty for not login or user removed
+func (wiki *Wiki) sessRole(sd *session.SessionData) string {
+	_, role := wiki.sessLogin(sd)
+	return role
+}
+
+// isLogin is true only if role of login user pass allow()
+func (wiki *Wiki) checkSessRole(w http.ResponseWriter, r *http.Request, allow func(role string) bool) (isLogin bool, user string, sd *session.SessionData) {
+	sd = wiki.getSess(w, r)
 	if sd != nil {
 		uid, ok := sd.Get("acc")
-		if ok {
+		if ok && allow(wiki.sessRole(sd)) {
 			isLogin = true
 			user = uid.(string)
 		}
@@ -213,25 +271,46 @@ func (wiki *Wiki) checkAuthEdit(w http.ResponseWriter, r *http.Request) (isAnno
 	return
 }
 
+func (wiki *Wiki) checkAuth(w http.ResponseWriter, r *http.Request) (isAnno bool, isLogin bool, user string, sd *session.SessionData) {
+	isAnno = wiki.AuthHandler.AllowAnonymous(r)
+	isLogin, user, sd = wiki.checkSessRole(w, r, auth.CanRead)
+	return
+}
+
+// login user with reader role is not allowed
+func (wiki *Wiki) checkAuthEdit(w http.ResponseWriter, r *http.Request) (isAnno bool, isLogin bool, user string, sd *session.SessionData) {
+	isAnno = wiki.AuthHandler.AllowAnonymousEdit(r)
+	isLogin, user, sd = wiki.checkSessRole(w, r, auth.CanEdit)
+	return
+}
+
 func (wiki *Wiki) checkAuthStatic(w http.ResponseWriter, r *http.Request) (isAnno bool, isLogin bool, user string, sd *session.SessionData) {
-	isLogin = false
 	isAnno = wiki.AuthHandler.AllowAnonymousAccessStaticFile(r)
-	sd = getSess(wiki.Sess, w, r)
-	if sd != nil {
-		uid, ok := sd.Get("acc")
-		if ok {
-			isLogin = true
-			user = uid.(string)
-		}
-	}
+	isLogin, user, sd = wiki.checkSessRole(w, r, auth.CanRead)
 	return
 }
 
+// login user with admin role, not login is never admin
+// without `-auth` (AuthAllowAll) any login user is admin
+func (wiki *Wiki) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	sd := wiki.getSess(w, r)
+	if sd == nil {
+		return false
+	}
+	if _, ok := getString(sd, "login"); !ok {
+		return false
+	}
+	return wiki.sessRole(sd) == auth.ROLE_ADMIN
+}
+
 func (wiki *Wiki) updateCSRF(w http.ResponseWriter, r *http.Request, sd *session.SessionData) {
 	// sd := getSess(wiki.Sess, w, r, false)
 	if sd == nil {
 		return // no session
 	}
+	if _, ok := sd.Get("via"); ok {
+		return // session only for this request, by API token, Basic auth or proxy
+	}
 	csrfToken, err := genRang()
 	if err != nil {
 		utils.Vln(4, "[CSRF]err", r.URL.Path, err)
@@ -242,7 +321,7 @@ func (wiki *Wiki) updateCSRF(w http.ResponseWriter, r *http.Request, sd *session
 	cookie := &http.Cookie{
 		Name:     COOKIE_CSRF,
 		Value:    csrfToken,
-		Path:     "/",   // TODO: by sub path
+		Path:     wiki.cookiePath(),
 		HttpOnly: false, // need to read by js
 		SameSite: http.SameSiteStrictMode,
 		Expires:  utils.Now().Add(_COOKIE_TTL),
@@ -273,7 +352,7 @@ func (wiki *Wiki) login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check already login
-	sd := getSess(wiki.Sess, w, r)
+	sd := wiki.getSess(w, r)
 	if sd != nil {
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -286,19 +365,40 @@ func (wiki *Wiki) login(w http.ResponseWriter, r *http.Request) {
 	}
 	user := r.Form.Get("user")
 	pwd := r.Form.Get("password")
+	remember, _ := strconv.ParseBool(r.Form.Get("remember"))
 
 	utils.Vln(4, "[login]", r.URL.Path, user)
+	ip := clientIP(r)
+	if wait, ok := wiki.LoginGuard.Allow(user, ip); !ok {
+		time.Sleep(time.Until(t0)) // block untill time up
+		utils.Vln(3, "[login]too many failures", user, ip, wait)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+
 	name, ok := wiki.AuthHandler.Login(user, pwd, r)
 	if !ok {
+		wiki.LoginGuard.Fail(user, ip)
 		time.Sleep(time.Until(t0)) // block untill time up
-		wiki.errNotLogin(w, r)
+		utils.Vln(3, "[login]failed", user, ip)
+		wiki.errNotLogin(w, r, nil)
 		return
 	}
+	wiki.LoginGuard.Success(user, ip)
 
 	time.Sleep(time.Until(t0)) // block untill time up
 
-	sd = startSess(wiki.Sess, w, r)
+	sd = wiki.startSess(w, r)
+	if sd == nil {
+		return
+	}
 	sd.Set("acc", name)
+	sd.Set("login", user)
+
+	if remember && _REMEMBER_TTL > 0 {
+		wiki.startRemember(w, r, name, user, utils.Now().Add(_REMEMBER_TTL))
+	}
 
 	// update CSRF
 	wiki.updateCSRF(w, r, sd)
@@ -317,15 +417,15 @@ func (wiki *Wiki) logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sd := getSess(wiki.Sess, w, r)
+	sd := wiki.getSess(w, r)
 	if sd == nil {
-		wiki.errNotLogin(w, r)
+		wiki.errNotLogin(w, r, sd)
 		return
 	}
 
 	token, ok := sd.Get("csrf")
 	if !ok {
-		wiki.errNotLogin(w, r)
+		wiki.errNotLogin(w, r, sd)
 		return
 	}
 	tokenStr, ok := token.(string)
@@ -347,10 +447,32 @@ func (wiki *Wiki) logout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	utils.Vln(4, "[logout]", r.URL.Path)
-	delSess(wiki.Sess, w, r)
+	wiki.delSess(w, r)
 }
 
-func (wiki *Wiki) errNotLogin(w http.ResponseWriter, r *http.Request) {
+// forbidden for login user without permission, like reader
+// sd is the session got by getSess() of this request, nil if none or credential failed
+// not check the credential again, Basic auth may cost a password hash
+func (wiki *Wiki) errNotLogin(w http.ResponseWriter, r *http.Request, sd *session.SessionData) {
+	if sd != nil {
+		// per-request session is only made by a valid credential
+		if _, ok := sd.Get("via"); ok || wiki.sessRole(sd) != "" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	if _, ok := bearerToken(r); ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if _, _, ok := wiki.basicAuth(r); ok {
+		wiki.basicChallenge(w)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("X-Requested-With") != "TiddlyWiki" && wiki.AuthHandler.AllowBasicAuth(r) {
+		wiki.basicChallenge(w) // not from the wiki page, avoid login dialog of browser
+	}
 	http.Error(w, "unauthorized", http.StatusUnauthorized)
 }
 
@@ -362,9 +484,6 @@ func (wiki *Wiki) list(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	isFirst := checkAndResetFirstLoad(w, r)
-	utils.Vln(4, "[list]", r.URL.Path, isFirst)
-
 	// update CSRF
 	wiki.updateCSRF(w, r, sd)
 
@@ -375,13 +494,43 @@ func (wiki *Wiki) list(w http.ResponseWriter, r *http.Request) {
 	}
 	SetHeader(w, false)
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(wiki.Store.List(tds, isFirst))
+
+	// only changes after `since`, full list if `since` newer than current (store reset)
+	// or older than dropped tombstones (deleted tiddlers may be missed)
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		since, err := strconv.ParseUint(sinceStr, 10, 64)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if since <= wiki.Store.Seq() && since >= store.SweptSeq(wiki.Store) {
+			buf, seq := wiki.Store.ListSince(tds, since)
+			utils.Vln(4, "[list]since", r.URL.Path, since, seq)
+			w.Header().Set(HEADER_CHANGE_SEQ, strconv.FormatUint(seq, 10))
+			w.Write(wiki.filterList(buf, sd))
+			return
+		}
+	}
+
+	isFirst := wiki.checkAndResetFirstLoad(w, r)
+	utils.Vln(4, "[list]", r.URL.Path, isFirst)
+
+	// get before list, client may get some changes again but never miss
+	w.Header().Set(HEADER_CHANGE_SEQ, strconv.FormatUint(wiki.Store.Seq(), 10))
+	w.Header().Set(HEADER_CHANGE_FULL, "1")
+	w.Write(wiki.filterList(wiki.Store.List(tds, isFirst), sd))
 }
 
 // TODO: check permission
 func (wiki *Wiki) tiddlers(w http.ResponseWriter, r *http.Request) {
 	utils.Vln(4, "[req]", r.Method, r.URL.Path)
 
+	// `<title>/revisions` and `<title>/revisions/<rev>`
+	if key, rev, ok := splitRevisionPath(r); ok {
+		wiki.revisions(w, r, key, rev)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodOptions:
 		w.Header().Add("Allow", "GET, PUT, OPTIONS")
@@ -407,7 +556,7 @@ func (wiki *Wiki) getTiddler(w http.ResponseWriter, r *http.Request) {
 
 	isAnno, isLogin, _, sd := wiki.checkAuth(w, r)
 	if !isAnno && !isLogin { // no anno && not login
-		wiki.errNotLogin(w, r)
+		wiki.errNotLogin(w, r, sd)
 		return
 	}
 
@@ -423,18 +572,16 @@ func (wiki *Wiki) getTiddler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
-		td = fn(r)
+		td = fn(wiki, r)
 		useCache = false
 	}
+	if !wiki.canAccess(sd, key, td, false) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
 
 	// set default value & add text back
-	td.Revision = fmt.Sprintf("%v", td.Rev)
-	if td.Bag == "" {
-		td.Bag = wiki.Recipe // "default"
-	}
-	if td.Type == "" {
-		td.Type = "text/vnd.tiddlywiki"
-	}
+	wiki.fillDefault(td)
 
 	// skip title due to not used and escape issue
 	etag := fmt.Sprintf(`"%v/%v/%v:%v"`, wiki.Recipe, "", td.Rev, hash) // recipe, title, revision, hash/checksum
@@ -470,7 +617,7 @@ func (wiki *Wiki) putTiddler(w http.ResponseWriter, r *http.Request) {
 
 	isAnno, isLogin, _, sd := wiki.checkAuthEdit(w, r)
 	if !isAnno && !isLogin { // no anno && not login
-		wiki.errNotLogin(w, r)
+		wiki.errNotLogin(w, r, sd)
 		return
 	}
 
@@ -509,31 +656,88 @@ func (wiki *Wiki) putTiddler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// both current and new one should be writable
+	if !wiki.canAccessTitle(sd, key, true) || !wiki.canAccess(sd, key, tiddler, true) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
 	// dbg
 	// meta, _ := json.MarshalIndent(tiddler, "", "\t")
 	// Vln(5, "[put]2", key, (string)(meta), tiddler.IsSkinny)
 
-	// check has file and file path is like "/files/20220201T104852-VgVjI7W_aR7_nkPT"
-	fp := getCanonicalUri(tiddler.Fields)
-	if fp != "" {
-		if wiki.fileRe.MatchString(fp) {
-			fp = path.Base(fp)
-		} else {
-			fp = ""
-		}
-	}
-
-	rev, hash := wiki.Store.Put(key, tiddler, hasMacro, fp)
+	fp := wiki.attachmentFile(tiddler)
+	rev, hash, code := wiki.putMatch(r, key, tiddler, hasMacro, fp)
 	// skip title due to not used and escape issue
 	etag := fmt.Sprintf(`"%v/%v/%v:%v"`, wiki.Recipe, "", rev, hash) // recipe, title, revision, hash/checksum
 	w.Header().Set("Etag", etag)
-	w.WriteHeader(http.StatusNoContent)
+	switch code {
+	case http.StatusPreconditionFailed:
+		utils.Vln(3, "[put]precondition failed", key, r.Header.Get("If-Match"), etag)
+		http.Error(w, "precondition failed", code)
+	case http.StatusConflict:
+		utils.Vln(3, "[put]conflict", key, tiddler.Revision, etag)
+		http.Error(w, "conflict", code)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// put tiddler with `If-Match` header or `revision` field in body
+// return http.StatusPreconditionFailed or http.StatusConflict with current revision if not match
+func (wiki *Wiki) putMatch(r *http.Request, key string, tiddler *store.TiddlyWebJSON, hasMacro bool, fp string) (rev uint64, hash string, code int) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	switch {
+	case ifMatch == "*": // any exist one
+		cur, curHash := wiki.Store.Get(key)
+		if cur == nil {
+			return 0, "", http.StatusPreconditionFailed
+		}
+		rev, hash, ok := wiki.Store.PutIf(key, cur.Rev, curHash, tiddler, hasMacro, fp)
+		if !ok {
+			return rev, hash, http.StatusPreconditionFailed
+		}
+		return rev, hash, http.StatusNoContent
+
+	case ifMatch != "":
+		for _, etag := range strings.Split(ifMatch, ",") {
+			ifRev, ifHash, ok := parseEtag(etag)
+			if !ok {
+				continue
+			}
+			rev, hash, ok = wiki.Store.PutIf(key, ifRev, ifHash, tiddler, hasMacro, fp)
+			if ok {
+				return rev, hash, http.StatusNoContent
+			}
+		}
+		if hash == "" { // no valid etag
+			cur, curHash := wiki.Store.Get(key)
+			if cur != nil {
+				rev, hash = cur.Rev, curHash
+			}
+		}
+		return rev, hash, http.StatusPreconditionFailed
+
+	case wiki.CheckRevision && tiddler.Revision != "":
+		ifRev, err := strconv.ParseUint(tiddler.Revision, 10, 64)
+		if err != nil {
+			break
+		}
+		rev, hash, ok := wiki.Store.PutIf(key, ifRev, "", tiddler, hasMacro, fp)
+		if !ok {
+			return rev, hash, http.StatusConflict
+		}
+		return rev, hash, http.StatusNoContent
+	}
+
+	rev, hash = wiki.Store.Put(key, tiddler, hasMacro, fp)
+	return rev, hash, http.StatusNoContent
 }
 
 func (wiki *Wiki) delTiddler(w http.ResponseWriter, r *http.Request) {
 	isAnno, isLogin, _, sd := wiki.checkAuthEdit(w, r)
 	if !isAnno && !isLogin { // no anno && not login
-		wiki.errNotLogin(w, r)
+		wiki.errNotLogin(w, r, sd)
 		return
 	}
 
@@ -543,6 +747,11 @@ func (wiki *Wiki) delTiddler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Path
 	utils.Vln(4, "[del]", key)
 
+	if !wiki.canAccessTitle(sd, key, true) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
 	ok, file := wiki.Store.Del(key)
 	if !ok {
 		http.Error(w, "not found", http.StatusNotFound)
@@ -559,6 +768,41 @@ func (wiki *Wiki) delTiddler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// drop expired history of deleted tiddlers, and remove attachment files not used by any kept revision
+// return count of removed files
+func (wiki *Wiki) Sweep() int {
+	files := store.Sweep(wiki.Store)
+	for _, file := range files {
+		saveFp := filepath.Join(wiki.Files, file)
+		os.Remove(saveFp)
+	}
+	return len(files)
+}
+
+// set default value for output
+func (wiki *Wiki) fillDefault(td *store.TiddlyWebJSON) {
+	td.Revision = fmt.Sprintf("%v", td.Rev)
+	if td.Bag == "" {
+		td.Bag = wiki.Recipe // "default"
+	}
+	if td.Type == "" {
+		td.Type = "text/vnd.tiddlywiki"
+	}
+}
+
+// check has file and file path is like "/files/20220201T104852-VgVjI7W_aR7_nkPT" (under path prefix)
+func (wiki *Wiki) attachmentFile(tiddler *store.TiddlyWebJSON) string {
+	fp := getCanonicalUri(tiddler.Fields)
+	if fp != "" {
+		if wiki.fileRe.MatchString(fp) {
+			fp = path.Base(fp)
+		} else {
+			fp = ""
+		}
+	}
+	return fp
+}
+
 // skip `$:/StoryList` and `$:/HistoryList`
 // https://tiddlywiki.com/#Hidden%20Setting%3A%20Sync%20System%20Tiddlers%20From%20Server
 func (wiki *Wiki) skipTiddler(w http.ResponseWriter, key string) bool {
@@ -577,16 +821,16 @@ func (wiki *Wiki) skipTiddler(w http.ResponseWriter, key string) bool {
 
 func (wiki *Wiki) upload(w http.ResponseWriter, r *http.Request) {
 	// TODO: session timeout when uploading?
-	isAnno, isLogin, _, _ := wiki.checkAuthEdit(w, r)
+	isAnno, isLogin, _, sd := wiki.checkAuthEdit(w, r)
 	if !isAnno && !isLogin { // no anno && not login
-		wiki.errNotLogin(w, r)
+		wiki.errNotLogin(w, r, sd)
 		return
 	}
 
 	r.Body = http.MaxBytesReader(w, r.Body, wiki.UploadFileSizeLimit)
 	err := r.ParseMultipartForm(wiki.ParseMemoryLimit)
 	if err != nil {
-		utils.Vln(0, "[upload]parse multipart-form error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+		utils.Vln(0, "[upload]parse multipart-form error", clientIP(r), r.Method, r.URL, r.Referer(), r.UserAgent(), err)
 		return
 	}
 
@@ -605,7 +849,7 @@ func (wiki *Wiki) upload(w http.ResponseWriter, r *http.Request) {
 	fh := fhs[0]
 	file, err := fh.Open()
 	if err != nil {
-		utils.Vln(3, "[upload]parse file error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err, meta)
+		utils.Vln(3, "[upload]parse file error", clientIP(r), r.Method, r.URL, r.Referer(), r.UserAgent(), err, meta)
 		return
 	}
 	attach, erroeText, errCode := wiki.saveFile(file, fh, r)
@@ -625,10 +869,19 @@ func (wiki *Wiki) upload(w http.ResponseWriter, r *http.Request) {
 	tiddler, hasMacro, err := parseMeta(([]byte)(meta[0]))
 	if err != nil {
 		utils.Vln(3, "[upload]meta error", meta, err)
+		attach.DelFromFS(wiki.Files)
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
 
+	// same as put, both current and new one should be writable
+	if !wiki.canAccessTitle(sd, tiddler.Title, true) || !wiki.canAccess(sd, tiddler.Title, tiddler, true) {
+		utils.Vln(3, "[upload]forbidden", clientIP(r), tiddler.Title)
+		attach.DelFromFS(wiki.Files)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
 	// save as tiddler first
 	wiki.Store.Put(tiddler.Title, tiddler, hasMacro, "")
 
@@ -650,14 +903,14 @@ func (wiki *Wiki) saveFile(file multipart.File, handler *multipart.FileHeader, r
 	saveFp := filepath.Join(wiki.Files, attach.SaveName)
 	fd, err := os.OpenFile(saveFp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
-		utils.Vln(3, "[upload]open save file error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+		utils.Vln(3, "[upload]open save file error", clientIP(r), r.Method, r.URL, r.Referer(), r.UserAgent(), err)
 		return nil, "internal server error", http.StatusInternalServerError
 	}
 	defer fd.Close()
 
 	// save file
 	// if _, err := io.Copy(fd, file); err != nil {
-	// 	utils.Vln(3, "[upload]write save file error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+	// 	utils.Vln(3, "[upload]write save file error", clientIP(r), r.Method, r.URL, r.Referer(), r.UserAgent(), err)
 	// 	return nil, "internal server error", http.StatusInternalServerError
 	// }
 
@@ -665,7 +918,7 @@ func (wiki *Wiki) saveFile(file multipart.File, handler *multipart.FileHeader, r
 	// save and calc hash
 	hash, err := cpAndHashFd(fd, file)
 	if err != nil {
-		utils.Vln(3, "[upload]save and hash file error", r.RemoteAddr, r.Method, r.URL, r.Referer(), r.UserAgent(), err)
+		utils.Vln(3, "[upload]save and hash file error", clientIP(r), r.Method, r.URL, r.Referer(), r.UserAgent(), err)
 		return nil, "internal server error", http.StatusInternalServerError
 	}
 	attach.Checksum = hash
@@ -673,9 +926,9 @@ func (wiki *Wiki) saveFile(file multipart.File, handler *multipart.FileHeader, r
 }
 
 func (wiki *Wiki) serveFile(w http.ResponseWriter, r *http.Request) {
-	isAnno, isLogin, _, _ := wiki.checkAuthStatic(w, r)
+	isAnno, isLogin, _, sd := wiki.checkAuthStatic(w, r)
 	if !isAnno && !isLogin { // no anno && not login
-		wiki.errNotLogin(w, r)
+		wiki.errNotLogin(w, r, sd)
 		return
 	}
 
@@ -711,6 +964,7 @@ func NewWiki(mux *Mux, db store.Store, sess session.SessionStore) *Wiki {
 		Mux:                 mux,
 		AuthHandler:         &auth.AuthAllowAll{},
 		Sess:                sess,
+		LoginGuard:          auth.NewLoginGuard(nil),
 		Store:               db,
 		Base:                "index.html",
 		Recipe:              "default",
@@ -718,10 +972,29 @@ func NewWiki(mux *Mux, db store.Store, sess session.SessionStore) *Wiki {
 		UploadFileSizeLimit: DefaultUploadFileSizeLimit,
 		ParseMemoryLimit:    DefaultParseMemoryLimit,
 		TiddlerSizeLimit:    DefaultTiddlerSizeLimit,
+		closed:              make(chan struct{}),
 	}
+	base := ""
+	if mux != nil {
+		base = mux.Base()
+	}
+	wiki.fileRe = fileRegexp(base)
 	return wiki
 }
 
+// end long-lived requests (Server-Sent Events), for wiki replaced by a new config
+// clients connect again and are checked by the new one
+func (wiki *Wiki) Close() {
+	wiki.closeOnce.Do(func() {
+		close(wiki.closed)
+	})
+}
+
+// attachment path like "/files/20220201T104852-VgVjI7W_aR7_nkPT", with or without path prefix
+func fileRegexp(base string) *regexp.Regexp {
+	return regexp.MustCompile(`^(` + regexp.QuoteMeta(base) + `)?/?files/(\d){8}T(\d){6}-([A-Za-z0-9\-_]){16}$`)
+}
+
 type WikiStatus struct {
 	Username  string `json:"username"` // "GUEST" === not login
 	Anonymous bool   `json:"anonymous"`
@@ -759,17 +1032,35 @@ func parseMeta(meta []byte) (*store.TiddlyWebJSON, bool, error) {
 		return nil, false, err
 	}
 
-	// check `$:/tags/Macro` tag exist or not
-	hasMacro := false
+	return tiddler, hasMacroTag(tiddler), err
+}
+
+// check `$:/tags/Macro` tag exist or not
+func hasMacroTag(tiddler *store.TiddlyWebJSON) bool {
 	if tiddler.Tags != nil {
 		for _, tag := range *tiddler.Tags {
 			if tag == TAGS_MACRO {
-				hasMacro = true
-				break
+				return true
 			}
 		}
 	}
-	return tiddler, hasMacro, err
+	return false
+}
+
+// parse etag like `"default/title/3:hash"` or `W/"default//3:hash"`
+func parseEtag(etag string) (rev uint64, hash string, ok bool) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	etag = strings.Trim(etag, `"`)
+	slash := strings.LastIndex(etag, "/")
+	colon := strings.LastIndex(etag, ":")
+	if slash < 0 || colon < slash {
+		return 0, "", false
+	}
+	rev, err := strconv.ParseUint(etag[slash+1:colon], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return rev, etag[colon+1:], true
 }
 
 func getCanonicalUri(fields *store.TiddlerFields) string {
@@ -807,20 +1098,32 @@ func JsonRes(w http.ResponseWriter, value interface{}, cors bool) {
 	}
 }
 
+// path prefix of wiki, empty for root
+func (wiki *Wiki) basePath() string {
+	if wiki.Mux == nil {
+		return ""
+	}
+	return wiki.Mux.Base()
+}
+
+func (wiki *Wiki) cookiePath() string {
+	return wiki.basePath() + "/"
+}
+
 // func cleanPath(fp string) string {
 // 	return filepath.FromSlash(path.Clean("/" + fp))
 // }
 
 // set in "/status"
 // check and reset in "/recipes/default/tiddlers.json"
-func setFirstLoad(w http.ResponseWriter, r *http.Request) {
+func (wiki *Wiki) setFirstLoad(w http.ResponseWriter, r *http.Request) {
 	_, err := r.Cookie(_FIRST_LOAD_COOKIE)
 	if err == http.ErrNoCookie {
 		// set cookie
 		http.SetCookie(w, &http.Cookie{
 			Name:     _FIRST_LOAD_COOKIE,
 			Value:    "1",
-			Path:     "/", // TODO: by sub path
+			Path:     wiki.cookiePath(),
 			HttpOnly: true,
 			SameSite: http.SameSiteStrictMode,
 			MaxAge:   int(_COOKIE_TTL.Seconds()),
@@ -828,7 +1131,7 @@ func setFirstLoad(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 }
-func checkAndResetFirstLoad(w http.ResponseWriter, r *http.Request) bool {
+func (wiki *Wiki) checkAndResetFirstLoad(w http.ResponseWriter, r *http.Request) bool {
 	_, err := r.Cookie(_FIRST_LOAD_COOKIE)
 	if err == http.ErrNoCookie {
 		return false
@@ -838,7 +1141,7 @@ func checkAndResetFirstLoad(w http.ResponseWriter, r *http.Request) bool {
 	http.SetCookie(w, &http.Cookie{
 		Name:     _FIRST_LOAD_COOKIE,
 		Value:    "",
-		Path:     "/", // TODO: by sub path
+		Path:     wiki.cookiePath(),
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
 		Expires:  utils.Now(),
@@ -847,12 +1150,12 @@ func checkAndResetFirstLoad(w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
-func setSessionCookie(w http.ResponseWriter, token string) {
+func (wiki *Wiki) setSessionCookie(w http.ResponseWriter, token string) {
 	// update cookie
 	cookie := &http.Cookie{
 		Name:     _SESSION_COOKIE,
 		Value:    token,
-		Path:     "/", // TODO: by sub path
+		Path:     wiki.cookiePath(),
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
 		Expires:  utils.Now().Add(_COOKIE_TTL),
@@ -861,25 +1164,35 @@ func setSessionCookie(w http.ResponseWriter, token string) {
 	http.SetCookie(w, cookie)
 }
 
-func getSess(sess session.SessionStore, w http.ResponseWriter, r *http.Request) *session.SessionData {
+func (wiki *Wiki) getSess(w http.ResponseWriter, r *http.Request) *session.SessionData {
+	if token, ok := bearerToken(r); ok {
+		return wiki.tokenSess(r, token)
+	}
+	if user, pwd, ok := wiki.basicAuth(r); ok {
+		return wiki.basicSess(r, user, pwd)
+	}
+	if sd := wiki.proxySess(r); sd != nil {
+		return sd
+	}
+
 	cookie, err := r.Cookie(_SESSION_COOKIE)
 	if err != nil || cookie.Value == "" {
-		return nil
+		return wiki.resumeSess(w, r)
 	}
 
 	token := cookie.Value
-	sd := sess.GetOrRenew(token)
+	sd := wiki.Sess.GetOrRenew(token)
 	if sd == nil { // timeout?
-		return nil
+		return wiki.resumeSess(w, r)
 	}
 
 	// update cookie
-	setSessionCookie(w, token)
+	wiki.setSessionCookie(w, token)
 
 	return sd
 }
 
-func delSess(sess session.SessionStore, w http.ResponseWriter, r *http.Request) {
+func (wiki *Wiki) delSess(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie(_SESSION_COOKIE)
 	if err != nil || cookie.Value == "" {
 		http.Error(w, "forbidden", http.StatusForbidden)
@@ -887,31 +1200,135 @@ func delSess(sess session.SessionStore, w http.ResponseWriter, r *http.Request)
 	}
 
 	token := cookie.Value
-	sess.Destroy(token)
+	wiki.Sess.Destroy(token)
 
 	// force cookie timeout
 	cookieSet := &http.Cookie{
 		Name:     _SESSION_COOKIE,
+		Path:     wiki.cookiePath(),
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
 		Expires:  utils.Now(),
 		MaxAge:   -1,
 	}
 	http.SetCookie(w, cookieSet)
+
+	// also forget "remember me"
+	if cookie, err := r.Cookie(_REMEMBER_COOKIE); err == nil && cookie.Value != "" {
+		wiki.Sess.Destroy(cookie.Value)
+		wiki.setRememberCookie(w, "", time.Time{})
+	}
+}
+
+// "remember me" token is kept in session store with fixed deadline,
+// but with different keys, so can not be used as a session
+func (wiki *Wiki) startRemember(w http.ResponseWriter, r *http.Request, acc string, login string, deadline time.Time) {
+	token, rd := wiki.Sess.NewToken()
+	if rd == nil {
+		return
+	}
+	setSessionClient(rd, r)
+	rd.SetDeadline(deadline)
+	rd.Set("remember-acc", acc)
+	rd.Set("remember-login", login)
+	wiki.setRememberCookie(w, token, deadline)
+}
+
+// empty token for delete cookie
+func (wiki *Wiki) setRememberCookie(w http.ResponseWriter, token string, deadline time.Time) {
+	cookie := &http.Cookie{
+		Name:     _REMEMBER_COOKIE,
+		Value:    token,
+		Path:     wiki.cookiePath(),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  deadline,
+		MaxAge:   int(time.Until(deadline).Seconds()),
+	}
+	if token == "" {
+		cookie.Expires = utils.Now()
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
 }
 
-func startSess(sess session.SessionStore, w http.ResponseWriter, r *http.Request) *session.SessionData {
-	token, sd := sess.NewToken()
+// start a new session by "remember me" token
+// the token can only be used once, a new one with same deadline is issued
+func (wiki *Wiki) resumeSess(w http.ResponseWriter, r *http.Request) *session.SessionData {
+	cookie, err := r.Cookie(_REMEMBER_COOKIE)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+
+	rd := wiki.Sess.Take(cookie.Value)
+	if rd == nil { // timeout or used, keep cookie which may be replaced by a parallel request
+		return wiki.resumeUsed(w, cookie.Value)
+	}
+	v0, ok0 := rd.Get("remember-acc")
+	v1, ok1 := rd.Get("remember-login")
+	acc, _ := v0.(string)
+	login, _ := v1.(string)
+	if !ok0 || !ok1 {
+		wiki.setRememberCookie(w, "", time.Time{})
+		return nil
+	}
+
+	token, sd := wiki.newSess(w, r)
 	if sd == nil {
-		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return nil
 	}
+	sd.Set("acc", acc)
+	sd.Set("login", login)
+	wiki.startRemember(w, r, acc, login, rd.Deadline())
 
-	// update cookie
-	setSessionCookie(w, token)
+	// map used token to the new session for a while
+	gd := wiki.Sess.New(usedRememberKey(cookie.Value))
+	gd.SetDeadline(utils.Now().Add(_REMEMBER_GRACE))
+	gd.Set("resumed", token)
+
+	utils.Vln(4, "[login]remember", r.URL.Path, login)
 	return sd
 }
 
+// session resumed by a used "remember me" token in grace period
+func (wiki *Wiki) resumeUsed(w http.ResponseWriter, used string) *session.SessionData {
+	gd := wiki.Sess.GetOrRenew(usedRememberKey(used)) // not extended, fixed deadline
+	if gd == nil {
+		return nil
+	}
+	token, _ := getString(gd, "resumed")
+	sd := wiki.Sess.GetOrRenew(token)
+	if sd == nil { // logout or revoked
+		return nil
+	}
+	wiki.setSessionCookie(w, token)
+	return sd
+}
+
+// not a valid token, tokens are url-safe base64
+func usedRememberKey(token string) string {
+	return "used:" + token
+}
+
+func (wiki *Wiki) startSess(w http.ResponseWriter, r *http.Request) *session.SessionData {
+	_, sd := wiki.newSess(w, r)
+	return sd
+}
+
+func (wiki *Wiki) newSess(w http.ResponseWriter, r *http.Request) (string, *session.SessionData) {
+	token, sd := wiki.Sess.NewToken()
+	if sd == nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return "", nil
+	}
+
+	setSessionClient(sd, r)
+
+	// update cookie
+	wiki.setSessionCookie(w, token)
+	return token, sd
+}
+
 func writeNotModified(w http.ResponseWriter) {
 	// RFC 7232 section 4.1:
 	// a sender SHOULD NOT generate representation metadata other than the
@@ -0,0 +1,495 @@
+package tiddlywikid
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tiddlywikid/auth"
+	"tiddlywikid/session"
+	"tiddlywikid/store"
+)
+
+func newTestWiki(t *testing.T, authConf string) *Wiki {
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "user.json")
+	if err := os.WriteFile(fp, []byte(authConf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	acl := auth.NewAuthCustom()
+	if err := acl.Load(fp); err != nil {
+		t.Fatal(err)
+	}
+
+	wiki := NewWiki(nil, store.NewMemStore(), nil)
+	wiki.AuthHandler = acl
+	wiki.Files = filepath.Join(dir, "files")
+	if err := os.Mkdir(wiki.Files, 0755); err != nil {
+		t.Fatal(err)
+	}
+	wiki.SetupMux(nil)
+	return wiki
+}
+
+func uploadReq(title string, token string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("meta", fmt.Sprintf(`{"title": %q, "type": "image/png"}`, title))
+	fw, _ := mw.CreateFormFile("text", "a.png")
+	fw.Write([]byte("png"))
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestUploadTokenPrefix(t *testing.T) {
+	token, hash, err := auth.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wiki := newTestWiki(t, fmt.Sprintf(`{
+	"allow-anonymous": { "def": false },
+	"allow-anonymous-edit": { "def": false },
+	"users": [
+		{ "id": "alice", "hash": "", "tokens": [{ "name": "journal", "hash": %q, "prefix": "Journal/" }] }
+	]
+}`, hash))
+
+	var testCase = []struct {
+		Title string
+		Code  int
+	}{
+		{"Journal/a.png", http.StatusOK},
+		{"Secret/a.png", http.StatusForbidden},
+	}
+	for _, tc := range testCase {
+		w := httptest.NewRecorder()
+		wiki.ServeHTTP(w, uploadReq(tc.Title, token))
+		if w.Code != tc.Code {
+			t.Fatal("upload", tc.Title, "should be", tc.Code, "got", w.Code, w.Body.String())
+		}
+		td, _ := wiki.Store.Get(tc.Title)
+		if (td != nil) != (tc.Code == http.StatusOK) {
+			t.Fatal("upload", tc.Title, "stored:", td != nil)
+		}
+	}
+
+	// attachment of forbidden one is removed
+	files, _ := os.ReadDir(wiki.Files)
+	if len(files) != 1 {
+		t.Fatal("should only keep 1 attachment, got", len(files))
+	}
+}
+
+func TestAdminNeedLogin(t *testing.T) {
+	wiki := NewWiki(nil, store.NewMemStore(), nil) // AuthAllowAll
+	wiki.SetupMux(nil)
+
+	w := httptest.NewRecorder()
+	wiki.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/sessions", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatal("admin api without login should be forbidden, got", w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/challenge/tiddlywebplugins.tiddlyspace.cookie_form", strings.NewReader("user=any&password=any"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Requested-With", "TiddlyWiki")
+	w = httptest.NewRecorder()
+	wiki.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatal("login failed", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/admin/sessions", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	wiki.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal("admin api after login should be allowed, got", w.Code)
+	}
+}
+
+type countLogin struct {
+	*auth.AuthCustom
+	count int
+}
+
+func (a *countLogin) Login(user string, pwd string, req *http.Request) (string, bool) {
+	a.count++
+	return a.AuthCustom.Login(user, pwd, req)
+}
+
+func TestBasicAuthHashOnce(t *testing.T) {
+	// argon2id hash of "test"
+	wiki := newTestWiki(t, `{
+	"allow-anonymous": { "def": false },
+	"allow-anonymous-edit": { "def": false },
+	"basic-auth": { "def": true },
+	"users": [
+		{ "id": "bob", "role": "reader", "hash": "$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$sAUIydaCcefYQ9MutI+XFcqYtHACStVvDYyQfJ2NStw" }
+	]
+}`)
+	acl := &countLogin{AuthCustom: wiki.AuthHandler.(*auth.AuthCustom)}
+	wiki.AuthHandler = acl
+
+	var testCase = []struct {
+		Pwd  string
+		Code int
+	}{
+		{"test", http.StatusForbidden}, // reader can not edit
+		{"wrong", http.StatusUnauthorized},
+	}
+	for _, tc := range testCase {
+		acl.count = 0
+		r := httptest.NewRequest(http.MethodPut, "/recipes/default/tiddlers/Note", strings.NewReader(`{"title": "Note"}`))
+		r.SetBasicAuth("bob", tc.Pwd)
+		w := httptest.NewRecorder()
+		wiki.ServeHTTP(w, r)
+		if w.Code != tc.Code {
+			t.Fatal("password", tc.Pwd, "should be", tc.Code, "got", w.Code)
+		}
+		if acl.count != 1 {
+			t.Fatal("password should be checked once, got", acl.count)
+		}
+	}
+}
+
+func TestRevisionsOfDeleted(t *testing.T) {
+	wiki := NewWiki(nil, store.NewMemStore(), nil) // AuthAllowAll
+	wiki.SetupMux(nil)
+
+	var testCase = []struct {
+		Method string
+		Path   string
+		Body   string
+		Code   int
+	}{
+		{http.MethodPut, "/recipes/default/tiddlers/A", `{"title": "A", "text": "v1"}`, http.StatusNoContent},
+		{http.MethodDelete, "/bags/default/tiddlers/A", "", http.StatusNoContent},
+		{http.MethodGet, "/recipes/default/tiddlers/A", "", http.StatusNotFound},
+		{http.MethodGet, "/recipes/default/tiddlers/A/revisions", "", http.StatusOK},
+		{http.MethodGet, "/recipes/default/tiddlers/A/revisions/1", "", http.StatusOK},
+		{http.MethodPost, "/recipes/default/tiddlers/A/revisions/1", "", http.StatusNoContent},
+		{http.MethodGet, "/recipes/default/tiddlers/A", "", http.StatusOK},
+	}
+	for _, tc := range testCase {
+		r := httptest.NewRequest(tc.Method, tc.Path, strings.NewReader(tc.Body))
+		r.Header.Set("X-Requested-With", "TiddlyWiki")
+		w := httptest.NewRecorder()
+		wiki.ServeHTTP(w, r)
+		if w.Code != tc.Code {
+			t.Fatal(tc.Method, tc.Path, "should be", tc.Code, "got", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestDeletedPrivateHidden(t *testing.T) {
+	token, hash, err := auth.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wiki := newTestWiki(t, fmt.Sprintf(`{
+	"allow-anonymous": { "def": false },
+	"allow-anonymous-edit": { "def": false },
+	"users": [
+		{ "id": "alice", "hash": "" },
+		{ "id": "bob", "hash": "", "tokens": [{ "name": "bob", "hash": %q }] }
+	],
+	"tiddlers": [
+		{ "match": "[tag[private]]", "read": ["alice"] }
+	]
+}`, hash))
+
+	private := store.TiddlerTags{"private"}
+	wiki.Store.Put("Diary", &store.TiddlyWebJSON{Title: "Diary", Tags: &private}, false, "")
+	wiki.Store.Put("Note", &store.TiddlyWebJSON{Title: "Note"}, false, "")
+	wiki.Store.Del("Diary")
+	wiki.Store.Del("Note")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		wiki.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/recipes/default/tiddlers.json?since=0")
+	if !strings.Contains(w.Body.String(), `"Note"`) || strings.Contains(w.Body.String(), `"Diary"`) {
+		t.Fatal("tombstone of private tiddler should be hidden", w.Body.String())
+	}
+	if w := get("/recipes/default/tiddlers/Diary/revisions"); w.Code != http.StatusNotFound {
+		t.Fatal("revisions of deleted private tiddler should be hidden", w.Code, w.Body.String())
+	}
+	if w := get("/recipes/default/tiddlers/Note/revisions"); w.Code != http.StatusOK {
+		t.Fatal("revisions of deleted tiddler should be found", w.Code)
+	}
+}
+
+func TestTaggedRecentACL(t *testing.T) {
+	token, hash, err := auth.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wiki := newTestWiki(t, fmt.Sprintf(`{
+	"allow-anonymous": { "def": false },
+	"allow-anonymous-edit": { "def": false },
+	"users": [
+		{ "id": "bob", "hash": "", "tokens": [{ "name": "bob", "hash": %q }] }
+	],
+	"tiddlers": [
+		{ "match": "[tag[private]]", "read": ["alice"] }
+	]
+}`, hash))
+
+	private := store.TiddlerTags{"todo", "private"}
+	todo := store.TiddlerTags{"todo"}
+	wiki.Store.Put("Secret", &store.TiddlyWebJSON{Title: "Secret", Modified: "20230103000000000", Tags: &private}, false, "")
+	wiki.Store.Put("Task", &store.TiddlyWebJSON{Title: "Task", Modified: "20230102000000000", Tags: &todo}, false, "")
+	wiki.Store.Put("Note", &store.TiddlyWebJSON{Title: "Note", Modified: "20230101000000000"}, false, "")
+
+	var testCase = []struct {
+		Path string
+		Out  string
+	}{
+		{"/recipes/default/tagged?tag=todo", `["Task"]`},
+		{"/recipes/default/recent?limit=1", `["Task"]`}, // limit after filter
+		{"/recipes/default/recent", `["Task","Note"]`},
+	}
+	for _, tc := range testCase {
+		r := httptest.NewRequest(http.MethodGet, tc.Path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		wiki.ServeHTTP(w, r)
+		if out := strings.TrimSpace(w.Body.String()); out != tc.Out {
+			t.Fatal(tc.Path, "should be", tc.Out, "got", w.Code, out)
+		}
+	}
+}
+
+func TestSweepFullList(t *testing.T) {
+	s := store.NewMemStore()
+	s.SetRevisionPolicy(0, 0)
+	wiki := NewWiki(nil, s, nil) // AuthAllowAll
+	wiki.Files = t.TempDir()
+	wiki.SetupMux(nil)
+
+	fp := filepath.Join(wiki.Files, "f1")
+	os.WriteFile(fp, []byte("png"), 0600)
+	s.Put("A", &store.TiddlyWebJSON{Title: "A"}, false, "f1")
+	s.Put("A", &store.TiddlyWebJSON{Title: "A"}, false, "") // f1 unused now
+	s.Put("B", &store.TiddlyWebJSON{Title: "B"}, false, "")
+	s.Del("B")
+	if n := wiki.Sweep(); n != 1 {
+		t.Fatal("one file should be removed, got", n)
+	}
+	if _, err := os.Stat(fp); !os.IsNotExist(err) {
+		t.Fatal("file should be removed", err)
+	}
+
+	var testCase = []struct {
+		Since string
+		Full  string
+	}{
+		{"3", "1"}, // before dropped tombstone of B
+		{"4", ""},
+	}
+	for _, tc := range testCase {
+		r := httptest.NewRequest(http.MethodGet, "/recipes/default/tiddlers.json?since="+tc.Since, nil)
+		r.Header.Set("X-Requested-With", "TiddlyWiki")
+		w := httptest.NewRecorder()
+		wiki.ServeHTTP(w, r)
+		if full := w.Header().Get(HEADER_CHANGE_FULL); full != tc.Full {
+			t.Fatal("since", tc.Since, "full should be", tc.Full, "got", full, w.Body.String())
+		}
+	}
+}
+
+func TestRememberParallel(t *testing.T) {
+	wiki := NewWiki(nil, nil, nil)
+	wiki.SetupMux(nil)
+
+	w := httptest.NewRecorder()
+	wiki.startRemember(w, httptest.NewRequest(http.MethodPost, "/login", nil), "Bob", "bob", time.Now().Add(time.Hour))
+	remember := w.Result().Cookies()[0]
+
+	// same remember cookie from two requests, both resume the same session
+	sds := make([]*session.SessionData, 0, 2)
+	cookies := make([]map[string]*http.Cookie, 0, 2)
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		r.AddCookie(remember)
+		w := httptest.NewRecorder()
+		sds = append(sds, wiki.getSess(w, r))
+		set := make(map[string]*http.Cookie)
+		for _, c := range w.Result().Cookies() {
+			set[c.Name] = c
+		}
+		cookies = append(cookies, set)
+	}
+	if sds[0] == nil || sds[0] != sds[1] {
+		t.Fatal("parallel request should resume the same session", sds)
+	}
+	if cookies[0][_SESSION_COOKIE].Value != cookies[1][_SESSION_COOKIE].Value {
+		t.Fatal("session cookie should be same")
+	}
+	if _, ok := cookies[1][_REMEMBER_COOKIE]; ok {
+		t.Fatal("remember cookie should not be changed by used token")
+	}
+
+	// revoked session is not resumed by used token
+	wiki.Sess.Destroy(cookies[0][_SESSION_COOKIE].Value)
+	r := httptest.NewRequest(http.MethodGet, "/status", nil)
+	r.AddCookie(remember)
+	if sd := wiki.getSess(httptest.NewRecorder(), r); sd != nil {
+		t.Fatal("destroyed session should not be resumed")
+	}
+}
+
+func TestEventsClosed(t *testing.T) {
+	wiki := newTestWiki(t, `{
+	"allow-anonymous": { "def": false },
+	"users": [{ "id": "bob", "hash": "" }]
+}`)
+	wiki.Store = store.NewWatchStore(wiki.Store)
+	srv := httptest.NewServer(wiki)
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // end streams left open on failure
+
+	// read events until stream end, send each event name
+	connect := func(token string) <-chan string {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/recipes/default/events", nil)
+		req.AddCookie(&http.Cookie{Name: _SESSION_COOKIE, Value: token})
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatal("events should be allowed for login", res.StatusCode)
+		}
+		ch := make(chan string)
+		go func() {
+			defer close(ch)
+			defer res.Body.Close()
+			sc := bufio.NewScanner(res.Body)
+			for sc.Scan() {
+				line := sc.Text()
+				if strings.HasPrefix(line, "retry:") || strings.HasPrefix(line, "event:") {
+					ch <- line
+				}
+			}
+		}()
+		if line := <-ch; !strings.HasPrefix(line, "retry:") {
+			t.Fatal("stream should start with retry", line)
+		}
+		return ch
+	}
+	next := func(ch <-chan string) (string, bool) {
+		select {
+		case line, ok := <-ch:
+			return line, ok
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream neither sent event nor ended")
+			return "", false
+		}
+	}
+	login := func() string {
+		token, sd := wiki.Sess.NewToken()
+		sd.Set("acc", "bob")
+		sd.Set("login", "bob")
+		return token
+	}
+
+	token := login()
+	ch := connect(token)
+	wiki.Store.Put("A", &store.TiddlyWebJSON{Title: "A"}, false, "")
+	if line, ok := next(ch); !ok || line != "event: put" {
+		t.Fatal("put event should be sent", line, ok)
+	}
+
+	// logout or revoked
+	wiki.Sess.Destroy(token)
+	wiki.Store.Put("B", &store.TiddlyWebJSON{Title: "B"}, false, "")
+	if line, ok := next(ch); ok {
+		t.Fatal("stream should end after session removed", line)
+	}
+
+	// replaced by new config
+	ch = connect(login())
+	wiki.Close()
+	if line, ok := next(ch); ok {
+		t.Fatal("stream should end after wiki closed", line)
+	}
+}
+
+func TestPutMatch(t *testing.T) {
+	wiki := NewWiki(nil, store.NewMemStore(), nil) // AuthAllowAll
+	wiki.SetupMux(nil)
+
+	put := func(ifMatch string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/recipes/default/tiddlers/A", strings.NewReader(body))
+		r.Header.Set("X-Requested-With", "TiddlyWiki")
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		wiki.ServeHTTP(w, r)
+		return w
+	}
+
+	// `*` only for exist one
+	if w := put("*", `{"title": "A", "text": "v0"}`); w.Code != http.StatusPreconditionFailed {
+		t.Fatal("If-Match * should fail for not exist tiddler", w.Code)
+	}
+	w := put("", `{"title": "A", "text": "v1"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatal("put failed", w.Code)
+	}
+	etag1 := w.Header().Get("Etag")
+	w = put("*", `{"title": "A", "text": "v2"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatal("If-Match * should write exist tiddler", w.Code)
+	}
+	etag2 := w.Header().Get("Etag")
+
+	// stale etag get current one
+	w = put(etag1, `{"title": "A", "text": "x"}`)
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("Etag") != etag2 {
+		t.Fatal("stale If-Match should fail with current Etag", w.Code, w.Header().Get("Etag"), etag2)
+	}
+	if w := put(`"default//1:x", `+etag2, `{"title": "A", "text": "v3"}`); w.Code != http.StatusNoContent {
+		t.Fatal("any matched etag should write", w.Code)
+	}
+
+	// `revision` field only checked with CheckRevision
+	if w := put("", `{"title": "A", "text": "v4", "revision": "1"}`); w.Code != http.StatusNoContent {
+		t.Fatal("revision field should be ignored by default", w.Code)
+	}
+	wiki.CheckRevision = true
+	w = put("", `{"title": "A", "text": "x", "revision": "1"}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Header().Get("Etag"), "/4:") {
+		t.Fatal("stale revision field should conflict with current Etag", w.Code, w.Header().Get("Etag"))
+	}
+	if w := put("", `{"title": "A", "text": "v5", "revision": "4"}`); w.Code != http.StatusNoContent {
+		t.Fatal("current revision field should write", w.Code)
+	}
+
+	if td, _ := wiki.Store.Get("A"); td == nil || td.Text != "v5" || td.Rev != 5 {
+		t.Fatal("failed put should not write", td)
+	}
+}
@@ -9,6 +9,36 @@ type Auth interface {
 	AllowAnonymousAccessStaticFile(req *http.Request) bool // TODO: implement
 	AllowAnonymousEdit(req *http.Request) bool
 	Login(user string, pwd string, req *http.Request) (displayName string, ok bool)
+	LoginToken(token string, req *http.Request) (login string, displayName string, tk *Token, ok bool) // API token
+	LoginProxy(req *http.Request) (login string, displayName string, role string, ok bool)             // by header from trusted proxy
+	AllowBasicAuth(req *http.Request) bool                                                             // accept `Authorization: Basic` on every request
+	IsAdmin(login string) bool                                                                         // for admin api, login is empty for not login
+	Role(login string) string                                                                          // role of login user, empty for no such user
+	TiddlerACL() *TiddlerACL                                                                           // per-tiddler rules, nil for no rule
+}
+
+const (
+	ROLE_READER = "reader" // read only
+	ROLE_EDITOR = "editor" // read, edit, delete and upload
+	ROLE_ADMIN  = "admin"  // editor with admin api
+)
+
+var roleLevel = map[string]int{
+	ROLE_READER: 1,
+	ROLE_EDITOR: 2,
+	ROLE_ADMIN:  3,
+}
+
+func ValidRole(role string) bool {
+	return roleLevel[role] > 0
+}
+
+func CanRead(role string) bool {
+	return roleLevel[role] >= roleLevel[ROLE_READER]
+}
+
+func CanEdit(role string) bool {
+	return roleLevel[role] >= roleLevel[ROLE_EDITOR]
 }
 
 type AuthAllowAll struct{}
@@ -29,6 +59,30 @@ func (a *AuthAllowAll) Login(user string, pwd string, req *http.Request) (displa
 	return "", true
 }
 
+func (a *AuthAllowAll) LoginToken(token string, req *http.Request) (login string, displayName string, tk *Token, ok bool) {
+	return "", "", nil, false
+}
+
+func (a *AuthAllowAll) LoginProxy(req *http.Request) (login string, displayName string, role string, ok bool) {
+	return "", "", "", false
+}
+
+func (a *AuthAllowAll) AllowBasicAuth(req *http.Request) bool {
+	return false
+}
+
+func (a *AuthAllowAll) IsAdmin(login string) bool {
+	return true
+}
+
+func (a *AuthAllowAll) Role(login string) string {
+	return ROLE_ADMIN
+}
+
+func (a *AuthAllowAll) TiddlerACL() *TiddlerACL {
+	return nil
+}
+
 // make sure AuthAllowAll implement Auth
 var _ Auth = (*AuthAllowAll)(nil)
 
@@ -50,5 +104,32 @@ func (a *AuthAnnoRead) Login(user string, pwd string, req *http.Request) (displa
 	return "", user == "aaa" && pwd == "123"
 }
 
+func (a *AuthAnnoRead) LoginToken(token string, req *http.Request) (login string, displayName string, tk *Token, ok bool) {
+	return "", "", nil, false
+}
+
+func (a *AuthAnnoRead) LoginProxy(req *http.Request) (login string, displayName string, role string, ok bool) {
+	return "", "", "", false
+}
+
+func (a *AuthAnnoRead) AllowBasicAuth(req *http.Request) bool {
+	return false
+}
+
+func (a *AuthAnnoRead) IsAdmin(login string) bool {
+	return false
+}
+
+func (a *AuthAnnoRead) Role(login string) string {
+	if login != "aaa" {
+		return ""
+	}
+	return ROLE_EDITOR
+}
+
+func (a *AuthAnnoRead) TiddlerACL() *TiddlerACL {
+	return nil
+}
+
 // make sure AuthAnnoRead implement Auth
 var _ Auth = (*AuthAnnoRead)(nil)
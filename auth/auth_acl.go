@@ -1,15 +1,17 @@
 package auth
 
 import (
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/base64"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/netip"
 	"os"
-	"strings"
+	"sync"
 	"sync/atomic"
+
+	"tiddlywikid/utils"
 )
 
 // TODO: lock?
@@ -19,12 +21,14 @@ type ACL struct {
 	Def   bool           `json:"def"`
 }
 
-func (a *ACL) Check(addrPort string) bool {
-	ipport, err := netip.ParseAddrPort(addrPort)
-	if err != nil {
+// addr is "ip:port" or "ip"
+func (a *ACL) Check(addr string) bool {
+	var ip netip.Addr
+	if ipport, err := netip.ParseAddrPort(addr); err == nil {
+		ip = ipport.Addr()
+	} else if ip, err = netip.ParseAddr(addr); err != nil {
 		return a.Def
 	}
-	ip := ipport.Addr()
 	for _, prefix := range a.Block {
 		if prefix.Contains(ip) {
 			return false
@@ -69,14 +73,24 @@ func NewACL(def bool) *ACL {
 }
 
 type AuthCustom struct {
-	AccessStaticFile *ACL    `json:"static-file,omitempty"`
-	Anonymous        *ACL    `json:"allow-anonymous,omitempty"`
-	AnonymousEdit    *ACL    `json:"allow-anonymous-edit,omitempty"`
-	UserDB           *UserDB `json:"users,omitempty"`
+	AccessStaticFile *ACL           `json:"static-file,omitempty"`
+	Anonymous        *ACL           `json:"allow-anonymous,omitempty"`
+	AnonymousEdit    *ACL           `json:"allow-anonymous-edit,omitempty"`
+	UserDB           *UserDB        `json:"users,omitempty"`
+	Admins           []string       `json:"admins,omitempty"`      // login id of users can use admin api
+	LoginLimit       *LoginLimit    `json:"login-limit,omitempty"` // nil for DefaultLoginLimit
+	Tiddlers         []*TiddlerRule `json:"tiddlers,omitempty"`    // per-tiddler access rules
+	BasicAuth        *ACL           `json:"basic-auth,omitempty"`  // HTTP Basic auth, nil for disable
+	ProxyAuth        *ProxyAuth     `json:"proxy-auth,omitempty"`  // login by header from reverse proxy, nil for disable
+
+	tiddlerACL *TiddlerACL
+
+	fp     string // for write back rehashed password
+	fileMx sync.Mutex
 }
 
 func (a *AuthCustom) AllowAnonymousAccessStaticFile(req *http.Request) bool {
-	return a.AccessStaticFile.Check(req.RemoteAddr)
+	return a.AccessStaticFile.Check(utils.ClientAddr(req))
 }
 
 func (a *AuthCustom) SetStaticFile(def bool, allowIPs []string, blockIPs []string) error {
@@ -84,7 +98,7 @@ func (a *AuthCustom) SetStaticFile(def bool, allowIPs []string, blockIPs []strin
 }
 
 func (a *AuthCustom) AllowAnonymous(req *http.Request) bool {
-	return a.Anonymous.Check(req.RemoteAddr)
+	return a.Anonymous.Check(utils.ClientAddr(req))
 }
 
 func (a *AuthCustom) SetAnonymous(def bool, allowIPs []string, blockIPs []string) error {
@@ -92,13 +106,20 @@ func (a *AuthCustom) SetAnonymous(def bool, allowIPs []string, blockIPs []string
 }
 
 func (a *AuthCustom) AllowAnonymousEdit(req *http.Request) bool {
-	return a.AnonymousEdit.Check(req.RemoteAddr)
+	return a.AnonymousEdit.Check(utils.ClientAddr(req))
 }
 
 func (a *AuthCustom) SetAnonymousEdit(def bool, allowIPs []string, blockIPs []string) error {
 	return a.AnonymousEdit.Set(def, allowIPs, blockIPs)
 }
 
+func (a *AuthCustom) AllowBasicAuth(req *http.Request) bool {
+	if a.BasicAuth == nil {
+		return false
+	}
+	return a.BasicAuth.Check(utils.ClientAddr(req))
+}
+
 func (a *AuthCustom) Login(user string, pwd string, req *http.Request) (displayName string, ok bool) {
 	u := a.UserDB.Get(user)
 	if u == nil {
@@ -108,9 +129,124 @@ func (a *AuthCustom) Login(user string, pwd string, req *http.Request) (displayN
 	if !ok {
 		return "", false
 	}
+	if u.NeedRehash() {
+		a.rehash(u, pwd)
+	}
 	return u.Name, true
 }
 
+// upgrade hash to new format, and write back to auth file
+func (a *AuthCustom) rehash(u *User, pwd string) {
+	nu := *u
+	if !nu.SetPwd(pwd) {
+		return
+	}
+
+	a.fileMx.Lock()
+	defer a.fileMx.Unlock()
+	a.UserDB.update(&nu)
+	if a.fp == "" {
+		return
+	}
+	if err := replaceHash(a.fp, u.Hash, nu.Hash); err != nil {
+		utils.Vln(2, "[auth]rehash write back err", a.fp, u.Login, err)
+		return
+	}
+	utils.Vln(3, "[auth]rehash", u.Login, hashAlgo(u.Hash), "->", hashAlgo(nu.Hash))
+}
+
+// replace only the hash string in file, keep others as is
+func replaceHash(fp string, oldHash string, newHash string) error {
+	buf, err := os.ReadFile(fp)
+	if err != nil {
+		return err
+	}
+	oldStr, _ := json.Marshal(oldHash)
+	newStr, _ := json.Marshal(newHash)
+	if bytes.Count(buf, oldStr) != 1 {
+		return errors.New("hash not found or not unique")
+	}
+	buf = bytes.Replace(buf, oldStr, newStr, 1)
+
+	fi, err := os.Stat(fp)
+	if err != nil {
+		return err
+	}
+	tmp := fp + ".tmp"
+	if err := os.WriteFile(tmp, buf, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
+
+func (a *AuthCustom) IsAdmin(login string) bool {
+	if login == "" {
+		return false
+	}
+	if u := a.UserDB.Get(login); u != nil && u.Role == ROLE_ADMIN {
+		return true
+	}
+	for _, admin := range a.Admins {
+		if admin == login {
+			return true
+		}
+	}
+	return false
+}
+
+// user in `admins` is admin, default is editor
+func (a *AuthCustom) Role(login string) string {
+	u := a.UserDB.Get(login)
+	if u == nil {
+		return ""
+	}
+	if a.IsAdmin(login) {
+		return ROLE_ADMIN
+	}
+	if u.Role == "" {
+		return ROLE_EDITOR
+	}
+	return u.Role
+}
+
+func (a *AuthCustom) LoginToken(token string, req *http.Request) (login string, displayName string, tk *Token, ok bool) {
+	u, tk := a.UserDB.GetToken(token)
+	if u == nil {
+		return "", "", nil, false
+	}
+	return u.Login, u.Name, tk, true
+}
+
+// users in `users` keep their role, others get role of ProxyAuth
+func (a *AuthCustom) LoginProxy(req *http.Request) (login string, displayName string, role string, ok bool) {
+	login, displayName = a.ProxyAuth.user(req)
+	if login == "" {
+		return "", "", "", false
+	}
+	if u := a.UserDB.Get(login); u != nil {
+		role = a.Role(login)
+		if displayName == "" {
+			displayName = u.Name
+		}
+	} else if a.ProxyAuth.Role != "" {
+		role = a.ProxyAuth.Role
+		if a.IsAdmin(login) {
+			role = ROLE_ADMIN
+		}
+	} else {
+		utils.Vln(3, "[auth]proxy user not found", utils.ClientAddr(req), login)
+		return "", "", "", false
+	}
+	if displayName == "" {
+		displayName = login
+	}
+	return login, displayName, role, true
+}
+
+func (a *AuthCustom) TiddlerACL() *TiddlerACL {
+	return a.tiddlerACL
+}
+
 func (a *AuthCustom) Load(fp string) error {
 	fd, err := os.Open(fp)
 	if err != nil {
@@ -124,7 +260,30 @@ func (a *AuthCustom) Load(fp string) error {
 	if err != nil {
 		return err
 	}
-	*a = nacl
+	var tacl *TiddlerACL
+	if len(nacl.Tiddlers) > 0 {
+		tacl, err = NewTiddlerACL(nacl.Tiddlers)
+		if err != nil {
+			return fmt.Errorf("tiddlers: %w", err)
+		}
+	}
+	if nacl.ProxyAuth != nil {
+		if err := nacl.ProxyAuth.check(); err != nil {
+			return fmt.Errorf("proxy-auth: %w", err)
+		}
+	}
+
+	a.AccessStaticFile = nacl.AccessStaticFile
+	a.Anonymous = nacl.Anonymous
+	a.AnonymousEdit = nacl.AnonymousEdit
+	a.UserDB = nacl.UserDB
+	a.Admins = nacl.Admins
+	a.LoginLimit = nacl.LoginLimit
+	a.Tiddlers = nacl.Tiddlers
+	a.BasicAuth = nacl.BasicAuth
+	a.ProxyAuth = nacl.ProxyAuth
+	a.tiddlerACL = tacl
+	a.fp = fp
 	return nil
 }
 
@@ -145,51 +304,75 @@ type User struct {
 	Login string `json:"id"`
 	Name  string `json:"name,omitempty"` // for display in wiki
 	Hash  string `json:"hash"`           // with salt
+	Role  string `json:"role,omitempty"` // reader, editor (default) or admin
+
+	Tokens []*Token `json:"tokens,omitempty"` // API tokens
 }
 
 func (u *User) CheckPwd(pwd string) bool {
-	sh := strings.SplitN(u.Hash, ":", 2)
-	if len(sh) != 2 {
-		return false
-	}
-	hash := pwdHash(pwd, sh[0])
-	return hash == sh[1]
+	return checkPwd(u.Hash, pwd)
 }
 
+// hash by HashAlgo
 func (u *User) SetPwd(pwd string) bool {
-	salt := genSalt()
-	if salt == "" {
+	hash, err := hashPwd(HashAlgo, pwd)
+	if err != nil {
 		return false
 	}
-	hash := pwdHash(pwd, salt)
-	u.Hash = salt + ":" + hash
+	u.Hash = hash
 	return true
 }
 
-func genSalt() string {
-	buf := make([]byte, 12)
-	_, err := rand.Read(buf)
-	if err != nil {
-		return ""
-	}
-	return base64.StdEncoding.EncodeToString(buf)
-}
-
-func pwdHash(pwd string, salt string) string {
-	shah := sha256.New()
-	shah.Write([]byte(pwd + "-:-" + salt))
-	return base64.StdEncoding.EncodeToString(shah.Sum([]byte("")))
+// hash is not in format of HashAlgo, like legacy one
+func (u *User) NeedRehash() bool {
+	return hashAlgo(u.Hash) != HashAlgo
 }
 
 type UserDB struct {
-	atomic.Value // map[string]*User // login -> user
+	atomic.Value              // map[string]*User // login -> user
+	tokens       atomic.Value // map[string]*userToken // token hash -> token
 }
 
 func (s *UserDB) Get(login string) *User {
-	lst := s.Value.Load().(map[string]*User)
+	if s == nil {
+		return nil
+	}
+	lst, _ := s.Value.Load().(map[string]*User)
 	return lst[login]
 }
 
+// replace a user, copy on write
+func (s *UserDB) update(u *User) {
+	lst := s.Value.Load().(map[string]*User)
+	ns := make(map[string]*User, len(lst))
+	for k, v := range lst {
+		ns[k] = v
+	}
+	ns[u.Login] = u
+	s.Value.Store(ns)
+}
+
+// login of users removed or password changed in nu
+func (s *UserDB) Changed(nu *UserDB) []string {
+	if s == nil {
+		return nil
+	}
+	oldLst, _ := s.Value.Load().(map[string]*User)
+	var newLst map[string]*User
+	if nu != nil {
+		newLst, _ = nu.Value.Load().(map[string]*User)
+	}
+
+	changed := make([]string, 0)
+	for login, u := range oldLst {
+		cur, ok := newLst[login]
+		if !ok || cur.Hash != u.Hash {
+			changed = append(changed, login)
+		}
+	}
+	return changed
+}
+
 func (s *UserDB) UnmarshalJSON(buf []byte) error {
 	aux := make([]*User, 0, 64)
 	err := json.Unmarshal(buf, &aux)
@@ -198,10 +381,27 @@ func (s *UserDB) UnmarshalJSON(buf []byte) error {
 	}
 
 	ns := make(map[string]*User)
+	tokens := make(map[string]*userToken)
 	for _, user := range aux {
+		if user.Role != "" && !ValidRole(user.Role) {
+			return fmt.Errorf("user %q: unknown role %q", user.Login, user.Role)
+		}
+		for _, tk := range user.Tokens {
+			if tk.Hash == "" {
+				return fmt.Errorf("user %q: token %q without hash", user.Login, tk.Name)
+			}
+			if tk.Scope != "" && tk.Scope != SCOPE_READ {
+				return fmt.Errorf("user %q: token %q unknown scope %q", user.Login, tk.Name, tk.Scope)
+			}
+			if _, ok := tokens[tk.Hash]; ok {
+				return fmt.Errorf("user %q: token %q duplicate", user.Login, tk.Name)
+			}
+			tokens[tk.Hash] = &userToken{login: user.Login, token: tk}
+		}
 		ns[user.Login] = user
 	}
 	s.Value.Store(ns)
+	s.tokens.Store(tokens)
 	return nil
 }
 
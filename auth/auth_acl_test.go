@@ -1,6 +1,10 @@
 package auth
 
 import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"testing"
 )
 
@@ -29,6 +33,14 @@ func TestACLDefaultBlock(t *testing.T) {
 			"12.34.56.78:23456",
 			false,
 		},
+		{
+			"192.168.0.1", // without port, from forwarding headers
+			true,
+		},
+		{
+			"192.168.10.1",
+			false,
+		},
 	}
 
 	acl := NewACL(false)
@@ -105,11 +117,55 @@ func TestUser(t *testing.T) {
 		t.Fatal("password should match")
 	}
 
+	if user.NeedRehash() {
+		t.Fatal("new hash should not need rehash", user.Hash)
+	}
+
 	// check precalculate hash
 	user.Hash = "1vm953mjdu+u8t9I:Xm0ZJOrbz+G4B1SClnN27SHW6hJ3hBrSXBf4pBemYEQ="
 	if !user.CheckPwd("test") {
 		t.Fatal("password should match")
 	}
+	if !user.NeedRehash() {
+		t.Fatal("legacy hash should need rehash")
+	}
+}
+
+func TestAuthCustomRehash(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "user.json")
+	legacy := "1vm953mjdu+u8t9I:Xm0ZJOrbz+G4B1SClnN27SHW6hJ3hBrSXBf4pBemYEQ="
+	conf := `{
+	"users": [
+		{ "id": "user1", "name": "User 1", "hash": "` + legacy + `" }
+	]
+}`
+	if err := os.WriteFile(fp, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	acl := NewAuthCustom()
+	if err := acl.Load(fp); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := acl.Login("user1", "test", nil); !ok {
+		t.Fatal("legacy hash should login")
+	}
+	if u := acl.UserDB.Get("user1"); u.NeedRehash() || !u.CheckPwd("test") {
+		t.Fatal("hash should be upgraded in memory", u.Hash)
+	}
+
+	// written back, other content unchanged
+	acl = NewAuthCustom()
+	if err := acl.Load(fp); err != nil {
+		t.Fatal(err)
+	}
+	u := acl.UserDB.Get("user1")
+	if u.NeedRehash() || !u.CheckPwd("test") || u.Name != "User 1" {
+		t.Fatal("hash should be upgraded in file", u)
+	}
+	if _, ok := acl.Login("user1", "test", nil); !ok {
+		t.Fatal("new hash should login")
+	}
 }
 
 func TestUserDB(t *testing.T) {
@@ -151,3 +207,95 @@ func TestUserDB(t *testing.T) {
 	}
 
 }
+
+func TestUserDBChanged(t *testing.T) {
+	old := NewUserDB("")
+	if err := old.UnmarshalJSON([]byte(`[{"id":"a","hash":"1"},{"id":"b","hash":"2"},{"id":"c","hash":"3"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	nu := NewUserDB("")
+	if err := nu.UnmarshalJSON([]byte(`[{"id":"a","hash":"1","name":"A"},{"id":"b","hash":"22"},{"id":"d","hash":"4"}]`)); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := old.Changed(nu)
+	sort.Strings(changed)
+	if len(changed) != 2 || changed[0] != "b" || changed[1] != "c" {
+		t.Fatal("should be password changed and removed users", changed)
+	}
+	if len(old.Changed(nil)) != 3 {
+		t.Fatal("all users should be removed", old.Changed(nil))
+	}
+}
+
+func TestAuthCustomRole(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "user.json")
+	conf := `{
+	"users": [
+		{ "id": "reader", "hash": "", "role": "reader" },
+		{ "id": "editor", "hash": "" },
+		{ "id": "admin", "hash": "", "role": "admin" },
+		{ "id": "old-admin", "hash": "", "role": "reader" }
+	],
+	"admins": ["old-admin"]
+}`
+	if err := os.WriteFile(fp, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	acl := NewAuthCustom()
+	if err := acl.Load(fp); err != nil {
+		t.Fatal(err)
+	}
+
+	var testCase = []struct {
+		Login string
+		Role  string
+		Read  bool
+		Edit  bool
+		Admin bool
+	}{
+		{"reader", ROLE_READER, true, false, false},
+		{"editor", ROLE_EDITOR, true, true, false},
+		{"admin", ROLE_ADMIN, true, true, true},
+		{"old-admin", ROLE_ADMIN, true, true, true},
+		{"removed", "", false, false, false},
+	}
+	for _, test := range testCase {
+		role := acl.Role(test.Login)
+		if role != test.Role || CanRead(role) != test.Read || CanEdit(role) != test.Edit || acl.IsAdmin(test.Login) != test.Admin {
+			t.Fatal("role of", test.Login, "should be", test.Role, "got", role)
+		}
+	}
+
+	// unknown role
+	if err := os.WriteFile(fp, []byte(`{"users": [{ "id": "user1", "hash": "", "role": "owner" }]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Load(fp); err == nil {
+		t.Fatal("unknown role should fail")
+	}
+}
+
+func TestAuthCustomBasicAuth(t *testing.T) {
+	acl := NewAuthCustom()
+	req := &http.Request{RemoteAddr: "192.168.1.2:5678"}
+	if acl.AllowBasicAuth(req) {
+		t.Fatal("basic auth should be disabled by default")
+	}
+
+	fp := filepath.Join(t.TempDir(), "user.json")
+	conf := `{"basic-auth": {"def": false, "allow": ["192.168.1.0/24"]}}`
+	if err := os.WriteFile(fp, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Load(fp); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.AllowBasicAuth(req) {
+		t.Fatal("basic auth should be allowed", req.RemoteAddr)
+	}
+	req.RemoteAddr = "10.0.0.1:5678"
+	if acl.AllowBasicAuth(req) {
+		t.Fatal("basic auth should not be allowed", req.RemoteAddr)
+	}
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// password hash formats in `User.Hash`:
+// argon2id: `$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>` (PHC string format)
+// bcrypt: `$2a$10$...` or `$2b$10$...`
+// legacy: `<salt>:<sha256 of "pwd-:-salt">`, only for verify, rehash on login
+
+const (
+	HASH_ARGON2ID = "argon2id"
+	HASH_BCRYPT   = "bcrypt"
+	HASH_LEGACY   = "legacy"
+
+	// upper bound of `m` accepted from stored hash, 1 GiB
+	argon2MaxMemory = 1024 * 1024
+)
+
+var (
+	// OWASP recommended minimum
+	Argon2Time    uint32 = 2
+	Argon2Memory  uint32 = 19 * 1024 // KiB
+	Argon2Threads uint8  = 1
+	Argon2KeyLen  uint32 = 32
+
+	BcryptCost = bcrypt.DefaultCost
+
+	// algorithm for new hash
+	HashAlgo = HASH_ARGON2ID
+)
+
+// algorithm of hash by prefix
+func hashAlgo(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return HASH_ARGON2ID
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return HASH_BCRYPT
+	case strings.Contains(hash, ":"):
+		return HASH_LEGACY
+	}
+	return ""
+}
+
+// hash password by algo
+func hashPwd(algo string, pwd string) (string, error) {
+	switch algo {
+	case HASH_ARGON2ID:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(pwd), salt, Argon2Time, Argon2Memory, Argon2Threads, Argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, Argon2Memory, Argon2Time, Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	case HASH_BCRYPT:
+		hash, err := bcrypt.GenerateFromPassword([]byte(pwd), BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	case HASH_LEGACY:
+		salt := genSalt()
+		if salt == "" {
+			return "", fmt.Errorf("gen salt failed")
+		}
+		return salt + ":" + pwdHash(pwd, salt), nil
+	}
+	return "", fmt.Errorf("unknown hash algorithm %q", algo)
+}
+
+// check password with hash in any supported format
+func checkPwd(hash string, pwd string) bool {
+	switch hashAlgo(hash) {
+	case HASH_ARGON2ID:
+		return checkArgon2id(hash, pwd)
+	case HASH_BCRYPT:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pwd)) == nil
+	case HASH_LEGACY:
+		sh := strings.SplitN(hash, ":", 2)
+		expect := pwdHash(pwd, sh[0])
+		return subtle.ConstantTimeCompare([]byte(expect), []byte(sh[1])) == 1
+	}
+	return false
+}
+
+func checkArgon2id(hash string, pwd string) bool {
+	// "", "argon2id", "v=19", "m=19456,t=2,p=1", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	// argon2.IDKey panics on t=0 or p=0, and a huge m allocates that much KiB
+	if time < 1 || threads < 1 || memory < 8*uint32(threads) || memory > argon2MaxMemory {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) < 4 || len(key) > 1024 {
+		return false
+	}
+	other := argon2.IDKey([]byte(pwd), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func genSalt() string {
+	buf := make([]byte, 12)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// legacy, single sha256 is too fast for password
+func pwdHash(pwd string, salt string) string {
+	shah := sha256.New()
+	shah.Write([]byte(pwd + "-:-" + salt))
+	return base64.StdEncoding.EncodeToString(shah.Sum([]byte("")))
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"testing"
+)
+
+func TestHashPwd(t *testing.T) {
+	for _, algo := range []string{HASH_ARGON2ID, HASH_BCRYPT, HASH_LEGACY} {
+		hash, err := hashPwd(algo, "test")
+		if err != nil {
+			t.Fatal(algo, err)
+		}
+		if hashAlgo(hash) != algo {
+			t.Fatal("algorithm should be", algo, "got", hashAlgo(hash), hash)
+		}
+		if !checkPwd(hash, "test") {
+			t.Fatal(algo, "password should match", hash)
+		}
+		if checkPwd(hash, "test-----") {
+			t.Fatal(algo, "password should not match", hash)
+		}
+	}
+
+	// precalculated
+	var testCase = []struct {
+		Hash string
+		Ret  bool
+	}{
+		{"$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$sAUIydaCcefYQ9MutI+XFcqYtHACStVvDYyQfJ2NStw", true},
+		{"$2a$10$ljDvJbLETWzGIGTow6lbrOSHyaKSKg41n6B17Ab2oEbTzE3L34jzO", true},
+		{"1vm953mjdu+u8t9I:Xm0ZJOrbz+G4B1SClnN27SHW6hJ3hBrSXBf4pBemYEQ=", true},
+		{"$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA", false},
+		{"$argon2id$v=18$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$sAUIydaCcefYQ9MutI+XFcqYtHACStVvDYyQfJ2NStw", false},
+		// bad parameters should fail, not panic
+		{"$argon2id$v=19$m=19456,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$sAUIydaCcefYQ9MutI+XFcqYtHACStVvDYyQfJ2NStw", false},
+		{"$argon2id$v=19$m=19456,t=2,p=0$c2FsdHNhbHRzYWx0c2FsdA$sAUIydaCcefYQ9MutI+XFcqYtHACStVvDYyQfJ2NStw", false},
+		{"$argon2id$v=19$m=0,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$sAUIydaCcefYQ9MutI+XFcqYtHACStVvDYyQfJ2NStw", false},
+		{"$argon2id$v=19$m=4294967295,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$sAUIydaCcefYQ9MutI+XFcqYtHACStVvDYyQfJ2NStw", false},
+		{"$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$sA", false},
+		{"nohash", false},
+		{"", false},
+	}
+	for _, test := range testCase {
+		if ret := checkPwd(test.Hash, "test"); ret != test.Ret {
+			t.Fatal("hash", test.Hash, "should be", test.Ret, "got", ret)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"tiddlywikid/utils"
+)
+
+// failed login limit, in auth file as `login-limit`
+type LoginLimit struct {
+	MaxFailures   int `json:"max-failures"`    // failures of an account before lockout, 0 for no lockout
+	MaxFailuresIP int `json:"max-failures-ip"` // failures from an IP before lockout, 0 for no lockout
+	Lockout       int `json:"lockout"`         // second
+	Backoff       int `json:"backoff"`         // second, wait after first failure, doubled after each failure
+	MaxBackoff    int `json:"max-backoff"`     // second
+	Window        int `json:"window"`          // second, failures are forgotten after no failure in window
+}
+
+var DefaultLoginLimit = LoginLimit{
+	MaxFailures:   5,
+	MaxFailuresIP: 20,
+	Lockout:       15 * 60,
+	Backoff:       1,
+	MaxBackoff:    30,
+	Window:        15 * 60,
+}
+
+type loginFailure struct {
+	count   int
+	last    time.Time
+	until   time.Time // locked until
+	pending int       // attempts allowed but not failed or succeeded yet
+}
+
+// next allowed attempt
+func (f *loginFailure) next(limit *LoginLimit) time.Time {
+	if f.until.After(f.last) {
+		return f.until
+	}
+	backoff := time.Duration(limit.Backoff) * time.Second
+	maxBackoff := time.Duration(limit.MaxBackoff) * time.Second
+	for i := 1; i < f.count && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return f.last.Add(backoff)
+}
+
+// track failed logins by account and IP, with exponential backoff and lockout
+// keep the same one over auth file reload
+type LoginGuard struct {
+	mx       sync.Mutex
+	limit    LoginLimit
+	accounts map[string]*loginFailure
+	ips      map[string]*loginFailure
+	sweep    time.Time
+}
+
+// nil for DefaultLoginLimit
+func NewLoginGuard(limit *LoginLimit) *LoginGuard {
+	g := &LoginGuard{
+		accounts: make(map[string]*loginFailure),
+		ips:      make(map[string]*loginFailure),
+	}
+	g.SetLimit(limit)
+	return g
+}
+
+// nil for DefaultLoginLimit
+func (g *LoginGuard) SetLimit(limit *LoginLimit) {
+	if limit == nil {
+		limit = &DefaultLoginLimit
+	}
+	g.mx.Lock()
+	g.limit = *limit
+	g.mx.Unlock()
+}
+
+// check before verify password, wait for retry if not allowed
+func (g *LoginGuard) Allow(login string, ip string) (wait time.Duration, ok bool) {
+	if g == nil {
+		return 0, true
+	}
+	now := utils.Now()
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	g.clean(now)
+
+	acc, ipf := g.accounts[login], g.ips[ip]
+	next := now
+	for _, f := range []*loginFailure{acc, ipf} {
+		if f == nil {
+			continue
+		}
+		if t := f.next(&g.limit); t.After(next) {
+			next = t
+		}
+	}
+	if next.After(now) {
+		return next.Sub(now), false
+	}
+
+	// pending attempts may all fail, parallel ones should not bypass backoff and lockout
+	if g.busy(acc, g.limit.MaxFailures) || g.busy(ipf, g.limit.MaxFailuresIP) {
+		wait := time.Duration(g.limit.Backoff) * time.Second
+		if wait < time.Second {
+			wait = time.Second
+		}
+		return wait, false
+	}
+	g.entry(g.accounts, login).pending++
+	g.entry(g.ips, ip).pending++
+	return 0, true
+}
+
+// not more pending attempts than failures left before lockout
+// or one at a time after a failure if no lockout
+func (g *LoginGuard) busy(f *loginFailure, max int) bool {
+	if f == nil || f.pending == 0 {
+		return false
+	}
+	if max > 0 && g.limit.Lockout > 0 {
+		return f.count+f.pending >= max
+	}
+	return f.count > 0
+}
+
+func (g *LoginGuard) entry(lst map[string]*loginFailure, key string) *loginFailure {
+	f, ok := lst[key]
+	if !ok {
+		f = &loginFailure{}
+		lst[key] = f
+	}
+	return f
+}
+
+// attempt allowed by Allow() is finished
+func (g *LoginGuard) done(lst map[string]*loginFailure, key string) {
+	if f, ok := lst[key]; ok && f.pending > 0 {
+		f.pending--
+	}
+}
+
+// record a failed login
+func (g *LoginGuard) Fail(login string, ip string) {
+	if g == nil {
+		return
+	}
+	now := utils.Now()
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	g.done(g.accounts, login)
+	g.done(g.ips, ip)
+
+	if g.fail(g.accounts, login, g.limit.MaxFailures, now) {
+		utils.Vln(2, "[login]lockout account", login, ip, g.limit.Lockout)
+	}
+	if g.fail(g.ips, ip, g.limit.MaxFailuresIP, now) {
+		utils.Vln(2, "[login]lockout ip", ip, login, g.limit.Lockout)
+	}
+}
+
+// return true if locked by this failure
+func (g *LoginGuard) fail(lst map[string]*loginFailure, key string, max int, now time.Time) bool {
+	f := g.entry(lst, key)
+	if g.expired(f, now) {
+		*f = loginFailure{pending: f.pending}
+	}
+	f.count += 1
+	f.last = now
+	if max > 0 && f.count >= max && g.limit.Lockout > 0 {
+		f.until = now.Add(time.Duration(g.limit.Lockout) * time.Second)
+		f.count = 0 // backoff again after lockout
+		return true
+	}
+	return false
+}
+
+// forget failures of the account, failures of IP are kept
+func (g *LoginGuard) Success(login string, ip string) {
+	if g == nil {
+		return
+	}
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	g.done(g.accounts, login)
+	g.done(g.ips, ip)
+	if f, ok := g.accounts[login]; ok {
+		if f.pending == 0 {
+			delete(g.accounts, login)
+		} else {
+			*f = loginFailure{pending: f.pending} // other attempts are still pending
+		}
+	}
+}
+
+func (g *LoginGuard) expired(f *loginFailure, now time.Time) bool {
+	if now.Before(f.until) {
+		return false
+	}
+	return now.Sub(f.last) > time.Duration(g.limit.Window)*time.Second
+}
+
+// remove expired, at most once a minute
+func (g *LoginGuard) clean(now time.Time) {
+	if now.Sub(g.sweep) < time.Minute {
+		return
+	}
+	g.sweep = now
+	for _, lst := range []map[string]*loginFailure{g.accounts, g.ips} {
+		for k, f := range lst {
+			if f.pending == 0 && g.expired(f, now) {
+				delete(lst, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoginGuard(t *testing.T) {
+	g := NewLoginGuard(&LoginLimit{
+		MaxFailures:   3,
+		MaxFailuresIP: 5,
+		Lockout:       60,
+		Backoff:       1,
+		MaxBackoff:    4,
+		Window:        60,
+	})
+
+	if _, ok := g.Allow("user1", "10.0.0.1"); !ok {
+		t.Fatal("should allow without failure")
+	}
+
+	// backoff
+	g.Fail("user1", "10.0.0.1")
+	if wait, ok := g.Allow("user1", "10.0.0.2"); ok || wait <= 0 {
+		t.Fatal("account should wait after failure", wait, ok)
+	}
+	if wait, ok := g.Allow("user2", "10.0.0.1"); ok || wait <= 0 {
+		t.Fatal("ip should wait after failure", wait, ok)
+	}
+	if _, ok := g.Allow("user2", "10.0.0.2"); !ok {
+		t.Fatal("other account and ip should allow")
+	}
+	g.Fail("user1", "10.0.0.1")
+	f := g.accounts["user1"]
+	if next := f.next(&g.limit).Sub(f.last); next != 2*time.Second {
+		t.Fatal("backoff should double", next)
+	}
+
+	// lockout account
+	g.Fail("user1", "10.0.0.1")
+	f = g.accounts["user1"]
+	if f.until.Sub(f.last) != 60*time.Second {
+		t.Fatal("account should be locked", f)
+	}
+	f.last = f.last.Add(-10 * time.Second) // backoff passed, still locked
+	if _, ok := g.Allow("user1", "10.0.0.3"); ok {
+		t.Fatal("locked account should not allow")
+	}
+
+	// success forget account failures, not ip
+	g.Success("user1", "10.0.0.1")
+	if g.accounts["user1"] != nil || g.ips["10.0.0.1"] == nil {
+		t.Fatal("success should only reset account")
+	}
+
+	// password spraying, lockout ip
+	for _, login := range []string{"a", "b"} {
+		g.Fail(login, "10.0.0.1")
+	}
+	if ip := g.ips["10.0.0.1"]; ip.until.IsZero() {
+		t.Fatal("ip should be locked", ip)
+	}
+
+	// expired
+	f = g.accounts["a"]
+	f.last = f.last.Add(-2 * time.Minute)
+	g.sweep = time.Time{}
+	g.clean(f.last.Add(2 * time.Minute))
+	if g.accounts["a"] != nil {
+		t.Fatal("expired failures should be removed")
+	}
+
+	// nil guard
+	var none *LoginGuard
+	none.Fail("user1", "10.0.0.1")
+	if _, ok := none.Allow("user1", "10.0.0.1"); !ok {
+		t.Fatal("nil guard should allow")
+	}
+}
+
+func TestLoginGuardParallel(t *testing.T) {
+	g := NewLoginGuard(&LoginLimit{
+		MaxFailures:   3,
+		MaxFailuresIP: 5,
+		Lockout:       60,
+		Backoff:       1,
+		MaxBackoff:    4,
+		Window:        60,
+	})
+
+	// attempts at the same time, no more than failures left before lockout
+	attempt := func(login string, ip string) int32 {
+		var allowed int32
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, ok := g.Allow(login, ip); ok {
+					atomic.AddInt32(&allowed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		return allowed
+	}
+	if n := attempt("user1", "10.0.0.1"); n != 3 {
+		t.Fatal("parallel attempts of an account should be limited, allowed", n)
+	}
+	for i := 0; i < 3; i++ {
+		g.Fail("user1", "10.0.0.1")
+	}
+	if _, ok := g.Allow("user1", "10.0.0.2"); ok {
+		t.Fatal("account should be locked after pending attempts failed")
+	}
+
+	// ip: 3 pending of different accounts, 2 left
+	for i := 0; i < 3; i++ {
+		if _, ok := g.Allow(fmt.Sprint("spray", i), "10.0.0.3"); !ok {
+			t.Fatal("attempt should be allowed", i)
+		}
+	}
+	if n := attempt("other", "10.0.0.3"); n != 2 {
+		t.Fatal("parallel attempts of an ip should be limited, allowed", n)
+	}
+
+	// finished attempts are not pending
+	g.Success("spray0", "10.0.0.3")
+	if _, ok := g.Allow("other", "10.0.0.3"); !ok {
+		t.Fatal("attempt should be allowed after one succeeded")
+	}
+
+	// no lockout, one at a time after a failure
+	g = NewLoginGuard(&LoginLimit{Backoff: 0, Window: 60})
+	g.Allow("user1", "10.0.0.1")
+	g.Fail("user1", "10.0.0.1")
+	if n := attempt("user1", "10.0.0.1"); n != 1 {
+		t.Fatal("parallel attempts after a failure should be serialized, allowed", n)
+	}
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"tiddlywikid/utils"
+)
+
+// login by header from an authenticating reverse proxy (like oauth2-proxy, Authelia), in auth file as `proxy-auth`
+type ProxyAuth struct {
+	Header     string `json:"header"`                // login id, like `X-Forwarded-User`
+	NameHeader string `json:"name-header,omitempty"` // display name, like `X-Forwarded-Preferred-Username`, login id if not set
+	Trusted    *ACL   `json:"trusted"`               // headers only from these proxies, by address of connection (not `-trusted-proxies`)
+	Role       string `json:"role,omitempty"`        // role of users not in `users`, empty for only users in `users`
+}
+
+func (p *ProxyAuth) check() error {
+	if p.Header == "" {
+		return fmt.Errorf("empty header")
+	}
+	if p.Trusted == nil {
+		return fmt.Errorf("trusted not set")
+	}
+	if p.Role != "" && !ValidRole(p.Role) {
+		return fmt.Errorf("unknown role %q", p.Role)
+	}
+	return nil
+}
+
+// login id and display name from headers, empty if not set or not from trusted proxy
+func (p *ProxyAuth) user(req *http.Request) (login string, displayName string) {
+	if p == nil {
+		return "", ""
+	}
+	login = strings.TrimSpace(req.Header.Get(p.Header))
+	if login == "" {
+		return "", ""
+	}
+	if !p.Trusted.Check(req.RemoteAddr) {
+		utils.Vln(3, "[auth]proxy header from untrusted", req.RemoteAddr, login)
+		return "", ""
+	}
+	if p.NameHeader != "" {
+		displayName = strings.TrimSpace(req.Header.Get(p.NameHeader))
+	}
+	return login, displayName
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthCustomProxy(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "user.json")
+	conf := `{
+	"users": [
+		{ "id": "alice", "name": "Alice", "hash": "", "role": "reader" },
+		{ "id": "bob", "hash": "" }
+	],
+	"admins": ["root"],
+	"proxy-auth": {
+		"header": "X-Forwarded-User",
+		"name-header": "X-Forwarded-Preferred-Username",
+		"trusted": { "def": false, "allow": ["10.0.0.1/32"] },
+		"role": "editor"
+	}
+}`
+	if err := os.WriteFile(fp, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	acl := NewAuthCustom()
+	if err := acl.Load(fp); err != nil {
+		t.Fatal(err)
+	}
+
+	var testCase = []struct {
+		Addr  string
+		User  string
+		Name  string
+		Login string
+		Disp  string
+		Role  string
+	}{
+		{"10.0.0.1:1234", "alice", "", "alice", "Alice", ROLE_READER},
+		{"10.0.0.1:1234", "alice", "A", "alice", "A", ROLE_READER},
+		{"10.0.0.1:1234", "bob", "", "bob", "bob", ROLE_EDITOR},
+		{"10.0.0.1:1234", "carol", "", "carol", "carol", ROLE_EDITOR}, // not in users
+		{"10.0.0.1:1234", "root", "", "root", "root", ROLE_ADMIN},
+		{"10.0.0.1:1234", "", "", "", "", ""},
+		{"10.0.0.2:1234", "alice", "", "", "", ""}, // not trusted
+	}
+	for i, tc := range testCase {
+		req := &http.Request{RemoteAddr: tc.Addr, Header: make(http.Header)}
+		if tc.User != "" {
+			req.Header.Set("X-Forwarded-User", tc.User)
+		}
+		if tc.Name != "" {
+			req.Header.Set("X-Forwarded-Preferred-Username", tc.Name)
+		}
+		login, name, role, ok := acl.LoginProxy(req)
+		if ok != (tc.Login != "") || login != tc.Login || name != tc.Disp || role != tc.Role {
+			t.Fatal(i, "LoginProxy() got", login, name, role, ok)
+		}
+	}
+
+	// only users in `users`
+	acl.ProxyAuth.Role = ""
+	req := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: make(http.Header)}
+	req.Header.Set("X-Forwarded-User", "carol")
+	if _, _, _, ok := acl.LoginProxy(req); ok {
+		t.Fatal("LoginProxy() should fail for user not in users")
+	}
+
+	// disabled
+	acl.ProxyAuth = nil
+	req.Header.Set("X-Forwarded-User", "alice")
+	if _, _, _, ok := acl.LoginProxy(req); ok {
+		t.Fatal("LoginProxy() should fail when disabled")
+	}
+
+	// trusted is required
+	if err := os.WriteFile(fp, []byte(`{"proxy-auth": {"header": "X-Forwarded-User"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Load(fp); err == nil {
+		t.Fatal("proxy-auth without trusted should fail")
+	}
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// access rule for tiddlers, in auth file as `tiddlers`
+type TiddlerRule struct {
+	// `[tag[private]]`, `[prefix[$:/config/]]`, `[regexp[^Secret/]]`,
+	// `$:/config/*` for prefix, or an exact title
+	Match string `json:"match"`
+
+	// who can read or write, nil for not restricted, empty for admins only
+	// `*` for everyone (even not login), `role:<role>` for users with the role or higher, or login id of users
+	Read  []string `json:"read,omitempty"`
+	Write []string `json:"write,omitempty"`
+
+	kind  string // tag, prefix, regexp, title
+	value string
+	re    *regexp.Regexp
+}
+
+var reRuleMatch = regexp.MustCompile(`^\[(tag|prefix|regexp)\[(.*)\]\]$`)
+
+func (rule *TiddlerRule) compile() error {
+	match := rule.Match
+	switch {
+	case match == "":
+		return fmt.Errorf("empty match")
+	case reRuleMatch.MatchString(match):
+		m := reRuleMatch.FindStringSubmatch(match)
+		rule.kind, rule.value = m[1], m[2]
+	case strings.HasSuffix(match, "*"):
+		rule.kind, rule.value = "prefix", strings.TrimSuffix(match, "*")
+	default:
+		rule.kind, rule.value = "title", match
+	}
+	if rule.kind == "regexp" {
+		re, err := regexp.Compile(rule.value)
+		if err != nil {
+			return fmt.Errorf("%q: %w", match, err)
+		}
+		rule.re = re
+	}
+	for _, subject := range append(rule.Read, rule.Write...) {
+		if role := strings.TrimPrefix(subject, "role:"); role != subject && !ValidRole(role) {
+			return fmt.Errorf("%q: unknown role %q", match, role)
+		}
+	}
+	return nil
+}
+
+// tags is nil for unknown (like deleted tiddler), tag rule never match
+func (rule *TiddlerRule) match(title string, tags []string) bool {
+	switch rule.kind {
+	case "title":
+		return title == rule.value
+	case "prefix":
+		return strings.HasPrefix(title, rule.value)
+	case "regexp":
+		return rule.re.MatchString(title)
+	case "tag":
+		for _, tag := range tags {
+			if tag == rule.value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func allowSubject(lst []string, login string, role string) bool {
+	if lst == nil {
+		return true
+	}
+	for _, subject := range lst {
+		switch {
+		case subject == "*":
+			return true
+		case strings.HasPrefix(subject, "role:"):
+			need := strings.TrimPrefix(subject, "role:")
+			if role != "" && roleLevel[role] >= roleLevel[need] {
+				return true
+			}
+		case login != "" && subject == login:
+			return true
+		}
+	}
+	return false
+}
+
+// rules checked in order, first matched rule decide, not matched is allowed
+// admins are always allowed
+type TiddlerACL struct {
+	Rules []*TiddlerRule
+}
+
+func NewTiddlerACL(rules []*TiddlerRule) (*TiddlerACL, error) {
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return &TiddlerACL{Rules: rules}, nil
+}
+
+// login and role are empty for not login, write also need read permission
+func (acl *TiddlerACL) Check(login string, role string, title string, tags []string, write bool) bool {
+	if acl == nil || role == ROLE_ADMIN {
+		return true
+	}
+	for _, rule := range acl.Rules {
+		if !rule.match(title, tags) {
+			continue
+		}
+		if !allowSubject(rule.Read, login, role) {
+			return false
+		}
+		return !write || allowSubject(rule.Write, login, role)
+	}
+	return true
+}
+
+// read check for tiddler with unknown tags (like deleted one without kept revision)
+// tag rule is treated as matched if it deny, not to leak the title
+func (acl *TiddlerACL) CheckUnknownTags(login string, role string, title string) bool {
+	if acl == nil || role == ROLE_ADMIN {
+		return true
+	}
+	for _, rule := range acl.Rules {
+		if rule.kind == "tag" {
+			if !allowSubject(rule.Read, login, role) {
+				return false
+			}
+			continue // may not match
+		}
+		if !rule.match(title, nil) {
+			continue
+		}
+		return allowSubject(rule.Read, login, role)
+	}
+	return true
+}
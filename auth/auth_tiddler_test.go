@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"testing"
+)
+
+func TestTiddlerACL(t *testing.T) {
+	acl, err := NewTiddlerACL([]*TiddlerRule{
+		{Match: "[tag[private]]", Read: []string{"alice"}, Write: []string{"alice"}},
+		{Match: "$:/config/*", Write: []string{"role:admin"}},
+		{Match: "[regexp[^Team/]]", Read: []string{"role:reader"}, Write: []string{"role:editor"}},
+		{Match: "Notice", Read: []string{"*"}, Write: []string{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testCase = []struct {
+		Login string
+		Role  string
+		Title string
+		Tags  []string
+		Read  bool
+		Write bool
+	}{
+		// tag
+		{"alice", ROLE_READER, "Diary", []string{"private"}, true, true},
+		{"bob", ROLE_EDITOR, "Diary", []string{"private"}, false, false},
+		{"", "", "Diary", []string{"private"}, false, false},
+		{"bob", ROLE_EDITOR, "Diary", nil, true, true}, // unknown tags
+		{"root", ROLE_ADMIN, "Diary", []string{"private"}, true, true},
+
+		// prefix, first matched rule decide
+		{"bob", ROLE_EDITOR, "$:/config/Foo", []string{}, true, false},
+		{"bob", ROLE_EDITOR, "$:/config/Foo", []string{"private"}, false, false},
+		{"root", ROLE_ADMIN, "$:/config/Foo", []string{}, true, true},
+
+		// regexp and role
+		{"", "", "Team/Plan", []string{}, false, false},
+		{"carol", ROLE_READER, "Team/Plan", []string{}, true, false},
+		{"bob", ROLE_EDITOR, "Team/Plan", []string{}, true, true},
+
+		// title, empty for admins only
+		{"", "", "Notice", []string{}, true, false},
+		{"bob", ROLE_EDITOR, "Notice", []string{}, true, false},
+
+		// not matched
+		{"", "", "Other", []string{}, true, true},
+	}
+	for _, test := range testCase {
+		read := acl.Check(test.Login, test.Role, test.Title, test.Tags, false)
+		write := acl.Check(test.Login, test.Role, test.Title, test.Tags, true)
+		if read != test.Read || write != test.Write {
+			t.Fatal(test.Login, test.Title, test.Tags, "should be", test.Read, test.Write, "got", read, write)
+		}
+	}
+
+	// unknown tags, tag rule deny if not allowed
+	var unknown = []struct {
+		Login string
+		Role  string
+		Title string
+		Read  bool
+	}{
+		{"alice", ROLE_READER, "Diary", true},
+		{"bob", ROLE_EDITOR, "Diary", false},
+		{"root", ROLE_ADMIN, "Diary", true},
+		{"", "", "Notice", false},
+	}
+	for _, test := range unknown {
+		if read := acl.CheckUnknownTags(test.Login, test.Role, test.Title); read != test.Read {
+			t.Fatal(test.Login, test.Title, "with unknown tags should be", test.Read, "got", read)
+		}
+	}
+
+	// nil for no rule
+	var none *TiddlerACL
+	if !none.Check("", "", "Diary", []string{"private"}, true) || !none.CheckUnknownTags("", "", "Diary") {
+		t.Fatal("nil acl should allow")
+	}
+
+	// bad rules
+	for _, rule := range []*TiddlerRule{
+		{Match: ""},
+		{Match: "[regexp[(]]"},
+		{Match: "A", Read: []string{"role:owner"}},
+	} {
+		if _, err := NewTiddlerACL([]*TiddlerRule{rule}); err == nil {
+			t.Fatal("should fail", rule.Match)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+
+	"tiddlywikid/utils"
+)
+
+const (
+	TOKEN_PREFIX = "twd_"
+
+	SCOPE_READ = "read" // read only
+)
+
+// API token of a user, for `Authorization: Bearer <token>`
+// only hash is stored, revoke by removing it from auth file
+type Token struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`             // by HashToken()
+	Scope   string    `json:"scope,omitempty"`  // "read" for read only, empty for same as user
+	Prefix  string    `json:"prefix,omitempty"` // only tiddlers with title prefix, empty for all
+	Expires time.Time `json:"expires"`          // zero for never
+}
+
+func (tk *Token) IsExpired() bool {
+	return !tk.Expires.IsZero() && utils.Now().After(tk.Expires)
+}
+
+// new random token, return token and its hash
+func NewToken() (token string, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(buf)
+	return token, HashToken(token), nil
+}
+
+// token is random enough, single sha256 is fine
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+type userToken struct {
+	login string
+	token *Token
+}
+
+// user and token by token, nil if not found or expired
+func (s *UserDB) GetToken(token string) (*User, *Token) {
+	if s == nil {
+		return nil, nil
+	}
+	lst, _ := s.tokens.Load().(map[string]*userToken)
+	ut, ok := lst[HashToken(token)]
+	if !ok || ut.token.IsExpired() {
+		return nil, nil
+	}
+	u := s.Get(ut.login)
+	if u == nil {
+		return nil, nil
+	}
+	return u, ut.token
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserDBToken(t *testing.T) {
+	tkAll, hashAll, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tkAll, TOKEN_PREFIX) || HashToken(tkAll) != hashAll {
+		t.Fatal("NewToken() bad token", tkAll, hashAll)
+	}
+	tkRead, hashRead, _ := NewToken()
+	tkOld, hashOld, _ := NewToken()
+	tkFuture, hashFuture, _ := NewToken()
+
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	buf := fmt.Sprintf(`[
+		{"id": "alice", "hash": "", "tokens": [
+			{"name": "all", "hash": %q},
+			{"name": "read", "hash": %q, "scope": "read", "prefix": "Note/"}
+		]},
+		{"id": "bob", "hash": "", "tokens": [
+			{"name": "old", "hash": %q, "expires": %q},
+			{"name": "future", "hash": %q, "expires": %q}
+		]}
+	]`, hashAll, hashRead, hashOld, past, hashFuture, future)
+
+	db := &UserDB{}
+	if err := json.Unmarshal([]byte(buf), db); err != nil {
+		t.Fatal(err)
+	}
+
+	var testCase = []struct {
+		Token  string
+		Login  string
+		Name   string
+		Scope  string
+		Prefix string
+	}{
+		{tkAll, "alice", "all", "", ""},
+		{tkRead, "alice", "read", SCOPE_READ, "Note/"},
+		{tkOld, "", "", "", ""}, // expired
+		{tkFuture, "bob", "future", "", ""},
+		{"", "", "", "", ""},
+		{TOKEN_PREFIX + "not-exist", "", "", "", ""},
+		{hashAll, "", "", "", ""}, // hash is not token
+	}
+	for i, tc := range testCase {
+		u, tk := db.GetToken(tc.Token)
+		if tc.Login == "" {
+			if u != nil || tk != nil {
+				t.Fatal(i, "GetToken() should fail", tc.Token)
+			}
+			continue
+		}
+		if u == nil || tk == nil {
+			t.Fatal(i, "GetToken() failed", tc.Token)
+		}
+		if u.Login != tc.Login || tk.Name != tc.Name || tk.Scope != tc.Scope || tk.Prefix != tc.Prefix {
+			t.Fatal(i, "GetToken() wrong token", u.Login, tk.Name, tk.Scope, tk.Prefix)
+		}
+	}
+
+	var nilDB *UserDB
+	if u, tk := nilDB.GetToken(tkAll); u != nil || tk != nil {
+		t.Fatal("GetToken() on nil")
+	}
+}
+
+func TestUserDBTokenInvalid(t *testing.T) {
+	var testCase = []string{
+		`[{"id": "a", "hash": "", "tokens": [{"name": "x"}]}]`,
+		`[{"id": "a", "hash": "", "tokens": [{"name": "x", "hash": "h", "scope": "admin"}]}]`,
+		`[{"id": "a", "hash": "", "tokens": [{"name": "x", "hash": "h"}]}, {"id": "b", "hash": "", "tokens": [{"name": "y", "hash": "h"}]}]`,
+	}
+	for i, buf := range testCase {
+		db := &UserDB{}
+		if err := json.Unmarshal([]byte(buf), db); err == nil {
+			t.Fatal(i, "should fail", buf)
+		}
+	}
+}
@@ -3,7 +3,6 @@ package tiddlywikid
 import (
 	_ "embed"
 	"encoding/json"
-	"net/http"
 
 	"tiddlywikid/store"
 )
@@ -24,6 +23,9 @@ node tiddlywiki.js srv --render '.' 'index.html' 'text/plain' '$:/core/save/all'
 
 const (
 	GENERATED_PLUGIN = "$:/plugins/tiddlywiki/tiddlyweb-external-attachments"
+
+	CONFIG_ATTACHMENTS_PATH = "$:/config/TiddlyWebExternalAttachments/ExternalAttachmentsPath"
+	CONFIG_TIDDLYWEB_HOST   = "$:/config/tiddlyweb/host" // for path prefix
 )
 
 var (
@@ -50,8 +52,8 @@ var (
 			Text:  "yes",
 		},
 		{
-			Title: "$:/config/TiddlyWebExternalAttachments/ExternalAttachmentsPath",
-			Text:  "/files/", // TODO: subpath by config
+			Title: CONFIG_ATTACHMENTS_PATH,
+			Text:  "/files/", // under path prefix by packPlugin()
 		},
 		{
 			Title: "$:/config/TiddlyWebExternalAttachments/SizeForExternal",
@@ -61,6 +63,14 @@ var (
 			Title: "$:/config/TiddlyWebExternalAttachments/Debug",
 			Text:  "no",
 		},
+		{
+			Title: "$:/config/TiddlyWebExternalAttachments/LiveSync",
+			Text:  "yes",
+		},
+		{
+			Title: "$:/config/TiddlyWebExternalAttachments/IncrementalList",
+			Text:  "yes",
+		},
 		{
 			Title: "$:/plugins/tiddlywiki/tiddlyweb-external-attachments/readme",
 			Text: `! Introduction
@@ -87,6 +97,10 @@ By default, a relative path is used to reference the file. Optionally, you can s
 
 <$link to="$:/config/TiddlyWebExternalAttachments/SizeForExternal">Size For External</$link>: use external attachment if file size large than <$edit-text tiddler="$:/config/TiddlyWebExternalAttachments/SizeForExternal" field="text" tag="input" default="16384"></$edit-text> Bytes
 
+<$checkbox tiddler="$:/config/TiddlyWebExternalAttachments/LiveSync" field="text" checked="yes" unchecked="no" default="yes"> <$link to="$:/config/TiddlyWebExternalAttachments/LiveSync">Sync from server immediately when tiddlers changed by others (need reload)</$link> </$checkbox>
+
+<$checkbox tiddler="$:/config/TiddlyWebExternalAttachments/IncrementalList" field="text" checked="yes" unchecked="no" default="yes"> <$link to="$:/config/TiddlyWebExternalAttachments/IncrementalList">Only fetch changed tiddlers when syncing from server (need reload)</$link> </$checkbox>
+
 `,
 		},
 		{
@@ -104,11 +118,25 @@ By default, a relative path is used to reference the file. Optionally, you can s
 )
 
 func init() {
+	pluginPack = packPlugin("")
+}
 
-	tiddlers := make(map[string]*TiddlyJSON, len(pluginFiles))
+// marshal all plugin files, config paths under prefix `base`
+func packPlugin(base string) string {
+	tiddlers := make(map[string]*TiddlyJSON, len(pluginFiles)+1)
 	for _, td := range pluginFiles {
 		tiddlers[td.Title] = td
 	}
+	if base != "" {
+		tiddlers[CONFIG_ATTACHMENTS_PATH] = &TiddlyJSON{
+			Title: CONFIG_ATTACHMENTS_PATH,
+			Text:  base + "/files/",
+		}
+		tiddlers[CONFIG_TIDDLYWEB_HOST] = &TiddlyJSON{
+			Title: CONFIG_TIDDLYWEB_HOST,
+			Text:  "$protocol$//$host$" + base + "/",
+		}
+	}
 
 	// {"tiddlers": {}}
 	aux := &struct {
@@ -117,12 +145,14 @@ func init() {
 		Tiddlers: tiddlers,
 	}
 	buf, err := json.Marshal(aux)
-	if err == nil {
-		pluginPack = (string)(buf)
+	if err != nil {
+		return ""
 	}
+	return (string)(buf)
 }
 
-func NewPlugin(r *http.Request) *store.TiddlyWebJSON {
+// plugin for wiki under path prefix `base`, empty for root
+func NewPlugin(base string) *store.TiddlyWebJSON {
 	// return &store.TiddlyWebJSON{
 	// 	Title: GENERATED_PLUGIN,
 	// 	// Tags:     autoGenTags,
@@ -137,12 +167,20 @@ func NewPlugin(r *http.Request) *store.TiddlyWebJSON {
 		// Tags:     autoGenTags,
 		Type:     "application/json",
 		Fields:   (*store.TiddlerFields)(&pluginFields),
-		Text:     pluginPack,
+		Text:     pluginText(base),
 		Revision: "0",
 	}
 }
 
-func NewPluginBuf() []byte {
+func pluginText(base string) string {
+	if base == "" {
+		return pluginPack
+	}
+	return packPlugin(base)
+}
+
+// tiddler store block of plugin for wiki under path prefix `base`, empty for root
+func NewPluginBuf(base string) []byte {
 	// td := &TiddlyJSON{
 	// 	Title: GENERATED_PLUGIN,
 	// 	// Tags:     autoGenTags,
@@ -155,7 +193,7 @@ func NewPluginBuf() []byte {
 	td := make(map[string]interface{})
 	td["title"] = GENERATED_PLUGIN
 	td["type"] = "application/json"
-	td["text"] = pluginPack
+	td["text"] = pluginText(base)
 	td["revision"] = "0"
 	for k, v := range pluginFields {
 		td[k] = v
@@ -20,14 +20,20 @@ var (
 	})
 )
 
-type AutoGenFn func(r *http.Request) *store.TiddlyWebJSON
+type AutoGenFn func(wiki *Wiki, r *http.Request) *store.TiddlyWebJSON
 
 func init() {
 	autoGen = map[string]AutoGenFn{
-		AUTO_GENERATED_NOW: NewNow,
-		AUTO_GENERATED_IP:  NewSrcIP,
-
-		GENERATED_PLUGIN: NewPlugin,
+		AUTO_GENERATED_NOW: func(_ *Wiki, r *http.Request) *store.TiddlyWebJSON {
+			return NewNow(r)
+		},
+		AUTO_GENERATED_IP: func(_ *Wiki, r *http.Request) *store.TiddlyWebJSON {
+			return NewSrcIP(r)
+		},
+
+		GENERATED_PLUGIN: func(wiki *Wiki, _ *http.Request) *store.TiddlyWebJSON {
+			return NewPlugin(wiki.basePath())
+		},
 	}
 }
 
@@ -43,7 +49,7 @@ func NewNow(r *http.Request) *store.TiddlyWebJSON {
 func NewSrcIP(r *http.Request) *store.TiddlyWebJSON {
 	return &store.TiddlyWebJSON{
 		Title: AUTO_GENERATED_IP,
-		Text:  r.RemoteAddr,
+		Text:  utils.ClientAddr(r),
 		Tags:  autoGenTags,
 		Type:  "text/vnd.tiddlywiki",
 	}
@@ -0,0 +1,90 @@
+package tiddlywikid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"tiddlywikid/store"
+	"tiddlywikid/utils"
+)
+
+// bag names of the recipe, the recipe itself is the only bag if Store is not a RecipeStore
+func (wiki *Wiki) bagNames() []string {
+	rs, ok := wiki.Store.(*store.RecipeStore)
+	if !ok {
+		return []string{wiki.Recipe}
+	}
+	bags := rs.Bags()
+	names := make([]string, 0, len(bags))
+	for _, bag := range bags {
+		names = append(names, bag.Name)
+	}
+	return names
+}
+
+// `/bags/<bag>/tiddlers/<title>`, get from the bag, delete from the write bag only
+func (wiki *Wiki) bagTiddlers(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rs, ok := wiki.Store.(*store.RecipeStore)
+		if !ok {
+			wiki.delTiddler(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodOptions:
+			w.Header().Add("Allow", "GET, DELETE, OPTIONS")
+			return
+		case http.MethodGet:
+			wiki.getBagTiddler(w, r, rs.Bag(name))
+		case http.MethodDelete:
+			if rs.WriteBag().Name != name {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			wiki.delTiddler(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	})
+}
+
+func (wiki *Wiki) getBagTiddler(w http.ResponseWriter, r *http.Request, bag *store.Bag) {
+	key := r.URL.Path
+	isAnno, isLogin, _, sd := wiki.checkAuth(w, r)
+	if !isAnno && !isLogin { // no anno && not login
+		wiki.errNotLogin(w, r, sd)
+		return
+	}
+
+	// update CSRF
+	wiki.updateCSRF(w, r, sd)
+
+	td, hash := bag.Store.Get(key)
+	if td == nil || !wiki.canAccess(sd, key, td, false) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	td.Bag = bag.Name
+	wiki.fillDefault(td)
+
+	etag := fmt.Sprintf(`"%v/%v/%v:%v"`, bag.Name, "", td.Rev, hash) // bag, title, revision, hash/checksum
+	h := w.Header()
+	h.Set("Cache-Control", "max-age=0, must-revalidate")
+	h.Set("Content-Type", "application/json")
+	h.Set("Etag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		writeNotModified(w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	err := enc.Encode(td)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		utils.Vln(4, "[bag]err", bag.Name, key, err)
+		return
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"tiddlywikid/utils"
+)
+
+// all settings in one json file, flags are the default values
+type Config struct {
+	Listen       string    `json:"listen"`        // same as `-l`
+	ReadTimeout  int       `json:"read-timeout"`  // second, <= 0 disable
+	WriteTimeout int       `json:"write-timeout"` // second, <= 0 disable
+	TLS          TLSConfig `json:"tls"`
+
+	Gzip          int      `json:"gzip"`            // same as `-gz`
+	SessionTTL    Duration `json:"session-ttl"`     // like "15m"
+	SessionMaxAge Duration `json:"session-max-age"` // same as `-session-max-age`
+	RememberTTL   Duration `json:"remember-ttl"`    // same as `-remember-ttl`
+
+	Search        bool           `json:"search"`
+	SyncStoryList bool           `json:"sync-story-sequence"`
+	CheckRevision bool           `json:"check-revision"`
+	Revision      RevisionConfig `json:"revision"`
+	Limits        LimitsConfig   `json:"limits"`
+
+	TrustedProxies []string `json:"trusted-proxies"` // same as `-trusted-proxies`
+	trustedProxies []netip.Prefix
+
+	Wikis []*wikiConfig `json:"wikis"` // same as `-wikis`, or a single wiki by flags
+}
+
+type TLSConfig struct {
+	Crt string `json:"crt"`
+	Key string `json:"key"`
+}
+
+type RevisionConfig struct {
+	Count int      `json:"count"` // same as `-rev-count`
+	Age   Duration `json:"age"`   // same as `-rev-age`
+}
+
+type LimitsConfig struct {
+	Upload  int64 `json:"upload"`  // same as `-upload-limit`
+	Parse   int64 `json:"parse"`   // same as `-parse-limit`
+	Tiddler int64 `json:"tiddler"` // same as `-tiddler-size-limit`
+}
+
+// time.Duration in json as string, like "720h"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(buf []byte) error {
+	var str string
+	if err := json.Unmarshal(buf, &str); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+var (
+	dbTypes = map[string]bool{
+		"json":    true,
+		"bitcask": true,
+		"bolt":    true,
+		"files":   true,
+	}
+
+	configCurrent atomic.Value // *Config
+)
+
+func currentConfig() *Config {
+	cfg, _ := configCurrent.Load().(*Config)
+	return cfg
+}
+
+func setConfig(cfg *Config) {
+	configCurrent.Store(cfg)
+}
+
+// config by flags, then override by `-wikis` and `-config`
+func loadConfig() (*Config, error) {
+	cfg := &Config{
+		Listen:       *port,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		TLS: TLSConfig{
+			Crt: *crtFile,
+			Key: *keyFile,
+		},
+		Gzip:          *gzipLevel,
+		SessionTTL:    Duration(*sessionTTL),
+		SessionMaxAge: Duration(*sessionMaxAge),
+		RememberTTL:   Duration(*rememberTTL),
+		Search:        *enableSearch,
+		SyncStoryList: *syncStoryList,
+		CheckRevision: *checkRevision,
+		Revision: RevisionConfig{
+			Count: *revCount,
+			Age:   Duration(*revAge),
+		},
+		Limits: LimitsConfig{
+			Upload:  *uploadFileSizeLimit,
+			Parse:   *parseMemoryLimit,
+			Tiddler: *tiddlerSizeLimit,
+		},
+		TrustedProxies: splitList(*trustedProxies),
+		Wikis:          []*wikiConfig{flagWikiConfig()},
+	}
+
+	if *wikisFile != "" {
+		buf, err := os.ReadFile(*wikisFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Wikis = nil
+		if err := json.Unmarshal(buf, cfg); err != nil {
+			return nil, fmt.Errorf("%v: %w", *wikisFile, err)
+		}
+	}
+
+	if *configFile != "" {
+		buf, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		wikis := cfg.Wikis
+		cfg.Wikis = nil // not merge with wikis by flags
+		if err := json.Unmarshal(buf, cfg); err != nil {
+			return nil, fmt.Errorf("%v: %w", *configFile, err)
+		}
+		if cfg.Wikis == nil {
+			cfg.Wikis = wikis
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// check values and fill default for wikis
+func (cfg *Config) validate() error {
+	if cfg.Listen == "" {
+		return errors.New("listen: empty")
+	}
+	if (cfg.TLS.Crt == "") != (cfg.TLS.Key == "") {
+		return errors.New("tls: need both crt and key")
+	}
+	for _, fp := range []string{cfg.TLS.Crt, cfg.TLS.Key} {
+		if fp == "" {
+			continue
+		}
+		if _, err := os.Stat(fp); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+	}
+	if cfg.Gzip < -2 || cfg.Gzip > 9 {
+		return fmt.Errorf("gzip: level %v not in -2 ~ 9", cfg.Gzip)
+	}
+	if cfg.SessionTTL <= 0 {
+		return errors.New("session-ttl: should be positive")
+	}
+	if cfg.SessionMaxAge < 0 || cfg.RememberTTL < 0 {
+		return errors.New("session-max-age, remember-ttl: should not be negative")
+	}
+	proxies, err := utils.ParsePrefixList(cfg.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("trusted-proxies: %w", err)
+	}
+	cfg.trustedProxies = proxies
+	if cfg.Revision.Count < 0 || cfg.Revision.Age < 0 {
+		return errors.New("revision: should not be negative")
+	}
+	if cfg.Limits.Upload <= 0 || cfg.Limits.Parse <= 0 || cfg.Limits.Tiddler <= 0 {
+		return errors.New("limits: should be positive")
+	}
+	if len(cfg.Wikis) == 0 {
+		return errors.New("wikis: no wiki")
+	}
+
+	prefixs := make(map[string]bool)
+	for _, wc := range cfg.Wikis {
+		wc.Prefix = cleanPrefix(wc.Prefix)
+		if prefixs[wc.Prefix] {
+			return fmt.Errorf("wikis: duplicate prefix %q", wc.Prefix)
+		}
+		prefixs[wc.Prefix] = true
+
+		if wc.Base == "" {
+			wc.Base = *wikiBase
+		}
+		if wc.DB == "" {
+			wc.DB = *dbType
+		}
+		if wc.Recipe == "" {
+			wc.Recipe = *recipeName
+		}
+		if err := wc.validate(); err != nil {
+			return fmt.Errorf("wiki %q: %w", wc.Prefix, err)
+		}
+	}
+	return cfg.validateStores()
+}
+
+// one store path for one wiki or bag, a bag can be shared by recipes
+// session files should not be shared too
+func (cfg *Config) validateStores() error {
+	users := make(map[string]string)
+	use := func(fp string, user string) error {
+		if fp == "" {
+			return nil
+		}
+		key := storePath(fp)
+		if other, ok := users[key]; ok && other != user {
+			return fmt.Errorf("%q: used by both %v and %v", fp, other, user)
+		}
+		users[key] = user
+		return nil
+	}
+	for _, wc := range cfg.Wikis {
+		if err := use(wc.sessionPath(), fmt.Sprintf("sessions of wiki %q", wc.Prefix)); err != nil {
+			return err
+		}
+		if wc.Recipes == "" {
+			if err := use(wc.Store, fmt.Sprintf("wiki %q", wc.Prefix)); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := loadRecipeConfig(wc.Recipes)
+		if err != nil {
+			return fmt.Errorf("wiki %q: %w", wc.Prefix, err)
+		}
+		for name, bc := range rc.Bags {
+			if err := use(bc.Store, fmt.Sprintf("bag %q(%v)", name, bc.DB)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// wiki by path prefix
+func (cfg *Config) wiki(prefix string) *wikiConfig {
+	for _, wc := range cfg.Wikis {
+		if wc.Prefix == prefix {
+			return wc
+		}
+	}
+	return nil
+}
+
+// keep settings which can not change at runtime from old config
+// return names of changed settings need restart
+func (cfg *Config) mergeRuntime(old *Config) []string {
+	changed := make([]string, 0)
+	keep := func(name string, same bool) {
+		if !same {
+			changed = append(changed, name)
+		}
+	}
+	keep("listen", cfg.Listen == old.Listen)
+	keep("read-timeout", cfg.ReadTimeout == old.ReadTimeout)
+	keep("write-timeout", cfg.WriteTimeout == old.WriteTimeout)
+	keep("tls", cfg.TLS == old.TLS)
+	keep("session-ttl", cfg.SessionTTL == old.SessionTTL)
+	keep("session-max-age", cfg.SessionMaxAge == old.SessionMaxAge)
+	keep("remember-ttl", cfg.RememberTTL == old.RememberTTL)
+	keep("search", cfg.Search == old.Search)
+	keep("revision", cfg.Revision == old.Revision)
+	cfg.Listen = old.Listen
+	cfg.ReadTimeout = old.ReadTimeout
+	cfg.WriteTimeout = old.WriteTimeout
+	cfg.TLS = old.TLS
+	cfg.SessionTTL = old.SessionTTL
+	cfg.SessionMaxAge = old.SessionMaxAge
+	cfg.RememberTTL = old.RememberTTL
+	cfg.Search = old.Search
+	cfg.Revision = old.Revision
+
+	// wikis can not be added or removed, store and auth file can not change
+	wikis := make([]*wikiConfig, 0, len(old.Wikis))
+	for _, oldWc := range old.Wikis {
+		wc := cfg.wiki(oldWc.Prefix)
+		if wc == nil {
+			changed = append(changed, fmt.Sprintf("wikis[%q]", oldWc.Prefix))
+			wikis = append(wikis, oldWc)
+			continue
+		}
+		keep(fmt.Sprintf("wikis[%q].store", oldWc.Prefix), wc.DB == oldWc.DB && wc.Store == oldWc.Store && wc.Recipes == oldWc.Recipes && wc.Recipe == oldWc.Recipe)
+		keep(fmt.Sprintf("wikis[%q].auth", oldWc.Prefix), wc.Auth == oldWc.Auth)
+		keep(fmt.Sprintf("wikis[%q].session", oldWc.Prefix), wc.Session == oldWc.Session)
+		wc.DB, wc.Store, wc.Recipes, wc.Recipe = oldWc.DB, oldWc.Store, oldWc.Recipes, oldWc.Recipe
+		wc.Auth = oldWc.Auth
+		wc.Session = oldWc.Session
+		wikis = append(wikis, wc)
+	}
+	if len(cfg.Wikis) != len(old.Wikis) {
+		changed = append(changed, "wikis")
+	}
+	cfg.Wikis = wikis
+	return changed
+}
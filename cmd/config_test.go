@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := newTestConfig(newTestWikiConfig(t, "/a")).validate(); err != nil {
+		t.Fatal("valid config", err)
+	}
+
+	var testCase = []struct {
+		Name string
+		Edit func(cfg *Config)
+		Err  string
+	}{
+		{"duplicate prefix", func(cfg *Config) {
+			cfg.Wikis = append(cfg.Wikis, newTestWikiConfig(t, "a/"))
+		}, `duplicate prefix "/a"`},
+		{"no store", func(cfg *Config) {
+			cfg.Wikis[0].Store = ""
+		}, "no store"},
+		{"gzip too high", func(cfg *Config) {
+			cfg.Gzip = 10
+		}, "gzip"},
+		{"gzip too low", func(cfg *Config) {
+			cfg.Gzip = -3
+		}, "gzip"},
+		{"shared store", func(cfg *Config) {
+			wc := newTestWikiConfig(t, "/b")
+			wc.Store = cfg.Wikis[0].Store
+			cfg.Wikis = append(cfg.Wikis, wc)
+		}, "used by both"},
+	}
+	for _, tc := range testCase {
+		cfg := newTestConfig(newTestWikiConfig(t, "/a"))
+		tc.Edit(cfg)
+		err := cfg.validate()
+		if err == nil || !strings.Contains(err.Error(), tc.Err) {
+			t.Fatal(tc.Name, "should fail with", tc.Err, "got", err)
+		}
+	}
+}
+
+func TestMergeRuntime(t *testing.T) {
+	oldWc := newTestWikiConfig(t, "/a")
+	old := newTestConfig(oldWc)
+
+	wc := newTestWikiConfig(t, "/a")
+	cfg := newTestConfig(wc, newTestWikiConfig(t, "/b"))
+	cfg.Listen = ":5050"
+	cfg.SessionTTL = Duration(time.Hour)
+	cfg.Revision.Count = 3
+	cfg.Gzip = 9
+	cfg.CheckRevision = true
+	cfg.Limits.Tiddler = 1
+
+	changed := cfg.mergeRuntime(old)
+	want := []string{"listen", "session-ttl", "revision", `wikis["/a"].store`, "wikis"}
+	if strings.Join(changed, ",") != strings.Join(want, ",") {
+		t.Fatal("changed settings should be", want, "got", changed)
+	}
+
+	// need restart, kept
+	if cfg.Listen != old.Listen || cfg.SessionTTL != old.SessionTTL || cfg.Revision != old.Revision {
+		t.Fatal("server settings should be kept", cfg.Listen, cfg.SessionTTL, cfg.Revision)
+	}
+	if len(cfg.Wikis) != 1 || cfg.Wikis[0] != wc || wc.Store != oldWc.Store || wc.Session != oldWc.Session {
+		t.Fatal("wikis and their stores should be kept", cfg.Wikis, wc.Store)
+	}
+
+	// hot reload, applied
+	if cfg.Gzip != 9 || !cfg.CheckRevision || cfg.Limits.Tiddler != 1 || wc.Base == oldWc.Base {
+		t.Fatal("runtime settings should be applied", cfg.Gzip, cfg.CheckRevision, cfg.Limits, wc.Base)
+	}
+}
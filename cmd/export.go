@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+
+	api "tiddlywikid"
+)
+
+// tiddlywikid [flags] export [-inline] <wiki.html>
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	inline := fs.Bool("inline", false, "put attachments (from -d) back into tiddlers, or keep _canonical_uri")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		Vln(0, "usage: tiddlywikid [flags] export [-inline] <wiki.html>")
+		os.Exit(2)
+	}
+
+	wc := currentConfig().wiki(cleanPrefix(*prefix))
+	if wc == nil {
+		Vln(0, "[wiki]not found", *prefix)
+		os.Exit(1)
+	}
+	store, shoutdownFn, err := wc.openStore()
+	if err != nil {
+		Vln(0, "[db]err", err)
+		os.Exit(1)
+	}
+
+	wiki := api.NewWiki(wc.newMux(), store, nil)
+	wiki.Files = wc.Files
+	wiki.Base = wc.Base
+
+	var b bytes.Buffer
+	err = wiki.ExportHTML(&b, &api.ExportOptions{
+		Inline: *inline,
+	})
+	shoutdownFn()
+	if err != nil {
+		Vln(0, "[export]err", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(fs.Arg(0), b.Bytes(), 0644); err != nil {
+		Vln(0, "[export]write err", err)
+		os.Exit(1)
+	}
+	Vln(0, "[export]", fs.Arg(0), b.Len())
+}
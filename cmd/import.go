@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	api "tiddlywikid"
+)
+
+// tiddlywikid [flags] import [-overwrite] [-plugins] [-extract 16384] <wiki.html>
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	overwrite := fs.Bool("overwrite", false, "overwrite existing tiddlers")
+	plugins := fs.Bool("plugins", false, "also import plugins (JavaScript in them will not run)")
+	extract := fs.Int64("extract", 0, "save base64 binary tiddler larger than this (bytes) to attachment directory (-d), 0 for disable")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		Vln(0, "usage: tiddlywikid [flags] import [-overwrite] [-plugins] [-extract 16384] <wiki.html>")
+		os.Exit(2)
+	}
+
+	buf, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		Vln(0, "[import]read err", err)
+		os.Exit(1)
+	}
+
+	wc := currentConfig().wiki(cleanPrefix(*prefix))
+	if wc == nil {
+		Vln(0, "[wiki]not found", *prefix)
+		os.Exit(1)
+	}
+	store, shoutdownFn, err := wc.openStore()
+	if err != nil {
+		Vln(0, "[db]err", err)
+		os.Exit(1)
+	}
+
+	wiki := api.NewWiki(wc.newMux(), store, nil)
+	wiki.Files = wc.Files
+	res, err := wiki.ImportHTML(buf, &api.ImportOptions{
+		Overwrite:   *overwrite,
+		Plugins:     *plugins,
+		ExtractSize: *extract,
+	})
+	shoutdownFn()
+	if err != nil {
+		Vln(0, "[import]err", err)
+		os.Exit(1)
+	}
+	for _, title := range res.Skipped {
+		Vln(3, "[import]skip", title)
+	}
+	Vln(0, "[import]imported", res.Imported, "extracted", res.Extracted, "skipped", len(res.Skipped))
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -15,6 +18,7 @@ import (
 	authpkg "tiddlywikid/auth"
 	session "tiddlywikid/session"
 	storepkg "tiddlywikid/store"
+	"tiddlywikid/utils"
 )
 
 var (
@@ -25,23 +29,45 @@ var (
 	port      = flag.String("l", ":4040", "bind port")
 	dir       = flag.String("d", "./files", "static file directory")
 	wikiBase  = flag.String("base", "index.html", "base TiddlyWiki file")
+	prefix    = flag.String("prefix", "", "path prefix for serving under sub path, like /wiki")
+	inject    = flag.String("inject", "", "plugin files (JSON, comma separated) to inject into base TiddlyWiki file")
 
 	// json for dev
-	dbType    = flag.String("db", "json", "store type (json, bitcask)")
+	dbType    = flag.String("db", "json", "store type (json, bitcask, bolt, files)")
 	dbStore   = flag.String("store", "tiddlersDb.json", "store path")
-	authStore = flag.String("auth", "user.json", "all user in a json file (for dev)")
+	authStore = flag.String("auth", "user.json", "all user in a json file, empty for no access control (any login is admin)")
+
+	recipeFile = flag.String("recipes", "", "bags and recipes in a json file, override -db and -store")
+	recipeName = flag.String("recipe", "default", "recipe to serve")
+
+	wikisFile  = flag.String("wikis", "", "serve multiple wikis in a json file, each with own path prefix, store, base, files and auth")
+	configFile = flag.String("config", "", "all settings in a json file, override flags, reload when changed")
+
+	gzipLevel     = flag.Int("gz", api.DefaultGzipLevel, "gzip disable = 0, DefaultCompression = -1, BestSpeed = 1, BestCompression = 9")
+	sessionTTL    = flag.Duration("session-ttl", session.SESSION_TTL, "session timeout without any request")
+	sessionMaxAge = flag.Duration("session-max-age", 0, "session lifetime since login even if active (eg: 12h), 0 for no limit")
+	rememberTTL   = flag.Duration("remember-ttl", api.DefaultRememberTTL, "lifetime of \"remember me\" login, 0 for disable")
+	sessFile      = flag.String("session", "", "keep sessions in a json file over restart, empty for next to the store, \"none\" for memory only")
+
+	revCount = flag.Int("rev-count", storepkg.DefaultRevisionCount, "max old revisions to keep for each tiddler, 0 for disable history")
+	revAge   = flag.Duration("rev-age", 0, "drop old revisions older than this (eg: 720h), 0 for no limit")
 
 	syncStoryList = flag.Bool("sync-story-sequence", false, "save and put $:/StoryList and $:/HistoryList, will cause some issue when multi-user/multi-window")
+	enableSearch  = flag.Bool("search", true, "enable full-text search index")
+	checkRevision = flag.Bool("check-revision", false, "reject PUT with outdated revision field in body")
 
 	uploadFileSizeLimit = flag.Int64("upload-limit", api.DefaultUploadFileSizeLimit, "size limit for file uploading")
 	parseMemoryLimit    = flag.Int64("parse-limit", api.DefaultParseMemoryLimit, "max size for parsing when file uploading")
 	tiddlerSizeLimit    = flag.Int64("tiddler-size-limit", api.DefaultTiddlerSizeLimit, "max size for a tiddler")
 
+	trustedProxies = flag.String("trusted-proxies", "", "reverse proxies (IP or CIDR, comma separated) to get client IP from X-Forwarded-For, Forwarded or X-Real-IP")
+
 	crtFile = flag.String("crt", "", "https certificate file")
 	keyFile = flag.String("key", "", "https private key file")
 
 	// for dev
-	doHash = flag.String("hash", "", "hash a password")
+	doHash  = flag.String("hash", "", "hash a password")
+	doToken = flag.String("token", "", "generate an API token with the name")
 )
 
 func reqAtom(atomNext *atomic.Value) http.Handler {
@@ -57,7 +83,7 @@ func reqAtom(atomNext *atomic.Value) http.Handler {
 
 func reqlog(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		Vln(3, r.Method, r.URL, r.RemoteAddr, r.Host)
+		Vln(3, r.Method, r.URL, utils.ClientAddr(r), r.Host)
 		if *verbosity >= 6 {
 			for i, hdr := range r.Header {
 				Vln(6, "---", i, len(hdr), hdr)
@@ -85,97 +111,65 @@ func main() {
 		return
 	}
 
-	// store not reload
-	var store storepkg.Store
-	var shoutdownFn func()
-	switch *dbType {
-	default:
-		fallthrough
-	case "json":
-		storeJson := storepkg.NewMemStore()
-		storeJson.Load(*dbStore)
-		shoutdownFn = func() {
-			storeJson.Dump(*dbStore)
-		}
-		store = storeJson
-	case "bitcask":
-		storeBitcask, err := storepkg.NewBitcaskStore(*dbStore)
+	if *doToken != "" {
+		token, hash, err := authpkg.NewToken()
 		if err != nil {
-			Vln(1, "[db]err", err)
-			return
+			Vln(0, "[token]err", err)
+			os.Exit(1)
 		}
-		shoutdownFn = func() {
-			storeBitcask.Merge()
-			storeBitcask.Close()
-		}
-		store = storeBitcask
+		Vln(0, "[token]", token)
+		Vln(0, "[token]add to `tokens` of the user:", fmt.Sprintf(`{"name": %q, "hash": %q}`, *doToken, hash))
+		return
 	}
 
-	// session not reload
-	sess := session.NewMemSession()
-
-	var wikiHandler atomic.Value // hold handler for current config
-
-	initWiki := func() *api.Wiki {
-		wiki := api.NewWiki(nil, store, sess)
-		wiki.SyncStoryList = *syncStoryList
-		wiki.Files = *dir
-		wiki.Base = *wikiBase
-		wiki.UploadFileSizeLimit = *uploadFileSizeLimit
-		wiki.ParseMemoryLimit = *parseMemoryLimit
-		wiki.TiddlerSizeLimit = *tiddlerSizeLimit
-		return wiki
+	cfg, err := loadConfig()
+	if err != nil {
+		Vln(0, "[config]err", err)
+		os.Exit(1)
 	}
+	setConfig(cfg)
 
-	if *authStore != "" {
-		buildHandler := func() (func(), error) {
-			auth := authpkg.NewAuthCustom()
-			if err := auth.Load(*authStore); err != nil {
-				Vln(0, "[acl]load err", err)
-				return nil, err
-			}
-			// Vln(0, "[acl]", auth.UserDB, auth.AnonymousEdit)
+	// sub command
+	switch flag.Arg(0) {
+	case "import":
+		runImport(flag.Args()[1:])
+		return
+	case "export":
+		runExport(flag.Args()[1:])
+		return
+	}
 
-			wiki := initWiki()
-			wiki.AuthHandler = auth
-			wiki.SetupMux(nil) // bind handler
+	api.SetGzipLevel(cfg.Gzip)
+	utils.SetTrustedProxies(cfg.trustedProxies)
+	api.SetSessionTTL(time.Duration(cfg.SessionTTL))
+	api.SetSessionMaxAge(time.Duration(cfg.SessionMaxAge))
+	api.SetRememberTTL(time.Duration(cfg.RememberTTL))
 
-			wikiHandler.Store(wiki)
-			return nil, nil
-		}
+	handler, wikis, shoutdownFn, err := startWikis(cfg)
+	if err != nil {
+		Vln(1, "[wiki]err", err)
+		return
+	}
 
-		// watch for config file chnage
-		go func() {
-			clean, _ := buildHandler()
-
-			for {
-				if err := watchFile(*authStore); err == nil {
-					Vln(2, "[config]has been changed")
-					if clr, err := buildHandler(); err == nil {
-						if clean != nil {
-							clean()
-						}
-						clean = clr
-					}
-				}
-
-				time.Sleep(2 * time.Second)
-			}
-		}()
-	} else {
-		wiki := initWiki()
-		wiki.SetupMux(nil) // bind handler
-		wikiHandler.Store(wiki)
+	if *configFile != "" {
+		go watchConfig(wikis)
 	}
 
 	// http.Handle("/", reqlog(wiki(http.FileServer(http.Dir(*dir)))))
 	srv := &http.Server{
-		ReadTimeout:  time.Duration(*readTimeout) * time.Second,
-		WriteTimeout: time.Duration(*writeTimeout) * time.Second,
-		Addr:         *port,
-		Handler:      reqlog(reqAtom(&wikiHandler)),
+		ReadTimeout:  time.Duration(cfg.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(cfg.WriteTimeout) * time.Second,
+		Addr:         cfg.Listen,
+		Handler:      reqlog(handler),
 	}
 
+	// cancel long-lived requests (Server-Sent Events) when shutdown
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	srv.BaseContext = func(net.Listener) context.Context {
+		return baseCtx
+	}
+	srv.RegisterOnShutdown(cancelBase)
+
 	idleConnsClosed := make(chan struct{})
 	go func() {
 		sigint := make(chan os.Signal, 1)
@@ -192,7 +186,7 @@ func main() {
 
 	// log.Printf("srv -> client (TX) limit: %v\n", *txSpd)
 	// log.Printf("srv <- client (RX) limit: %v\n", *rxSpd)
-	startServer(srv, *crtFile, *keyFile)
+	startServer(srv, cfg.TLS.Crt, cfg.TLS.Key)
 
 	<-idleConnsClosed
 
@@ -200,6 +194,113 @@ func main() {
 	shoutdownFn()
 }
 
+// start all wikis in config, by path prefix
+func startWikis(cfg *Config) (handler http.Handler, wikis map[string]*wikiServer, shoutdownFn func(), err error) {
+	mux := http.NewServeMux()
+	wikis = make(map[string]*wikiServer, len(cfg.Wikis))
+	shoutdownFns := make([]func(), 0, len(cfg.Wikis))
+	shoutdownFn = func() {
+		for _, fn := range shoutdownFns {
+			fn()
+		}
+	}
+	for _, wc := range cfg.Wikis {
+		ws, fn, err := startWiki(cfg, wc)
+		if err != nil {
+			shoutdownFn()
+			return nil, nil, nil, fmt.Errorf("wiki %q: %w", wc.Prefix, err)
+		}
+		shoutdownFns = append(shoutdownFns, fn)
+		wikis[wc.Prefix] = ws
+		mux.Handle(wc.Prefix+"/", ws.Handler())
+		Vln(2, "[wiki]", wc.Prefix+"/", wc.Base)
+	}
+	return mux, wikis, shoutdownFn, nil
+}
+
+// reload `-config` when changed, keep current config if any error
+func watchConfig(wikis map[string]*wikiServer) {
+	for {
+		if err := watchFile(*configFile); err == nil {
+			Vln(2, "[config]has been changed", *configFile)
+			reloadConfig(wikis)
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func reloadConfig(wikis map[string]*wikiServer) {
+	cfg, err := loadConfig()
+	if err != nil {
+		Vln(0, "[config]reload err", err)
+		return
+	}
+	for _, name := range cfg.mergeRuntime(currentConfig()) {
+		Vln(1, "[config]need restart for", name)
+	}
+	setConfig(cfg)
+
+	api.SetGzipLevel(cfg.Gzip)
+	utils.SetTrustedProxies(cfg.trustedProxies)
+	for _, wc := range cfg.Wikis {
+		ws, ok := wikis[wc.Prefix]
+		if !ok {
+			continue
+		}
+		ws.build(cfg, wc)
+	}
+}
+
+// open store by type and path, shoutdownFn for write back and close
+func openStoreBy(dbType string, dbStore string) (store storepkg.Store, shoutdownFn func(), err error) {
+	rev := currentConfig().Revision
+	switch dbType {
+	default:
+		fallthrough
+	case "json":
+		storeJson := storepkg.NewMemStore()
+		storeJson.SetRevisionPolicy(rev.Count, time.Duration(rev.Age))
+		storeJson.Load(dbStore)
+		shoutdownFn = func() {
+			storeJson.Dump(dbStore)
+		}
+		store = storeJson
+	case "bitcask":
+		storeBitcask, err := storepkg.NewBitcaskStore(dbStore)
+		if err != nil {
+			return nil, nil, err
+		}
+		storeBitcask.SetRevisionPolicy(rev.Count, time.Duration(rev.Age))
+		shoutdownFn = func() {
+			storeBitcask.Merge()
+			storeBitcask.Close()
+		}
+		store = storeBitcask
+	case "bolt":
+		storeBolt, err := storepkg.NewBoltStore(dbStore)
+		if err != nil {
+			return nil, nil, err
+		}
+		storeBolt.SetRevisionPolicy(rev.Count, time.Duration(rev.Age))
+		shoutdownFn = func() {
+			storeBolt.Close()
+		}
+		store = storeBolt
+	case "files":
+		storeFiles, err := storepkg.NewFileStore(dbStore)
+		if err != nil {
+			return nil, nil, err
+		}
+		storeFiles.SetRevisionPolicy(rev.Count, time.Duration(rev.Age))
+		shoutdownFn = func() {
+			storeFiles.Close()
+		}
+		store = storeFiles
+	}
+	return store, shoutdownFn, nil
+}
+
 func startServer(srv *http.Server, crt string, key string) {
 	var err error
 
@@ -261,6 +362,17 @@ func Vln(level int, v ...interface{}) {
 	}
 }
 
+func splitList(str string) []string {
+	out := make([]string, 0, 4)
+	for _, v := range strings.Split(str, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
 func watchFile(fp string) error {
 	stat0, err := os.Stat(fp)
 	if err != nil {
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	storepkg "tiddlywikid/store"
+)
+
+// bags and recipes in a json file
+type recipeConfig struct {
+	Bags    map[string]*bagConfig    `json:"bags"`
+	Recipes map[string]*recipeLayers `json:"recipes"`
+}
+
+type bagConfig struct {
+	DB    string `json:"db"`    // store type, same as `-db`
+	Store string `json:"store"` // store path, same as `-store`
+}
+
+type recipeLayers struct {
+	Bags  []string `json:"bags"`  // later bag override earlier one
+	Write string   `json:"write"` // bag to write, empty for the last one
+}
+
+// open bags used by recipe `name` in config file `fp`, each bag is wrapped for change notify
+func openRecipe(fp string, name string) (store storepkg.Store, shoutdownFn func(), err error) {
+	cfg, err := loadRecipeConfig(fp)
+	if err != nil {
+		return nil, nil, err
+	}
+	recipe, ok := cfg.Recipes[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("recipe %v not found", name)
+	}
+
+	bags := make([]*storepkg.Bag, 0, len(recipe.Bags))
+	shoutdownFns := make([]func(), 0, len(recipe.Bags))
+	shoutdownFn = func() {
+		for _, fn := range shoutdownFns {
+			fn()
+		}
+	}
+	for _, bagName := range recipe.Bags {
+		bc, ok := cfg.Bags[bagName]
+		if !ok {
+			shoutdownFn()
+			return nil, nil, fmt.Errorf("bag %v not found", bagName)
+		}
+		s, fn, err := openBag(bc)
+		if err != nil {
+			shoutdownFn()
+			return nil, nil, fmt.Errorf("bag %v: %w", bagName, err)
+		}
+		shoutdownFns = append(shoutdownFns, fn)
+		bags = append(bags, &storepkg.Bag{
+			Name:  bagName,
+			Store: s,
+		})
+	}
+
+	rs, err := storepkg.NewRecipeStore(bags, recipe.Write)
+	if err != nil {
+		shoutdownFn()
+		return nil, nil, err
+	}
+	return rs, shoutdownFn, nil
+}
+
+func loadRecipeConfig(fp string) (*recipeConfig, error) {
+	buf, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &recipeConfig{}
+	if err := json.Unmarshal(buf, cfg); err != nil {
+		return nil, fmt.Errorf("%v: %w", fp, err)
+	}
+	return cfg, nil
+}
+
+// bags opened by this process, shared by recipes of all wikis
+var openBags = struct {
+	sync.Mutex
+	m map[string]*sharedBag
+}{m: make(map[string]*sharedBag)}
+
+type sharedBag struct {
+	store       *storepkg.WatchStore
+	refs        int
+	shoutdownFn func()
+}
+
+// open bag once per process, so all recipes see the same data and changes
+// the store is closed when the last user shutdown
+func openBag(bc *bagConfig) (store *storepkg.WatchStore, shoutdownFn func(), err error) {
+	key := bc.DB + ":" + storePath(bc.Store)
+	openBags.Lock()
+	defer openBags.Unlock()
+	b, ok := openBags.m[key]
+	if !ok {
+		s, fn, err := openStoreBy(bc.DB, bc.Store)
+		if err != nil {
+			return nil, nil, err
+		}
+		b = &sharedBag{store: storepkg.NewWatchStore(s), shoutdownFn: fn}
+		openBags.m[key] = b
+	}
+	b.refs++
+
+	var once sync.Once
+	shoutdownFn = func() {
+		once.Do(func() {
+			openBags.Lock()
+			defer openBags.Unlock()
+			b.refs--
+			if b.refs == 0 {
+				delete(openBags.m, key)
+				b.shoutdownFn()
+			}
+		})
+	}
+	return b.store, shoutdownFn, nil
+}
+
+// absolute path of store for compare
+func storePath(fp string) string {
+	if abs, err := filepath.Abs(fp); err == nil {
+		return abs
+	}
+	return filepath.Clean(fp)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	api "tiddlywikid"
+	authpkg "tiddlywikid/auth"
+	"tiddlywikid/search"
+	session "tiddlywikid/session"
+	storepkg "tiddlywikid/store"
+)
+
+const (
+	// how often to drop expired deleted tiddlers and unused attachment files
+	sweepInterval = time.Hour
+
+	// `-session` value for keeping sessions in memory only
+	sessionMemOnly = "none"
+)
+
+// one wiki served by this process
+type wikiConfig struct {
+	Prefix  string   `json:"prefix"`  // path prefix, like "/team", empty for root
+	Base    string   `json:"base"`    // same as `-base`
+	Inject  []string `json:"inject"`  // same as `-inject`
+	Files   string   `json:"files"`   // same as `-d`
+	Auth    string   `json:"auth"`    // same as `-auth`
+	DB      string   `json:"db"`      // same as `-db`
+	Store   string   `json:"store"`   // same as `-store`
+	Recipes string   `json:"recipes"` // same as `-recipes`
+	Recipe  string   `json:"recipe"`  // same as `-recipe`
+	Session string   `json:"session"` // same as `-session`
+}
+
+// wiki config by flags
+func flagWikiConfig() *wikiConfig {
+	return &wikiConfig{
+		Prefix:  cleanPrefix(*prefix),
+		Base:    *wikiBase,
+		Inject:  splitList(*inject),
+		Files:   *dir,
+		Auth:    *authStore,
+		DB:      *dbType,
+		Store:   *dbStore,
+		Recipes: *recipeFile,
+		Recipe:  *recipeName,
+		Session: *sessFile,
+	}
+}
+
+func (wc *wikiConfig) validate() error {
+	if wc.Store == "" && wc.Recipes == "" {
+		return errors.New("no store")
+	}
+	if !dbTypes[wc.DB] {
+		return fmt.Errorf("unknown db type %q", wc.DB)
+	}
+	if wc.Files == "" {
+		return errors.New("no files directory")
+	}
+	files := append([]string{wc.Base, wc.Auth, wc.Recipes}, wc.Inject...)
+	for _, fp := range files {
+		if fp == "" {
+			continue
+		}
+		if _, err := os.Stat(fp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open store by `recipes` and `recipe`, or `db` and `store`
+func (wc *wikiConfig) openStore() (store storepkg.Store, shoutdownFn func(), err error) {
+	if wc.Recipes != "" {
+		return openRecipe(wc.Recipes, wc.Recipe)
+	}
+	return openStoreBy(wc.DB, wc.Store)
+}
+
+// sessions in file, or memory only for "none"
+func (wc *wikiConfig) openSession() (session.SessionStore, error) {
+	fp := wc.sessionPath()
+	if fp == "" {
+		return session.NewMemSession(), nil
+	}
+	return session.NewFileSession(fp)
+}
+
+// session file, next to store if not set, like "tiddlers.db.sessions.json"
+// empty for memory only
+func (wc *wikiConfig) sessionPath() string {
+	switch {
+	case wc.Session == sessionMemOnly:
+		return ""
+	case wc.Session != "":
+		return wc.Session
+	case wc.Recipes != "":
+		return filepath.Clean(wc.Recipes) + "." + wc.Recipe + ".sessions.json"
+	}
+	return filepath.Clean(wc.Store) + ".sessions.json"
+}
+
+// like "/wiki", empty for root
+func cleanPrefix(prefix string) string {
+	prefix = path.Clean("/" + prefix)
+	if prefix == "/" {
+		return ""
+	}
+	return prefix
+}
+
+func (wc *wikiConfig) newMux() *api.Mux {
+	if wc.Prefix == "" {
+		return api.NewRootMux()
+	}
+	return api.NewMux(wc.Prefix)
+}
+
+// a running wiki, rebuilt when config or auth file changed
+type wikiServer struct {
+	mx sync.Mutex
+	wc *wikiConfig
+
+	// not reload
+	store     storepkg.Store
+	searchIdx *search.Index
+	sess      session.SessionStore
+	guard     *authpkg.LoginGuard // keep failed logins over reload
+
+	acl     *authpkg.AuthCustom // current auth file, for revoke sessions when users changed
+	handler atomic.Value        // hold handler for current config
+}
+
+// open store and build handler, reload when auth file changed
+func startWiki(cfg *Config, wc *wikiConfig) (ws *wikiServer, shoutdownFn func(), err error) {
+	store, shoutdownFn, err := wc.openStore()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// notify changes for Server-Sent Events
+	watcher, ok := store.(storepkg.Watcher)
+	if !ok {
+		watchStore := storepkg.NewWatchStore(store)
+		store = watchStore
+		watcher = watchStore
+	}
+
+	// full-text search
+	var searchIdx *search.Index
+	if cfg.Search {
+		searchIdx = search.NewIndex()
+		searchIdx.Build(store)
+		searchIdx.Watch(watcher, store)
+		Vln(2, "[search]indexed", wc.Prefix, searchIdx.Len())
+	}
+
+	sess, err := wc.openSession()
+	if err != nil {
+		shoutdownFn()
+		return nil, nil, err
+	}
+	closeStore := shoutdownFn
+	stopSweep := make(chan struct{})
+	sweepDone := make(chan struct{})
+	shoutdownFn = func() {
+		close(stopSweep)
+		<-sweepDone
+		sess.Close() // write back sessions
+		closeStore()
+	}
+
+	ws = &wikiServer{
+		wc:        wc,
+		store:     store,
+		searchIdx: searchIdx,
+		sess:      sess,
+		guard:     authpkg.NewLoginGuard(nil),
+	}
+	go ws.sweepLoop(stopSweep, sweepDone)
+	if err := ws.build(cfg, wc); err != nil {
+		shoutdownFn()
+		return nil, nil, err
+	}
+
+	if wc.Auth != "" {
+		// watch for config file chnage
+		go func() {
+			for {
+				if err := watchFile(wc.Auth); err == nil {
+					Vln(2, "[config]has been changed", wc.Auth)
+					ws.build(currentConfig(), nil)
+				}
+
+				time.Sleep(2 * time.Second)
+			}
+		}()
+	}
+	return ws, shoutdownFn, nil
+}
+
+// build wiki by config, nil wc for keep current one
+// keep current handler if auth file can not load
+func (ws *wikiServer) build(cfg *Config, wc *wikiConfig) error {
+	ws.mx.Lock()
+	defer ws.mx.Unlock()
+	if wc == nil {
+		wc = ws.wc
+	}
+
+	var auth authpkg.Auth
+	var acl *authpkg.AuthCustom
+	if wc.Auth != "" {
+		acl = authpkg.NewAuthCustom()
+		if err := acl.Load(wc.Auth); err != nil {
+			Vln(0, "[acl]load err", wc.Auth, err)
+			return err
+		}
+		// Vln(0, "[acl]", auth.UserDB, auth.AnonymousEdit)
+		auth = acl
+	}
+
+	wiki := api.NewWiki(nil, ws.store, ws.sess)
+	if auth != nil {
+		wiki.AuthHandler = auth
+	}
+	if acl != nil {
+		ws.guard.SetLimit(acl.LoginLimit)
+	}
+	wiki.LoginGuard = ws.guard
+	wiki.Search = ws.searchIdx
+	wiki.Recipe = wc.Recipe
+	wiki.SyncStoryList = cfg.SyncStoryList
+	wiki.CheckRevision = cfg.CheckRevision
+	wiki.Files = wc.Files
+	wiki.Base = wc.Base
+	wiki.Plugins = wc.Inject
+	wiki.UploadFileSizeLimit = cfg.Limits.Upload
+	wiki.ParseMemoryLimit = cfg.Limits.Parse
+	wiki.TiddlerSizeLimit = cfg.Limits.Tiddler
+	wiki.SetupMux(wc.newMux()) // bind handler
+
+	// user removed or password changed
+	if ws.acl != nil {
+		var users *authpkg.UserDB
+		if acl != nil {
+			users = acl.UserDB
+		}
+		for _, login := range ws.acl.UserDB.Changed(users) {
+			n := wiki.RevokeUser(login)
+			Vln(2, "[acl]user changed, revoke sessions", wc.Prefix, login, n)
+		}
+	}
+
+	ws.wc = wc
+	ws.acl = acl
+	old, _ := ws.handler.Load().(*api.Wiki)
+	ws.handler.Store(wiki)
+	if old != nil {
+		old.Close() // end event streams, clients connect again with new roles and rules
+	}
+	return nil
+}
+
+// sweep deleted tiddlers and unused files periodically, and once more before stop
+func (ws *wikiServer) sweepLoop(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ws.sweep()
+		case <-stop:
+			ws.sweep()
+			return
+		}
+	}
+}
+
+func (ws *wikiServer) sweep() {
+	wiki, ok := ws.handler.Load().(*api.Wiki)
+	if !ok {
+		return // not built
+	}
+	if n := wiki.Sweep(); n > 0 {
+		ws.mx.Lock()
+		prefix := ws.wc.Prefix
+		ws.mx.Unlock()
+		Vln(2, "[sweep]files removed", prefix, n)
+	}
+}
+
+func (ws *wikiServer) Handler() http.Handler {
+	return reqAtom(&ws.handler)
+}
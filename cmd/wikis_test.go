@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	api "tiddlywikid"
+)
+
+func newTestWikiConfig(t *testing.T, prefix string) *wikiConfig {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "index.html")
+	if err := os.WriteFile(base, []byte(`<html></html>`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &wikiConfig{
+		Prefix:  prefix,
+		Base:    base,
+		Files:   filepath.Join(dir, "files"),
+		DB:      "json",
+		Store:   filepath.Join(dir, "tiddlers.json"),
+		Recipe:  "default",
+		Session: sessionMemOnly,
+	}
+}
+
+func newTestConfig(wikis ...*wikiConfig) *Config {
+	return &Config{
+		Listen:     ":4040",
+		SessionTTL: Duration(time.Minute),
+		Limits: LimitsConfig{
+			Upload:  api.DefaultUploadFileSizeLimit,
+			Parse:   api.DefaultParseMemoryLimit,
+			Tiddler: api.DefaultTiddlerSizeLimit,
+		},
+		Wikis: wikis,
+	}
+}
+
+// start wikis in config, stopped when test end
+func startTestWikis(t *testing.T, cfg *Config) http.Handler {
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(cfg)
+	handler, _, shoutdownFn, err := startWikis(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(shoutdownFn)
+	return handler
+}
+
+func TestPrefixRouting(t *testing.T) {
+	handler := startTestWikis(t, newTestConfig(newTestWikiConfig(t, ""), newTestWikiConfig(t, "team/")))
+
+	do := func(method string, path string, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-Requested-With", "TiddlyWiki")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := do(http.MethodPut, "/team/recipes/default/tiddlers/Note", `{"title": "Note"}`); code != http.StatusNoContent {
+		t.Fatal("put to prefixed wiki failed", code)
+	}
+
+	var testCase = []struct {
+		Path string
+		Code int
+	}{
+		{"/team/recipes/default/tiddlers/Note", http.StatusOK},
+		{"/recipes/default/tiddlers/Note", http.StatusNotFound}, // other store
+		{"/team", http.StatusMovedPermanently},
+		{"/team/status", http.StatusOK},
+		{"/status", http.StatusOK},
+	}
+	for _, tc := range testCase {
+		if code := do(http.MethodGet, tc.Path, ""); code != tc.Code {
+			t.Fatal(tc.Path, "should be", tc.Code, "got", code)
+		}
+	}
+}
+
+func TestPrefixCookiePath(t *testing.T) {
+	handler := startTestWikis(t, newTestConfig(newTestWikiConfig(t, ""), newTestWikiConfig(t, "/team")))
+
+	for prefix, cookiePath := range map[string]string{"": "/", "/team": "/team/"} {
+		r := httptest.NewRequest(http.MethodPost, prefix+"/challenge/tiddlywebplugins.tiddlyspace.cookie_form", strings.NewReader("user=any&password=any"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Requested-With", "TiddlyWiki")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatal(prefix, "login failed", w.Code)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) == 0 {
+			t.Fatal(prefix, "no cookie after login")
+		}
+		for _, cookie := range cookies {
+			if cookie.Path != cookiePath {
+				t.Fatal(prefix, "cookie", cookie.Name, "path should be", cookiePath, "got", cookie.Path)
+			}
+		}
+
+		// session of one wiki is not used by other
+		r = httptest.NewRequest(http.MethodGet, "/team/status", nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if loggedIn := !strings.Contains(w.Body.String(), `"username":"GUEST"`); loggedIn != (prefix == "/team") {
+			t.Fatal(prefix, "bad login state in /team", w.Body.String())
+		}
+	}
+}
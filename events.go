@@ -0,0 +1,130 @@
+package tiddlywikid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"tiddlywikid/session"
+	"tiddlywikid/store"
+	"tiddlywikid/utils"
+)
+
+const (
+	EventsKeepAlive  = 30 * time.Second
+	EventsBufferSize = 64
+)
+
+// Server-Sent Events for tiddler changes
+// event: `put` or `del`, data: `{"title":"","revision":"","hash":"","modifier":""}`
+// stream ends when the login session is gone (logout, revoked or timeout), or the wiki is closed for new config
+func (wiki *Wiki) events(w http.ResponseWriter, r *http.Request) {
+	isAnno, isLogin, _, sd := wiki.checkAuth(w, r)
+	if !isAnno && !isLogin { // no anno && not login
+		wiki.errNotLogin(w, r, sd)
+		return
+	}
+	alive := wiki.sessAlive(r, sd)
+
+	watcher, ok := wiki.Store.(store.Watcher)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	checkDeleted := wiki.deletedCheck(sd)
+
+	// drop event if client too slow, client will sync by polling anyway
+	ch := make(chan *store.ChangeEvent, EventsBufferSize)
+	cancel := watcher.Watch(func(ev *store.ChangeEvent) {
+		select {
+		case ch <- ev:
+		default:
+		}
+	})
+	defer cancel()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // for nginx
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", 5000)
+	flusher.Flush()
+
+	utils.Vln(4, "[events]start", clientIP(r))
+	defer utils.Vln(4, "[events]end", clientIP(r))
+
+	ticker := time.NewTicker(EventsKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wiki.closed:
+			return
+		case <-ticker.C:
+			if !alive() {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case ev := <-ch:
+			if !alive() {
+				return
+			}
+			if !wiki.SyncStoryList && (ev.Title == STORYLIST_PATH || ev.Title == HISTORYLIST_PATH) {
+				continue
+			}
+			if ev.Op == store.EventDel && checkDeleted != nil && !checkDeleted(ev.Title) {
+				continue
+			}
+			if !wiki.canAccessTitle(sd, ev.Title, false) {
+				continue
+			}
+			buf, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Op, buf); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// check stored session of a long-lived request is not removed, without resume by "remember me"
+// sessions only for the request (token, basic auth, proxy) and anonymous are checked by the wiki config only
+func (wiki *Wiki) sessAlive(r *http.Request, sd *session.SessionData) func() bool {
+	always := func() bool { return true }
+	if sd == nil {
+		return always
+	}
+	if _, ok := sd.Get("via"); ok {
+		return always
+	}
+
+	// cookie of this request, or a new one set by resume
+	token := ""
+	if cookie, err := r.Cookie(_SESSION_COOKIE); err == nil && wiki.Sess.GetOrRenew(cookie.Value) == sd {
+		token = cookie.Value
+	} else {
+		wiki.Sess.Range(func(t string, s *session.SessionData) bool {
+			if s == sd {
+				token = t
+			}
+			return token == ""
+		})
+	}
+	return func() bool {
+		return token != "" && wiki.Sess.GetOrRenew(token) == sd
+	}
+}
@@ -0,0 +1,182 @@
+package tiddlywikid
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"tiddlywikid/store"
+	"tiddlywikid/utils"
+)
+
+// not exported: need the server to work
+var exportSkipTitles = map[string]bool{
+	GENERATED_PLUGIN:                  true,
+	"$:/plugins/tiddlywiki/tiddlyweb": true,
+}
+
+var exportSkipPrefix = []string{
+	"$:/config/tiddlyweb/",
+	"$:/config/TiddlyWebExternalAttachments/",
+	"$:/status/",
+	"$:/temp/",
+}
+
+type ExportOptions struct {
+	Inline bool // put attachments back into tiddlers, or keep `_canonical_uri`
+
+	Filter func(tiddler *store.TiddlyWebJSON) bool // stored tiddlers to export, nil for all
+}
+
+func skipExport(title string) bool {
+	if title == "" || exportSkipTitles[title] {
+		return true
+	}
+	for _, prefix := range exportSkipPrefix {
+		if strings.HasPrefix(title, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// write base wiki with all stored tiddlers as a single file wiki, without TiddlyWeb plugin
+func (wiki *Wiki) ExportHTML(w io.Writer, opt *ExportOptions) error {
+	if opt == nil {
+		opt = &ExportOptions{}
+	}
+	base, err := os.ReadFile(wiki.Base)
+	if err != nil {
+		return err
+	}
+	locs := reTiddlerStore.FindAllSubmatchIndex(base, -1)
+	if len(locs) == 0 {
+		return ErrNoTiddlers
+	}
+
+	// tiddlers from base wiki first, then override by stored
+	order := make([]string, 0, 256)
+	tiddlers := make(map[string]map[string]string)
+	add := func(fields map[string]string) {
+		title := fields["title"]
+		if skipExport(title) {
+			return
+		}
+		if _, ok := tiddlers[title]; !ok {
+			order = append(order, title)
+		}
+		tiddlers[title] = fields
+	}
+	for _, loc := range locs {
+		lst, err := store.ParseJSONTiddlers(base[loc[2]:loc[3]])
+		if err != nil {
+			return err
+		}
+		for _, fields := range lst {
+			add(fields)
+		}
+	}
+
+	stored := make([]*store.TiddlyWebJSON, 0, 256)
+	wiki.Store.Each(func(tiddler *store.TiddlyWebJSON, hash string) bool {
+		if opt.Filter == nil || opt.Filter(tiddler) {
+			stored = append(stored, tiddler)
+		}
+		return true
+	})
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].Title < stored[j].Title
+	})
+	for _, tiddler := range stored {
+		if opt.Inline {
+			wiki.inlineAttachment(tiddler)
+		}
+		add(tiddler.ToFields())
+	}
+
+	// same layout as TiddlyWiki
+	var b bytes.Buffer
+	b.WriteString("[\n")
+	for i, title := range order {
+		buf, err := json.Marshal(tiddlers[title])
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			b.WriteString(",\n")
+		}
+		b.Write(buf)
+	}
+	b.WriteString("\n]")
+
+	// replace first store, empty others
+	last := 0
+	for i, loc := range locs {
+		if _, err := w.Write(base[last:loc[2]]); err != nil {
+			return err
+		}
+		content := []byte("[]")
+		if i == 0 {
+			content = b.Bytes()
+		}
+		if _, err := w.Write(content); err != nil {
+			return err
+		}
+		last = loc[3]
+	}
+	_, err = w.Write(base[last:])
+	return err
+}
+
+// read attachment file back into `text`, and remove `_canonical_uri`
+func (wiki *Wiki) inlineAttachment(tiddler *store.TiddlyWebJSON) {
+	fp := wiki.attachmentFile(tiddler)
+	if fp == "" {
+		return
+	}
+	buf, err := os.ReadFile(filepath.Join(wiki.Files, fp))
+	if err != nil {
+		utils.Vln(3, "[export]read attachment err", tiddler.Title, err)
+		return
+	}
+	if store.IsTextType(tiddler.Type) {
+		tiddler.Text = string(buf)
+	} else {
+		tiddler.Text = base64.StdEncoding.EncodeToString(buf)
+	}
+	delete(*tiddler.Fields, "_canonical_uri")
+}
+
+// download single file wiki, query: `inline=1` for put attachments into tiddlers
+func (wiki *Wiki) exportWiki(w http.ResponseWriter, r *http.Request) {
+	isAnno, isLogin, _, sd := wiki.checkAuth(w, r)
+	if !isAnno && !isLogin { // no anno && not login
+		wiki.errNotLogin(w, r, sd)
+		return
+	}
+
+	opt := &ExportOptions{
+		Inline: r.URL.Query().Get("inline") == "1",
+		Filter: func(tiddler *store.TiddlyWebJSON) bool {
+			return wiki.canAccess(sd, tiddler.Title, tiddler, false)
+		},
+	}
+	var b bytes.Buffer
+	if err := wiki.ExportHTML(&b, opt); err != nil {
+		utils.Vln(3, "[export]err", clientIP(r), err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/html; charset=utf-8")
+	hdr.Set("Content-Disposition", `attachment; filename="wiki.html"`)
+	hdr.Set("Cache-Control", "no-store")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,91 @@
+package tiddlywikid
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tiddlywikid/auth"
+	"tiddlywikid/store"
+)
+
+const testBaseHTML = `<html><body>
+<script class="tiddlywiki-tiddler-store" type="application/json">[
+{"title":"$:/core","plugin-type":"plugin","text":"{}"},
+{"title":"$:/plugins/tiddlywiki/tiddlyweb","plugin-type":"plugin","text":"{}"},
+{"title":"$:/config/tiddlyweb/host","text":"$protocol$//$host$/"}
+]</script>
+<script class="tiddlywiki-tiddler-store" type="application/json">[{"title":"Base","text":"base"}]</script>
+<div id="storeArea" style="display:none;"></div>
+</body></html>`
+
+func writeTestBase(t *testing.T, wiki *Wiki, html string) {
+	if err := os.WriteFile(wiki.Base, []byte(html), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exportTitles(t *testing.T, buf []byte) map[string]map[string]string {
+	lst, err := ParseWikiHTML(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]map[string]string)
+	for _, fields := range lst {
+		out[fields["title"]] = fields
+	}
+	return out
+}
+
+func TestExportHTML(t *testing.T) {
+	token, hash, err := auth.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wiki := newTestWiki(t, fmt.Sprintf(`{
+	"allow-anonymous": { "def": false },
+	"users": [
+		{ "id": "alice", "hash": "" },
+		{ "id": "bob", "hash": "", "tokens": [{ "name": "bob", "hash": %q }] }
+	],
+	"tiddlers": [
+		{ "match": "[tag[private]]", "read": ["alice"] }
+	]
+}`, hash))
+	wiki.Base = filepath.Join(t.TempDir(), "index.html")
+	writeTestBase(t, wiki, testBaseHTML)
+
+	private := store.TiddlerTags{"private"}
+	wiki.Store.Put("Base", &store.TiddlyWebJSON{Title: "Base", Text: "stored"}, false, "")
+	wiki.Store.Put("Diary", &store.TiddlyWebJSON{Title: "Diary", Tags: &private}, false, "")
+	wiki.Store.Put("$:/config/TiddlyWebExternalAttachments/Enable", &store.TiddlyWebJSON{Title: "$:/config/TiddlyWebExternalAttachments/Enable", Text: "yes"}, false, "")
+
+	var b bytes.Buffer
+	if err := wiki.ExportHTML(&b, nil); err != nil {
+		t.Fatal(err)
+	}
+	lst := exportTitles(t, b.Bytes())
+	if len(lst) != 3 || lst["$:/core"] == nil || lst["Diary"] == nil || lst["Base"]["text"] != "stored" {
+		t.Fatal("stored tiddlers should override base, without TiddlyWeb plugin and config", lst)
+	}
+	if strings.Count(b.String(), `type="application/json">[]</script>`) != 1 {
+		t.Fatal("other tiddler store should be empty", b.String())
+	}
+
+	// only readable tiddlers by the endpoint
+	r := httptest.NewRequest(http.MethodGet, "/export/wiki.html", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	wiki.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal("export failed", w.Code, w.Body.String())
+	}
+	if lst := exportTitles(t, w.Body.Bytes()); len(lst) != 2 || lst["Diary"] != nil || lst["Base"]["text"] != "stored" {
+		t.Fatal("tiddlers can not read should not be exported", lst)
+	}
+}
@@ -3,12 +3,17 @@ module tiddlywikid
 go 1.18
 
 require (
-	git.mills.io/prologic/bitcask v1.0.2 // indirect
+	git.mills.io/prologic/bitcask v1.0.2
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/crypto v0.5.0
+)
+
+require (
 	github.com/abcum/lcp v0.0.0-20201209214815-7a3f3840be81 // indirect
 	github.com/gofrs/flock v0.8.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/plar/go-adaptive-radix-tree v1.0.4 // indirect
 	github.com/sirupsen/logrus v1.8.1 // indirect
 	golang.org/x/exp v0.0.0-20200228211341-fcea875c7e85 // indirect
-	golang.org/x/sys v0.0.0-20210510120138-977fb7262007 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 )
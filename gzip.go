@@ -2,21 +2,35 @@ package tiddlywikid
 
 import (
 	"compress/gzip"
-	"flag"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+)
+
+const (
+	DefaultGzipLevel = 2
 )
 
 var (
-	gzipLv = flag.Int("gz", 2, "gzip disable = 0, DefaultCompression = -1, BestSpeed = 1, BestCompression = 9")
+	gzipLv int32 = DefaultGzipLevel
 
-	gzWiterPool sync.Pool
+	gzWiterPool [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool // by level
 )
 
+// disable = 0, DefaultCompression = -1, BestSpeed = 1, BestCompression = 9, HuffmanOnly = -2
+// can be changed at runtime
+func SetGzipLevel(lv int) {
+	if lv < gzip.HuffmanOnly || lv > gzip.BestCompression {
+		lv = DefaultGzipLevel
+	}
+	atomic.StoreInt32(&gzipLv, int32(lv))
+}
+
 type GzipResponseWriter struct {
 	http.ResponseWriter
 	gzip *gzip.Writer
+	lv   int
 }
 
 func (w *GzipResponseWriter) Write(p []byte) (int, error) {
@@ -30,12 +44,22 @@ func (w *GzipResponseWriter) Write(p []byte) (int, error) {
 func (w *GzipResponseWriter) Close() error {
 	if w.gzip != nil {
 		err := w.gzip.Close()
-		gzWiterPool.Put(w.gzip)
+		gzWiterPool[w.lv-gzip.HuffmanOnly].Put(w.gzip)
 		return err
 	}
 	return nil
 }
 
+// for streaming response (Server-Sent Events)
+func (w *GzipResponseWriter) Flush() {
+	if w.gzip != nil {
+		w.gzip.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func CanAcceptsGzip(r *http.Request) bool {
 	s := strings.ToLower(r.Header.Get("Accept-Encoding"))
 	for _, ss := range strings.Split(s, ",") {
@@ -47,22 +71,23 @@ func CanAcceptsGzip(r *http.Request) bool {
 }
 
 func TryGzipResponse(w http.ResponseWriter, r *http.Request) *GzipResponseWriter {
-	if !CanAcceptsGzip(r) || *gzipLv == 0 {
+	lv := int(atomic.LoadInt32(&gzipLv))
+	if !CanAcceptsGzip(r) || lv == 0 {
 		return nil
 	}
 
-	gw, ok := gzWiterPool.Get().(*gzip.Writer)
+	gw, ok := gzWiterPool[lv-gzip.HuffmanOnly].Get().(*gzip.Writer)
 	if ok {
 		gw.Reset(w)
 	} else {
 		var err error
-		gw, err = gzip.NewWriterLevel(w, *gzipLv)
+		gw, err = gzip.NewWriterLevel(w, lv)
 		if err != nil {
-			gw = gzip.NewWriter(w)
+			return nil
 		}
 	}
 	w.Header().Set("Content-Encoding", "gzip")
 	w.Header().Del("Content-Length")
 
-	return &GzipResponseWriter{w, gw}
+	return &GzipResponseWriter{w, gw, lv}
 }
@@ -0,0 +1,266 @@
+package tiddlywikid
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"tiddlywikid/store"
+	"tiddlywikid/utils"
+)
+
+const (
+	DefaultImportExtractSize = 16 * 1024 // same as `$:/config/TiddlyWebExternalAttachments/SizeForExternal`
+)
+
+var (
+	ErrEncryptedWiki = errors.New("encrypted wiki is not supported")
+	ErrNoTiddlers    = errors.New("no tiddler store found")
+)
+
+// not imported: state of the old wiki, and tiddlers come with base wiki or server
+var importSkipTitles = map[string]bool{
+	STORYLIST_PATH:                    true,
+	HISTORYLIST_PATH:                  true,
+	GENERATED_PLUGIN:                  true,
+	"$:/isEncrypted":                  true,
+	"$:/core":                         true,
+	"$:/boot/boot.js":                 true,
+	"$:/boot/boot.css":                true,
+	"$:/boot/bootprefix.js":           true,
+	"$:/library/sjcl.js":              true,
+	"$:/plugins/tiddlywiki/tiddlyweb": true,
+}
+
+var importSkipPrefix = []string{
+	"$:/temp/",
+	"$:/state/",
+	"$:/status/",
+}
+
+type ImportOptions struct {
+	Overwrite   bool  // overwrite existing tiddlers, or skip them
+	Plugins     bool  // also import plugins, JavaScript in them will not run since plugins must be pre-baked into base wiki
+	ExtractSize int64 // save base64 binary tiddler larger than this as attachment, 0 for keep in tiddler
+}
+
+type ImportResult struct {
+	Imported  int      `json:"imported"`
+	Extracted int      `json:"extracted"` // saved as attachment
+	Skipped   []string `json:"skipped"`
+}
+
+var (
+	reTiddlerStore   = regexp.MustCompile(`(?s)<script\b[^>]*\bclass="tiddlywiki-tiddler-store"[^>]*>(.*?)</script>`)
+	reStoreArea      = regexp.MustCompile(`<div\s+id="storeArea"[^>]*>`)
+	reStoreAreaDiv   = regexp.MustCompile(`(?s)\A\s*<div\s([^>]*)>\s*<pre>(.*?)</pre>\s*</div>`)
+	reStoreAreaAttr  = regexp.MustCompile(`([^\s="]+)="([^"]*)"`)
+	reEncryptedStore = regexp.MustCompile(`<pre\s+id="encryptedStoreArea"`)
+)
+
+// parse tiddlers in `tiddlywiki-tiddler-store` script blocks (v5.2.0+) and legacy `storeArea` div
+func ParseWikiHTML(buf []byte) ([]map[string]string, error) {
+	if reEncryptedStore.Match(buf) {
+		return nil, ErrEncryptedWiki
+	}
+
+	found := false
+	out := make([]map[string]string, 0, 128)
+	for _, m := range reTiddlerStore.FindAllSubmatch(buf, -1) {
+		lst, err := store.ParseJSONTiddlers(m[1])
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		out = append(out, lst...)
+	}
+
+	if loc := reStoreArea.FindIndex(buf); loc != nil {
+		found = true
+		rest := buf[loc[1]:]
+		for {
+			m := reStoreAreaDiv.FindSubmatchIndex(rest)
+			if m == nil {
+				break
+			}
+			fields := make(map[string]string)
+			for _, attr := range reStoreAreaAttr.FindAllSubmatch(rest[m[2]:m[3]], -1) {
+				fields[string(attr[1])] = html.UnescapeString(string(attr[2]))
+			}
+			fields["text"] = html.UnescapeString(string(rest[m[4]:m[5]]))
+			if fields["title"] != "" {
+				out = append(out, fields)
+			}
+			rest = rest[m[1]:]
+		}
+	}
+
+	if !found {
+		return nil, ErrNoTiddlers
+	}
+	return out, nil
+}
+
+// put tiddlers from single file wiki into store
+func (wiki *Wiki) ImportHTML(buf []byte, opt *ImportOptions) (*ImportResult, error) {
+	if opt == nil {
+		opt = &ImportOptions{}
+	}
+	lst, err := ParseWikiHTML(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &ImportResult{
+		Skipped: make([]string, 0),
+	}
+	for _, fields := range lst {
+		title := fields["title"]
+		if skipImport(fields, opt) {
+			res.Skipped = append(res.Skipped, title)
+			continue
+		}
+		if !opt.Overwrite {
+			if td, _ := wiki.Store.Get(title); td != nil {
+				res.Skipped = append(res.Skipped, title)
+				continue
+			}
+		}
+
+		tiddler := store.NewTiddlerFromFields(fields)
+		attach, err := wiki.extractBinary(tiddler, opt.ExtractSize)
+		if err != nil {
+			return res, err
+		}
+		if attach == nil {
+			wiki.Store.Put(title, tiddler, hasMacroTag(tiddler), wiki.attachmentFile(tiddler))
+			res.Imported++
+			continue
+		}
+
+		// same as upload
+		wiki.Store.Put(title, tiddler, hasMacroTag(tiddler), "")
+		wiki.Store.AttachAttachment(title, attach.SaveName)
+		res.Imported++
+		res.Extracted++
+	}
+	return res, nil
+}
+
+func skipImport(fields map[string]string, opt *ImportOptions) bool {
+	title := fields["title"]
+	if title == "" || importSkipTitles[title] {
+		return true
+	}
+	if _, ok := autoGen[title]; ok {
+		return true
+	}
+	for _, prefix := range importSkipPrefix {
+		if strings.HasPrefix(title, prefix) {
+			return true
+		}
+	}
+	return !opt.Plugins && fields["plugin-type"] != ""
+}
+
+// save base64 binary text as attachment and set `_canonical_uri`, nil if not extracted
+func (wiki *Wiki) extractBinary(tiddler *store.TiddlyWebJSON, size int64) (*Attachment, error) {
+	if size <= 0 || store.IsTextType(tiddler.Type) || getCanonicalUri(tiddler.Fields) != "" {
+		return nil, nil
+	}
+	if int64(base64.StdEncoding.DecodedLen(len(tiddler.Text))) <= size {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(tiddler.Text)
+	if err != nil || int64(len(data)) <= size {
+		return nil, nil // not base64, keep it
+	}
+
+	attach := NewAttachment(tiddler.Title, int64(len(data)))
+	fd, err := os.OpenFile(filepath.Join(wiki.Files, attach.SaveName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	hash, err := cpAndHashFd(fd, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	attach.Checksum = hash
+
+	if tiddler.Fields == nil {
+		tiddler.Fields = &store.TiddlerFields{}
+	}
+	(*tiddler.Fields)["_canonical_uri"] = wiki.attachmentURI(attach.SaveName)
+	tiddler.Text = ""
+	return attach, nil
+}
+
+// `_canonical_uri` for attachment, same as `$:/config/TiddlyWebExternalAttachments/ExternalAttachmentsPath`
+func (wiki *Wiki) attachmentURI(saveName string) string {
+	return wiki.basePath() + "/files/" + saveName
+}
+
+// POST single file wiki as body or `file` of multipart form
+// query: `overwrite=1`, `plugins=1`, `extract=<size>`
+func (wiki *Wiki) importWiki(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("X-Requested-With") != "TiddlyWiki" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if !wiki.checkAdmin(w, r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, wiki.UploadFileSizeLimit)
+	var rd io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(wiki.ParseMemoryLimit); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		rd = file
+	}
+	buf, err := io.ReadAll(rd)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+	opt := &ImportOptions{
+		Overwrite: q.Get("overwrite") == "1",
+		Plugins:   q.Get("plugins") == "1",
+	}
+	if str := q.Get("extract"); str != "" {
+		opt.ExtractSize, _ = strconv.ParseInt(str, 10, 64)
+	}
+
+	res, err := wiki.ImportHTML(buf, opt)
+	if err != nil {
+		utils.Vln(3, "[import]err", clientIP(r), err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	utils.Vln(3, "[import]", clientIP(r), res.Imported, res.Extracted, len(res.Skipped))
+	JsonRes(w, res, false)
+}
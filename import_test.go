@@ -0,0 +1,106 @@
+package tiddlywikid
+
+import (
+	"encoding/base64"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseWikiHTML(t *testing.T) {
+	// v5.2.0+, one store per plugin and one for others
+	modern := `<html><body>
+<script class="tiddlywiki-tiddler-store" type="application/json">[{"title":"$:/core","plugin-type":"plugin","text":"{}"}]</script>
+<script class="tiddlywiki-tiddler-store" type="application/json">[
+{"title":"A","tags":"[[my tag]]","text":"\u003Cb>a\u003C/b>"},
+{"title":"B","text":"b"}
+]</script>
+<div id="storeArea" style="display:none;"></div>
+</body></html>`
+	lst, err := ParseWikiHTML([]byte(modern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lst) != 3 || lst[1]["title"] != "A" || lst[1]["text"] != "<b>a</b>" || lst[1]["tags"] != "[[my tag]]" || lst[2]["title"] != "B" {
+		t.Fatal("bad tiddlers from tiddler store", lst)
+	}
+
+	// before v5.2.0
+	legacy := `<html><body>
+<div id="storeArea" style="display:none;">
+<div created="20200101000000000" title="A &amp; B" tags="x">
+<pre>&lt;b&gt;a&lt;/b&gt;
+line 2</pre>
+</div>
+<div title="Empty" type="text/plain">
+<pre></pre>
+</div>
+</div>
+</body></html>`
+	lst, err = ParseWikiHTML([]byte(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lst) != 2 || lst[0]["title"] != "A & B" || lst[0]["text"] != "<b>a</b>\nline 2" || lst[0]["created"] != "20200101000000000" {
+		t.Fatal("bad tiddlers from storeArea", lst)
+	}
+	if lst[1]["title"] != "Empty" || lst[1]["text"] != "" || lst[1]["type"] != "text/plain" {
+		t.Fatal("bad empty tiddler from storeArea", lst[1])
+	}
+
+	if _, err := ParseWikiHTML([]byte(`<pre id="encryptedStoreArea" type="text/plain">{}</pre>`)); err != ErrEncryptedWiki {
+		t.Fatal("should be ErrEncryptedWiki, got", err)
+	}
+	if _, err := ParseWikiHTML([]byte(`<html></html>`)); err != ErrNoTiddlers {
+		t.Fatal("should be ErrNoTiddlers, got", err)
+	}
+}
+
+func TestImportExtractSize(t *testing.T) {
+	wiki := newTestWiki(t, `{}`)
+	big := strings.Repeat("png", 100)
+	html := `<script class="tiddlywiki-tiddler-store" type="application/json">[
+{"title":"Big","type":"image/png","text":"` + base64.StdEncoding.EncodeToString([]byte(big)) + `"},
+{"title":"Small","type":"image/png","text":"` + base64.StdEncoding.EncodeToString([]byte("png")) + `"},
+{"title":"Text","type":"text/plain","text":"` + big + `"},
+{"title":"$:/StoryList","list":"Big"}
+]</script>`
+
+	res, err := wiki.ImportHTML([]byte(html), &ImportOptions{ExtractSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Imported != 3 || res.Extracted != 1 || len(res.Skipped) != 1 {
+		t.Fatal("bad import result", res)
+	}
+
+	td, _ := wiki.Store.Get("Big")
+	uri := getCanonicalUri(td.Fields)
+	if td.Text != "" || !strings.HasPrefix(uri, "/files/") {
+		t.Fatal("large binary should be extracted with _canonical_uri", td.Text, uri)
+	}
+	buf, err := os.ReadFile(filepath.Join(wiki.Files, path.Base(uri)))
+	if err != nil || string(buf) != big {
+		t.Fatal("attachment should be decoded binary", string(buf), err)
+	}
+	if file := wiki.attachmentFile(td); file != path.Base(uri) {
+		t.Fatal("extracted file should be served as attachment", file, uri)
+	}
+
+	for _, title := range []string{"Small", "Text"} {
+		if td, _ := wiki.Store.Get(title); td == nil || td.Text == "" || getCanonicalUri(td.Fields) != "" {
+			t.Fatal("small binary and text should be kept in tiddler", td)
+		}
+	}
+
+	// existing one is skipped without overwrite
+	res, err = wiki.ImportHTML([]byte(html), &ImportOptions{ExtractSize: 100})
+	if err != nil || res.Imported != 0 || len(res.Skipped) != 4 {
+		t.Fatal("existing tiddlers should be skipped", res, err)
+	}
+	if entries, _ := os.ReadDir(wiki.Files); len(entries) != 1 {
+		t.Fatal("skipped one should not be extracted", len(entries))
+	}
+}
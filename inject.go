@@ -0,0 +1,105 @@
+package tiddlywikid
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"tiddlywikid/store"
+)
+
+// base html with plugins injected
+type baseCache struct {
+	key     string // mtime and size of base and plugin files
+	buf     []byte
+	modTime time.Time
+	etag    string
+}
+
+// base html with the external attachments plugin and `Plugins` injected, cached until files changed
+func (wiki *Wiki) baseHTML() (*baseCache, error) {
+	files := append([]string{wiki.Base}, wiki.Plugins...)
+	keys := make([]string, 0, len(files))
+	modTime := time.Time{}
+	for _, fp := range files {
+		info, err := os.Stat(fp)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()))
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	key := strings.Join(keys, "/")
+
+	if c, ok := wiki.baseCache.Load().(*baseCache); ok && c.key == key {
+		return c, nil
+	}
+
+	base, err := os.ReadFile(wiki.Base)
+	if err != nil {
+		return nil, err
+	}
+	inject := NewPluginBuf(wiki.basePath())
+	for _, fp := range wiki.Plugins {
+		buf, err := pluginFileBuf(fp)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %v: %w", fp, err)
+		}
+		inject = append(inject, buf...)
+	}
+
+	c := &baseCache{
+		key:     key,
+		buf:     injectStore(base, inject),
+		modTime: modTime,
+	}
+	h := sha256.Sum256(c.buf)
+	c.etag = `"` + base64.RawURLEncoding.EncodeToString(h[:12]) + `"`
+	wiki.baseCache.Store(c)
+	return c, nil
+}
+
+// put after the last tiddler store, so injected tiddlers override the ones in base
+// untouched if no tiddler store (before v5.2.0)
+func injectStore(base []byte, inject []byte) []byte {
+	locs := reTiddlerStore.FindAllIndex(base, -1)
+	if len(locs) == 0 {
+		return base
+	}
+	pos := locs[len(locs)-1][1]
+	out := make([]byte, 0, len(base)+len(inject)+1)
+	out = append(out, base[:pos]...)
+	out = append(out, '\n')
+	out = append(out, inject...)
+	out = append(out, base[pos:]...)
+	return out
+}
+
+// tiddler store block for plugin file (JSON array of tiddlers or single tiddler, as exported by TiddlyWiki)
+func pluginFileBuf(fp string) ([]byte, error) {
+	buf, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	lst, err := store.ParseJSONTiddlers(buf)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = json.Marshal(lst) // `<` will be escaped
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`<script class="tiddlywiki-tiddler-store" type="application/json">`)
+	b.Write(buf)
+	b.WriteString(`</script>`)
+	return b.Bytes(), nil
+}
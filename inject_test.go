@@ -0,0 +1,62 @@
+package tiddlywikid
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tiddlywikid/store"
+)
+
+func TestInjectStore(t *testing.T) {
+	inject := []byte(`<script class="tiddlywiki-tiddler-store" type="application/json">[{"title":"P"}]</script>`)
+	out := string(injectStore([]byte(testBaseHTML), inject))
+	last := strings.Index(out, `[{"title":"Base","text":"base"}]</script>`)
+	pos := strings.Index(out, string(inject))
+	if last < 0 || pos < last || pos > strings.Index(out, `<div id="storeArea"`) {
+		t.Fatal("should be injected after the last tiddler store", out)
+	}
+
+	legacy := `<div id="storeArea"></div>`
+	if out := injectStore([]byte(legacy), inject); string(out) != legacy {
+		t.Fatal("should not inject without tiddler store", string(out))
+	}
+}
+
+func TestBaseHTMLCache(t *testing.T) {
+	wiki := NewWiki(nil, store.NewMemStore(), nil)
+	wiki.SetupMux(nil)
+	wiki.Base = filepath.Join(t.TempDir(), "index.html")
+	writeTestBase(t, wiki, testBaseHTML)
+
+	c, err := wiki.baseHTML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lst := exportTitles(t, c.buf); lst[GENERATED_PLUGIN] == nil || lst["Base"] == nil {
+		t.Fatal("plugin should be injected", string(c.buf))
+	}
+	if c2, _ := wiki.baseHTML(); c2 != c {
+		t.Fatal("should be cached if base not changed")
+	}
+
+	// same size, only mtime changed
+	edited := strings.Replace(testBaseHTML, `"text":"base"`, `"text":"edit"`, 1)
+	writeTestBase(t, wiki, edited)
+	mtime := time.Now().Add(time.Minute)
+	os.Chtimes(wiki.Base, mtime, mtime)
+	c2, err := wiki.baseHTML()
+	if err != nil || c2 == c || c2.etag == c.etag || exportTitles(t, c2.buf)["Base"]["text"] != "edit" {
+		t.Fatal("should be rebuilt after mtime changed", err)
+	}
+
+	// same mtime, only size changed
+	writeTestBase(t, wiki, edited+"\n")
+	os.Chtimes(wiki.Base, mtime, mtime)
+	c3, err := wiki.baseHTML()
+	if err != nil || c3 == c2 || !strings.HasSuffix(string(c3.buf), "\n") {
+		t.Fatal("should be rebuilt after size changed", err)
+	}
+}
@@ -33,6 +33,11 @@ func (mux *Mux) NewSubMux(pattern string) *Mux {
 	}
 }
 
+// path prefix, empty for root
+func (mux *Mux) Base() string {
+	return mux.base
+}
+
 func (mux *Mux) Handle(pattern string, handler http.Handler) {
 	mux.mu.Handle(mux.base+pattern, handler)
 }
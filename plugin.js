@@ -21,6 +21,11 @@ Startup initialisation
 	const ONLY_BINARY_TITLE = '$:/config/TiddlyWebExternalAttachments/OnlyBinary';
 	const SIZE_TITLE = '$:/config/TiddlyWebExternalAttachments/SizeForExternal';
 	const DEBUG_TITLE = '$:/config/TiddlyWebExternalAttachments/Debug';
+	const LIVE_SYNC_TITLE = '$:/config/TiddlyWebExternalAttachments/LiveSync';
+	const INCREMENTAL_LIST_TITLE = '$:/config/TiddlyWebExternalAttachments/IncrementalList';
+
+	const CHANGE_SEQ_HEADER = 'X-Change-Seq';
+	const CHANGE_FULL_HEADER = 'X-Change-Full';
 
 
 	const WIKITEXT_TYPE = 'text/vnd.tiddlywiki';
@@ -122,6 +127,87 @@ Startup initialisation
 			return doUpload(tiddler.fields, file);
 		});
 
+		// sync from server when tiddlers changed by other user/window
+		const liveSync = () => {
+			if ($tw.wiki.getTiddlerText(LIVE_SYNC_TITLE, "yes") !== "yes") return;
+			if (!$tw.syncer || !$tw.syncadaptor || typeof EventSource === 'undefined') return;
+
+			// recipe is ready after status loaded
+			const recipe = $tw.syncadaptor.recipe;
+			if (!recipe) {
+				setTimeout(liveSync, 1000);
+				return;
+			}
+
+			let timer = null;
+			const onChange = (e) => {
+				log("[events]", e.type, e.data);
+				try {
+					const { title, revision } = JSON.parse(e.data);
+					const info = $tw.syncer.tiddlerInfo[title];
+					if (e.type === 'put' && info && info.revision === revision) return; // already synced, eg: saved by self
+				} catch (err) {
+					log("[events]err", err);
+				}
+				if (timer !== null) return;
+				timer = setTimeout(() => {
+					timer = null;
+					$tw.syncer.syncFromServer();
+				}, 500);
+			};
+			const es = new EventSource(`${getHost()}recipes/${encodeURIComponent(recipe)}/events`, { withCredentials: true });
+			es.addEventListener('put', onChange);
+			es.addEventListener('del', onChange);
+		};
+		liveSync();
+
+		// only fetch changes by `tiddlers.json?since=<seq>`, and merge into cached list
+		const incrementalList = () => {
+			if ($tw.wiki.getTiddlerText(INCREMENTAL_LIST_TITLE, "yes") !== "yes") return;
+			const adaptor = $tw.syncadaptor;
+			if (!adaptor || !adaptor.getSkinnyTiddlers || !adaptor.convertTiddlerFromTiddlyWebFormat) return;
+
+			const cache = new Map();
+			let seq = null;
+			adaptor.getSkinnyTiddlers = function (callback) {
+				const self = this;
+				const since = seq;
+				let url = `${self.host}recipes/${encodeURIComponent(self.recipe)}/tiddlers.json`;
+				if (since !== null) url += `?since=${since}`;
+				$tw.utils.httpRequest({
+					url: url,
+					callback: (err, data, xhr) => {
+						if (err) return callback(err);
+
+						const newSeq = Number.parseInt(xhr.getResponseHeader(CHANGE_SEQ_HEADER));
+						const full = since === null || Number.isNaN(newSeq) || newSeq < since // server may not support or reset
+							|| xhr.getResponseHeader(CHANGE_FULL_HEADER) === "1"; // deleted tiddlers since `since` are dropped
+						if (full) cache.clear();
+						seq = Number.isNaN(newSeq) ? null : newSeq;
+
+						const tiddlers = JSON.parse(data);
+						log("[list]", since, newSeq, full, tiddlers.length);
+						for (const td of tiddlers) {
+							if (td._is_deleted) {
+								cache.delete(td.title);
+								continue;
+							}
+							cache.set(td.title, self.convertTiddlerFromTiddlyWebFormat(td));
+						}
+						callback(null, Array.from(cache.values()));
+
+						// only need title and revision next time
+						for (const [title, fields] of cache) {
+							if (fields.text === undefined) continue;
+							const { text, ...skinny } = fields;
+							cache.set(title, skinny);
+						}
+					}
+				});
+			};
+		};
+		incrementalList();
+
 		const doUpload = (tiddlerFields, file) => {
 			const {
 				title,
@@ -0,0 +1,73 @@
+package tiddlywikid
+
+import (
+	"net/http"
+	"strconv"
+
+	"tiddlywikid/session"
+	"tiddlywikid/store"
+)
+
+// titles tagged with `tag`, sorted by title, by index of store if any
+// resp: `["title", ...]`
+func (wiki *Wiki) taggedTiddlers(w http.ResponseWriter, r *http.Request) {
+	isAnno, isLogin, _, sd := wiki.checkAuth(w, r)
+	if !isAnno && !isLogin { // no anno && not login
+		JsonRes(w, []string{}, false)
+		return
+	}
+
+	// update CSRF
+	wiki.updateCSRF(w, r, sd)
+
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	JsonRes(w, wiki.filterTitles(store.Tagged(wiki.Store, tag), sd, 0), false)
+}
+
+// titles sorted by `modified` field, newest first, `limit` 0 for all
+// resp: `["title", ...]`
+func (wiki *Wiki) recentTiddlers(w http.ResponseWriter, r *http.Request) {
+	isAnno, isLogin, _, sd := wiki.checkAuth(w, r)
+	if !isAnno && !isLogin { // no anno && not login
+		JsonRes(w, []string{}, false)
+		return
+	}
+
+	// update CSRF
+	wiki.updateCSRF(w, r, sd)
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 0 {
+		limit = 0
+	}
+
+	// filter before limit, same as search
+	if wiki.tiddlerCheck(sd) != nil {
+		JsonRes(w, wiki.filterTitles(store.Recent(wiki.Store, 0), sd, limit), false)
+		return
+	}
+	JsonRes(w, store.Recent(wiki.Store, limit), false)
+}
+
+// titles can read, at most limit (0 for no limit)
+func (wiki *Wiki) filterTitles(lst []string, sd *session.SessionData, limit int) []string {
+	check := wiki.tiddlerCheck(sd)
+	out := make([]string, 0, len(lst))
+	for _, title := range lst {
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+		if check != nil {
+			td, _ := wiki.Store.Get(title)
+			if td == nil || !check(title, tiddlerTags(td), false) {
+				continue
+			}
+		}
+		out = append(out, title)
+	}
+	return out
+}
@@ -0,0 +1,169 @@
+package tiddlywikid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"tiddlywikid/store"
+	"tiddlywikid/utils"
+)
+
+// split `<title>/revisions` and `<title>/revisions/<rev>` by escaped path
+// title with '/' should be escaped as "%2F" by client
+func splitRevisionPath(r *http.Request) (key string, rev string, ok bool) {
+	p := r.URL.EscapedPath()
+	idx := strings.LastIndex(p, "/revisions")
+	if idx <= 0 {
+		return "", "", false
+	}
+	tail := p[idx+len("/revisions"):]
+	if tail != "" {
+		if tail[0] != '/' {
+			return "", "", false
+		}
+		rev = tail[1:]
+		if strings.Contains(rev, "/") {
+			return "", "", false
+		}
+	}
+	key, err := url.PathUnescape(p[:idx])
+	if err != nil {
+		return "", "", false
+	}
+	return key, rev, true
+}
+
+func (wiki *Wiki) revisions(w http.ResponseWriter, r *http.Request, key string, revStr string) {
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Add("Allow", "GET, POST, OPTIONS")
+		return
+	case http.MethodGet:
+		if revStr == "" {
+			wiki.listRevisions(w, r, key)
+			return
+		}
+		wiki.getRevision(w, r, key, revStr)
+	case http.MethodPost:
+		if revStr == "" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		wiki.restoreRevision(w, r, key, revStr)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+// resp: skinny tiddlers of all kept revisions, newest first
+func (wiki *Wiki) listRevisions(w http.ResponseWriter, r *http.Request, key string) {
+	isAnno, isLogin, _, sd := wiki.checkAuth(w, r)
+	if !isAnno && !isLogin { // no anno && not login
+		wiki.errNotLogin(w, r, sd)
+		return
+	}
+
+	// update CSRF
+	wiki.updateCSRF(w, r, sd)
+
+	if !wiki.canAccessTitle(sd, key, false) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	// each revision by its own tags, current one may be deleted
+	lst := make([]*store.TiddlyWebJSON, 0)
+	for _, td := range wiki.Store.Revisions(key) {
+		if wiki.canAccess(sd, key, td, false) {
+			wiki.fillDefault(td)
+			lst = append(lst, td)
+		}
+	}
+	if len(lst) == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	JsonRes(w, lst, false)
+}
+
+func (wiki *Wiki) getRevision(w http.ResponseWriter, r *http.Request, key string, revStr string) {
+	rev, err := strconv.ParseUint(revStr, 10, 64)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	isAnno, isLogin, _, sd := wiki.checkAuth(w, r)
+	if !isAnno && !isLogin { // no anno && not login
+		wiki.errNotLogin(w, r, sd)
+		return
+	}
+
+	// update CSRF
+	wiki.updateCSRF(w, r, sd)
+
+	td, hash := wiki.Store.GetRevision(key, rev)
+	if td == nil || !wiki.canAccessTitle(sd, key, false) || !wiki.canAccess(sd, key, td, false) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	wiki.fillDefault(td)
+
+	// old revision never change
+	etag := fmt.Sprintf(`"%v/%v/%v:%v"`, wiki.Recipe, "", td.Rev, hash) // recipe, title, revision, hash/checksum
+	h := w.Header()
+	h.Set("Cache-Control", "max-age=0, must-revalidate")
+	h.Set("Content-Type", "application/json")
+	h.Set("Etag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		writeNotModified(w)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	err = enc.Encode(td)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		utils.Vln(4, "[revision]err", key, rev, err)
+		return
+	}
+}
+
+// save an old revision as the newest revision
+func (wiki *Wiki) restoreRevision(w http.ResponseWriter, r *http.Request, key string, revStr string) {
+	rev, err := strconv.ParseUint(revStr, 10, 64)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	isAnno, isLogin, _, sd := wiki.checkAuthEdit(w, r)
+	if !isAnno && !isLogin { // no anno && not login
+		wiki.errNotLogin(w, r, sd)
+		return
+	}
+
+	// update CSRF
+	wiki.updateCSRF(w, r, sd)
+
+	td, _ := wiki.Store.GetRevision(key, rev)
+	if td == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if !wiki.canAccessTitle(sd, key, true) || !wiki.canAccess(sd, key, td, true) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	td.Revision = ""
+
+	utils.Vln(3, "[restore]", key, rev)
+	newRev, hash := wiki.Store.Put(key, td, hasMacroTag(td), wiki.attachmentFile(td))
+	etag := fmt.Sprintf(`"%v/%v/%v:%v"`, wiki.Recipe, "", newRev, hash) // recipe, title, revision, hash/checksum
+	w.Header().Set("Etag", etag)
+	w.WriteHeader(http.StatusNoContent)
+}
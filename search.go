@@ -0,0 +1,47 @@
+package tiddlywikid
+
+import (
+	"net/http"
+	"strconv"
+
+	"tiddlywikid/search"
+	"tiddlywikid/utils"
+)
+
+// full-text search
+// resp: `[{"title":"","score":1.23,"snippet":"..."}]`
+func (wiki *Wiki) searchTiddlers(w http.ResponseWriter, r *http.Request) {
+	isAnno, isLogin, _, sd := wiki.checkAuth(w, r)
+	if !isAnno && !isLogin { // no anno && not login
+		JsonRes(w, []*search.Result{}, false)
+		return
+	}
+	if wiki.Search == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	// update CSRF
+	wiki.updateCSRF(w, r, sd)
+
+	query := r.URL.Query()
+	q := query.Get("q")
+	limit, _ := strconv.Atoi(query.Get("limit"))
+
+	// filter before limit, or a page may be short with readable matches left
+	var allow func(title string) bool
+	if check := wiki.tiddlerCheck(sd); check != nil {
+		allow = func(title string) bool {
+			td, _ := wiki.Store.Get(title)
+			return td != nil && check(title, tiddlerTags(td), false)
+		}
+	}
+	res := wiki.Search.Search(q, limit, allow)
+	for _, item := range res {
+		if td, _ := wiki.Store.Get(item.Title); td != nil {
+			item.Snippet = search.Snippet(td, q)
+		}
+	}
+	utils.Vln(4, "[search]", q, len(res))
+	JsonRes(w, res, false)
+}
@@ -0,0 +1,314 @@
+package search
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"tiddlywikid/store"
+)
+
+const (
+	// max text size for indexing
+	MaxTextSize = 1024 * 1024 // 1MB
+
+	DefaultLimit  = 20
+	SnippetRadius = 60 // runes before and after matched term
+)
+
+// weight for each part of tiddler
+var (
+	WeightTitle = float32(4)
+	WeightTags  = float32(3)
+	WeightField = float32(2)
+	WeightText  = float32(1)
+)
+
+type Result struct {
+	Title   string  `json:"title"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet,omitempty"`
+}
+
+type doc struct {
+	title string
+	terms map[string]float32 // term -> weighted frequency
+}
+
+// simple in memory inverted index
+type Index struct {
+	mx    sync.RWMutex
+	docs  map[string]*doc               // title -> doc
+	terms map[string]map[string]float32 // term -> title -> weighted frequency
+}
+
+func (idx *Index) Len() int {
+	idx.mx.RLock()
+	defer idx.mx.RUnlock()
+	return len(idx.docs)
+}
+
+func (idx *Index) Put(tiddler *store.TiddlyWebJSON) {
+	d := &doc{
+		title: tiddler.Title,
+		terms: make(map[string]float32),
+	}
+	addTerms(d.terms, tiddler.Title, WeightTitle)
+	if tiddler.Tags != nil {
+		for _, tag := range *tiddler.Tags {
+			addTerms(d.terms, tag, WeightTags)
+		}
+	}
+	hasFile := false
+	if tiddler.Fields != nil {
+		for k, v := range *tiddler.Fields {
+			if k == "_canonical_uri" {
+				hasFile = true
+				continue
+			}
+			addTerms(d.terms, fmt.Sprint(v), WeightField)
+		}
+	}
+	if !hasFile && store.IsTextType(tiddler.Type) {
+		text := tiddler.Text
+		if len(text) > MaxTextSize {
+			text = text[:MaxTextSize]
+		}
+		addTerms(d.terms, text, WeightText)
+	}
+
+	idx.mx.Lock()
+	defer idx.mx.Unlock()
+	idx.del(tiddler.Title)
+	idx.docs[d.title] = d
+	for term, w := range d.terms {
+		lst, ok := idx.terms[term]
+		if !ok {
+			lst = make(map[string]float32)
+			idx.terms[term] = lst
+		}
+		lst[d.title] = w
+	}
+}
+
+func (idx *Index) Del(title string) {
+	idx.mx.Lock()
+	defer idx.mx.Unlock()
+	idx.del(title)
+}
+
+// should hold write lock
+func (idx *Index) del(title string) {
+	d, ok := idx.docs[title]
+	if !ok {
+		return
+	}
+	delete(idx.docs, title)
+	for term := range d.terms {
+		lst := idx.terms[term]
+		delete(lst, title)
+		if len(lst) == 0 {
+			delete(idx.terms, term)
+		}
+	}
+}
+
+// all terms should be matched, ranked by tf-idf
+// call `allow` for each matched title, nil for allow all
+func (idx *Index) Search(q string, limit int, allow func(title string) bool) []*Result {
+	terms := Tokenize(q)
+	if len(terms) == 0 {
+		return []*Result{}
+	}
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	lowerQ := strings.ToLower(strings.TrimSpace(q))
+
+	idx.mx.RLock()
+	// start from the rarest term
+	sort.Slice(terms, func(i, j int) bool {
+		return len(idx.terms[terms[i]]) < len(idx.terms[terms[j]])
+	})
+	n := float64(len(idx.docs))
+	scores := make(map[string]float64)
+	for i, term := range terms {
+		lst := idx.terms[term]
+		if len(lst) == 0 {
+			scores = nil
+			break
+		}
+		idf := math.Log(1 + n/float64(len(lst)))
+		if i == 0 {
+			for title, w := range lst {
+				scores[title] = float64(w) * idf
+			}
+			continue
+		}
+		for title := range scores {
+			w, ok := lst[title]
+			if !ok {
+				delete(scores, title)
+				continue
+			}
+			scores[title] += float64(w) * idf
+		}
+	}
+	idx.mx.RUnlock()
+
+	out := make([]*Result, 0, len(scores))
+	for title, score := range scores {
+		if allow != nil && !allow(title) {
+			continue
+		}
+		// boost for title contains whole query
+		if strings.Contains(strings.ToLower(title), lowerQ) {
+			score *= 2
+		}
+		out = append(out, &Result{
+			Title: title,
+			Score: score,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		return out[i].Title < out[j].Title
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// build from all tiddlers in store
+func (idx *Index) Build(s store.Store) {
+	s.Each(func(tiddler *store.TiddlyWebJSON, hash string) bool {
+		idx.Put(tiddler)
+		return true
+	})
+}
+
+// keep index updated
+func (idx *Index) Watch(w store.Watcher, s store.Store) (cancel func()) {
+	return w.Watch(func(ev *store.ChangeEvent) {
+		switch ev.Op {
+		case store.EventPut:
+			tiddler, _ := s.Get(ev.Title)
+			if tiddler == nil {
+				return
+			}
+			idx.Put(tiddler)
+		case store.EventDel:
+			idx.Del(ev.Title)
+		}
+	})
+}
+
+func NewIndex() *Index {
+	return &Index{
+		docs:  make(map[string]*doc),
+		terms: make(map[string]map[string]float32),
+	}
+}
+
+// lower case words, each CJK character as a term
+func Tokenize(str string) []string {
+	terms := make([]string, 0, 8)
+	seen := make(map[string]struct{})
+	eachTerm(str, func(term string) {
+		if _, ok := seen[term]; ok {
+			return
+		}
+		seen[term] = struct{}{}
+		terms = append(terms, term)
+	})
+	return terms
+}
+
+func addTerms(terms map[string]float32, str string, weight float32) {
+	eachTerm(str, func(term string) {
+		terms[term] += weight
+	})
+}
+
+func eachTerm(str string, fn func(term string)) {
+	start := -1
+	for i, r := range str {
+		switch {
+		case isCJK(r):
+			if start >= 0 {
+				fn(strings.ToLower(str[start:i]))
+				start = -1
+			}
+			fn(string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if start < 0 {
+				start = i
+			}
+		default:
+			if start >= 0 {
+				fn(strings.ToLower(str[start:i]))
+				start = -1
+			}
+		}
+	}
+	if start >= 0 {
+		fn(strings.ToLower(str[start:]))
+	}
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// cut text around first matched term, empty for non-text tiddler
+func Snippet(tiddler *store.TiddlyWebJSON, q string) string {
+	if !store.IsTextType(tiddler.Type) {
+		return ""
+	}
+	text := tiddler.Text
+	if len(text) > MaxTextSize {
+		text = text[:MaxTextSize]
+	}
+	lowerText := strings.ToLower(text)
+	pos := -1
+	for _, term := range Tokenize(q) {
+		i := strings.Index(lowerText, term)
+		if i >= 0 && (pos < 0 || i < pos) {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	// lower case may change byte length, only use it when same
+	if len(lowerText) != len(text) {
+		pos = 0
+	}
+
+	start := pos
+	for n := 0; n < SnippetRadius && start > 0; n++ {
+		_, sz := utf8.DecodeLastRuneInString(text[:start])
+		start -= sz
+	}
+	end := pos
+	for n := 0; n < SnippetRadius*2 && end < len(text); n++ {
+		_, sz := utf8.DecodeRuneInString(text[end:])
+		end += sz
+	}
+
+	out := strings.Join(strings.Fields(text[start:end]), " ")
+	if start > 0 {
+		out = "..." + out
+	}
+	if end < len(text) {
+		out = out + "..."
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package search
+
+import (
+	"testing"
+
+	"tiddlywikid/store"
+)
+
+func TestTokenize(t *testing.T) {
+	var testCase = []struct {
+		In  string
+		Out []string
+	}{
+		{"Hello, World!", []string{"hello", "world"}},
+		{"$:/config/Foo-Bar", []string{"config", "foo", "bar"}},
+		{"go go GO", []string{"go"}},
+		{"中文abc", []string{"中", "文", "abc"}},
+		{"  ", []string{}},
+	}
+
+	for _, test := range testCase {
+		out := Tokenize(test.In)
+		if len(out) != len(test.Out) {
+			t.Fatal("Tokenize", test.In, "should be", test.Out, "got", out)
+		}
+		for i := range out {
+			if out[i] != test.Out[i] {
+				t.Fatal("Tokenize", test.In, "should be", test.Out, "got", out)
+			}
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	idx := NewIndex()
+	tags := store.TiddlerTags{"recipe"}
+	idx.Put(&store.TiddlyWebJSON{Title: "Apple Pie", Text: "bake the apple with sugar", Tags: &tags})
+	idx.Put(&store.TiddlyWebJSON{Title: "Banana", Text: "an apple a day"})
+	idx.Put(&store.TiddlyWebJSON{Title: "Image", Type: "image/png", Text: "YXBwbGU="})
+	fields := store.TiddlerFields{"color": "red apple"}
+	idx.Put(&store.TiddlyWebJSON{Title: "Cherry", Fields: &fields})
+
+	// ranked
+	res := idx.Search("apple", 0, nil)
+	if len(res) != 3 {
+		t.Fatal("should match 3 tiddlers", res)
+	}
+	if res[0].Title != "Apple Pie" || res[1].Title != "Cherry" || res[2].Title != "Banana" {
+		t.Fatal("wrong rank", res[0], res[1], res[2])
+	}
+
+	// all terms should match
+	res = idx.Search("apple sugar", 0, nil)
+	if len(res) != 1 || res[0].Title != "Apple Pie" {
+		t.Fatal("should only match `Apple Pie`", res)
+	}
+	res = idx.Search("recipe", 0, nil)
+	if len(res) != 1 || res[0].Title != "Apple Pie" {
+		t.Fatal("should match by tag", res)
+	}
+
+	// filter & limit
+	res = idx.Search("apple", 1, func(title string) bool {
+		return title != "Apple Pie"
+	})
+	if len(res) != 1 || res[0].Title != "Cherry" {
+		t.Fatal("should filter and limit", res)
+	}
+
+	// update & delete
+	idx.Put(&store.TiddlyWebJSON{Title: "Banana", Text: "yellow"})
+	idx.Del("Cherry")
+	res = idx.Search("apple", 0, nil)
+	if len(res) != 1 {
+		t.Fatal("should only match 1 tiddler", res)
+	}
+	if idx.Len() != 3 {
+		t.Fatal("index should have 3 tiddlers", idx.Len())
+	}
+	if len(idx.Search("nothing", 0, nil)) != 0 {
+		t.Fatal("should not match")
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	text := "The quick brown fox jumps over the lazy dog. " +
+		"Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua."
+	out := Snippet(&store.TiddlyWebJSON{Text: text}, "magna")
+	if out == "" || out[:3] != "..." {
+		t.Fatal("snippet should be cut", out)
+	}
+
+	out = Snippet(&store.TiddlyWebJSON{Text: "short\ntext"}, "text")
+	if out != "short text" {
+		t.Fatal("snippet should not be cut", out)
+	}
+
+	out = Snippet(&store.TiddlyWebJSON{Type: "image/png", Text: "abc"}, "abc")
+	if out != "" {
+		t.Fatal("no snippet for binary", out)
+	}
+}
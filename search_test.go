@@ -0,0 +1,55 @@
+package tiddlywikid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tiddlywikid/auth"
+	"tiddlywikid/search"
+	"tiddlywikid/store"
+)
+
+func TestSearchLimitAfterACL(t *testing.T) {
+	token, hash, err := auth.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wiki := newTestWiki(t, fmt.Sprintf(`{
+	"allow-anonymous": { "def": false },
+	"allow-anonymous-edit": { "def": false },
+	"users": [
+		{ "id": "alice", "hash": "" },
+		{ "id": "bob", "hash": "", "tokens": [{ "name": "bob", "hash": %q }] }
+	],
+	"tiddlers": [
+		{ "match": "[tag[private]]", "read": ["alice"] }
+	]
+}`, hash))
+	wiki.Search = search.NewIndex()
+
+	private := store.TiddlerTags{"private"}
+	for _, td := range []*store.TiddlyWebJSON{
+		{Title: "apple pie", Text: "apple", Tags: &private},
+		{Title: "apple tart", Text: "apple", Tags: &private},
+		{Title: "Note", Text: "apple"},
+	} {
+		wiki.Search.Put(td)
+		wiki.Store.Put(td.Title, td, false, "")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/recipes/default/search?q=apple&limit=1", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	wiki.ServeHTTP(w, r)
+
+	var res []*search.Result
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	if len(res) != 1 || res[0].Title != "Note" {
+		t.Fatal("should only get Note", w.Body.String())
+	}
+}
@@ -1,6 +1,7 @@
 package session
 
 import (
+	"encoding/json"
 	"sync"
 	"time"
 
@@ -8,7 +9,8 @@ import (
 )
 
 var (
-	SESSION_TTL = 15 * 60 * time.Second // 15 min
+	SESSION_TTL     = 15 * 60 * time.Second // 15 min, idle timeout
+	SESSION_MAX_AGE = time.Duration(0)      // absolute lifetime from created, 0 for no limit
 )
 
 type SessionStore interface {
@@ -16,6 +18,8 @@ type SessionStore interface {
 	Destroy(token string)
 	New(token string) *SessionData
 	NewToken() (string, *SessionData)
+	Take(token string) *SessionData // get and destroy, without renew
+	Range(fn func(token string, sd *SessionData) bool)
 	Close()
 }
 
@@ -27,20 +31,55 @@ type SessionData2 interface {
 }
 
 type SessionData struct {
-	mx  sync.RWMutex
-	ttl time.Time
-	lst map[interface{}]interface{}
+	mx       sync.RWMutex
+	ttl      time.Time
+	created  time.Time
+	seen     time.Time // last renew
+	deadline time.Time // zero for no limit
+	lst      map[interface{}]interface{}
 }
 
 func (sd *SessionData) IsTimeout() bool {
 	sd.mx.RLock()
 	defer sd.mx.RUnlock()
-	return utils.Now().After(sd.ttl)
+	now := utils.Now()
+	if !sd.deadline.IsZero() && now.After(sd.deadline) {
+		return true
+	}
+	return now.After(sd.ttl)
+}
+
+func (sd *SessionData) Created() time.Time {
+	sd.mx.RLock()
+	defer sd.mx.RUnlock()
+	return sd.created
+}
+
+func (sd *SessionData) LastSeen() time.Time {
+	sd.mx.RLock()
+	defer sd.mx.RUnlock()
+	return sd.seen
+}
+
+func (sd *SessionData) Deadline() time.Time {
+	sd.mx.RLock()
+	defer sd.mx.RUnlock()
+	return sd.deadline
+}
+
+// fixed lifetime, not extended by Renew()
+func (sd *SessionData) SetDeadline(t time.Time) {
+	sd.mx.Lock()
+	sd.ttl = t
+	sd.deadline = t
+	sd.mx.Unlock()
 }
 
 func (sd *SessionData) Renew() {
+	now := utils.Now()
 	sd.mx.Lock()
-	sd.ttl = utils.Now().Add(SESSION_TTL)
+	sd.ttl = now.Add(SESSION_TTL)
+	sd.seen = now
 	sd.mx.Unlock()
 }
 
@@ -57,10 +96,67 @@ func (sd *SessionData) Set(k interface{}, v interface{}) {
 	sd.mx.Unlock()
 }
 
+// for persistent session, only string keys are kept
+// values should be json types, numbers will be float64 after loaded
+type dumpSessionData struct {
+	TTL      int64                  `json:"ttl"` // unix nano
+	Created  int64                  `json:"created"`
+	Seen     int64                  `json:"seen"`
+	Deadline int64                  `json:"deadline,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+func (sd *SessionData) MarshalJSON() ([]byte, error) {
+	sd.mx.RLock()
+	defer sd.mx.RUnlock()
+	dump := &dumpSessionData{
+		TTL:     sd.ttl.UnixNano(),
+		Created: sd.created.UnixNano(),
+		Seen:    sd.seen.UnixNano(),
+		Data:    make(map[string]interface{}, len(sd.lst)),
+	}
+	if !sd.deadline.IsZero() {
+		dump.Deadline = sd.deadline.UnixNano()
+	}
+	for k, v := range sd.lst {
+		if key, ok := k.(string); ok {
+			dump.Data[key] = v
+		}
+	}
+	return json.Marshal(dump)
+}
+
+func (sd *SessionData) UnmarshalJSON(buf []byte) error {
+	dump := &dumpSessionData{}
+	if err := json.Unmarshal(buf, dump); err != nil {
+		return err
+	}
+	sd.mx.Lock()
+	defer sd.mx.Unlock()
+	sd.ttl = time.Unix(0, dump.TTL)
+	sd.created = time.Unix(0, dump.Created)
+	sd.seen = time.Unix(0, dump.Seen)
+	sd.deadline = time.Time{}
+	if dump.Deadline != 0 {
+		sd.deadline = time.Unix(0, dump.Deadline)
+	}
+	sd.lst = make(map[interface{}]interface{}, len(dump.Data))
+	for k, v := range dump.Data {
+		sd.lst[k] = v
+	}
+	return nil
+}
+
 func NewSessionData() *SessionData {
+	now := utils.Now()
 	sd := &SessionData{
-		ttl: utils.Now().Add(SESSION_TTL),
-		lst: make(map[interface{}]interface{}),
+		ttl:     now.Add(SESSION_TTL),
+		created: now,
+		seen:    now,
+		lst:     make(map[interface{}]interface{}),
+	}
+	if SESSION_MAX_AGE > 0 {
+		sd.deadline = now.Add(SESSION_MAX_AGE)
 	}
 	return sd
 }
@@ -0,0 +1,134 @@
+package session
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// interval for writing sessions to file
+	FileSessionDumpInterval = 30 * time.Second
+)
+
+// MemSession with all sessions written to a json file periodically and on Close()
+// survives restarts, sessions changed after the last write are lost if crashed
+// removed sessions are written at once, so a logout or revoked session never comes back
+type FileSession struct {
+	*MemSession
+	fp     string
+	dumpMx sync.Mutex
+}
+
+// load sessions from file, not exist file is ok
+func (ss *FileSession) Load() error {
+	buf, err := os.ReadFile(ss.fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	lst := make(map[string]*SessionData)
+	if err := json.Unmarshal(buf, &lst); err != nil {
+		return err
+	}
+
+	ss.mx.Lock()
+	for token, sd := range lst {
+		if sd == nil || sd.IsTimeout() {
+			continue
+		}
+		ss.cookie[token] = sd
+	}
+	ss.mx.Unlock()
+	return nil
+}
+
+// write all sessions to file (atomic by rename), only readable by owner
+func (ss *FileSession) Dump() error {
+	ss.dumpMx.Lock()
+	defer ss.dumpMx.Unlock()
+
+	ss.mx.RLock()
+	buf, err := json.Marshal(ss.cookie)
+	ss.mx.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(ss.fp), filepath.Base(ss.fp)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), ss.fp)
+}
+
+func (ss *FileSession) Destroy(token string) {
+	if ss.has(token) {
+		ss.MemSession.Destroy(token)
+		ss.Dump()
+	}
+}
+
+func (ss *FileSession) Take(token string) *SessionData {
+	if !ss.has(token) {
+		return nil
+	}
+	sd := ss.MemSession.Take(token)
+	ss.Dump()
+	return sd
+}
+
+func (ss *FileSession) has(token string) bool {
+	ss.mx.RLock()
+	_, ok := ss.cookie[token]
+	ss.mx.RUnlock()
+	return ok
+}
+
+func (ss *FileSession) dumper() {
+	ticker := time.NewTicker(FileSessionDumpInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ss.die:
+			return
+		case <-ticker.C:
+			ss.Dump()
+		}
+	}
+}
+
+// stop cleaner and write back
+func (ss *FileSession) Close() {
+	ss.MemSession.Close()
+	ss.Dump()
+}
+
+func NewFileSession(fp string) (*FileSession, error) {
+	sess := &FileSession{
+		MemSession: NewMemSession(),
+		fp:         fp,
+	}
+	if err := sess.Load(); err != nil {
+		sess.MemSession.Close()
+		return nil, err
+	}
+	go sess.dumper()
+	return sess, nil
+}
+
+// make sure FileSession implement Session
+var _ SessionStore = (*FileSession)(nil)
@@ -48,6 +48,38 @@ func (ss *MemSession) Destroy(token string) {
 	}
 }
 
+func (ss *MemSession) Take(token string) *SessionData {
+	ss.mx.Lock()
+	sd, ok := ss.cookie[token]
+	if ok {
+		delete(ss.cookie, token)
+	}
+	ss.mx.Unlock()
+	if !ok || sd.IsTimeout() {
+		return nil
+	}
+	return sd
+}
+
+// call fn for each session not timeout, stop if fn return false
+func (ss *MemSession) Range(fn func(token string, sd *SessionData) bool) {
+	ss.mx.RLock()
+	lst := make(map[string]*SessionData, len(ss.cookie))
+	for token, sd := range ss.cookie {
+		lst[token] = sd
+	}
+	ss.mx.RUnlock()
+
+	for token, sd := range lst {
+		if sd.IsTimeout() {
+			continue
+		}
+		if !fn(token, sd) {
+			return
+		}
+	}
+}
+
 func (ss *MemSession) New(token string) *SessionData {
 	sd := NewSessionData()
 	ss.mx.Lock()
@@ -1,6 +1,7 @@
 package session
 
 import (
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -160,3 +161,99 @@ func TestMemSession(t *testing.T) {
 		}
 	}
 }
+
+func TestFileSession(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "sessions.json")
+	sess, err := NewFileSession(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sd := sess.New("11111")
+	sd.Set("acc", "alice")
+	sd.Set(123, "not string key")
+	old := sess.New("22222")
+	old.ttl = time.Now().Add(-1 * time.Second)
+	sess.Close()
+
+	// load after restart
+	sess, err = NewFileSession(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	if sess.Len() != 1 {
+		t.Fatal("timeout session should not be loaded", sess.Len())
+	}
+	sd = sess.GetOrRenew("11111")
+	if sd == nil {
+		t.Fatal("session should survive restart")
+	}
+	if v, ok := sd.Get("acc"); !ok || v.(string) != "alice" {
+		t.Fatal("value should be loaded", v, ok)
+	}
+	if _, ok := sd.Get(123); ok {
+		t.Fatal("non-string key should not be kept")
+	}
+}
+
+func TestFileSessionRemoved(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "sessions.json")
+	sess, err := NewFileSession(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.New("11111")
+	sess.New("22222")
+	sess.New("33333")
+	sess.Dump()
+
+	// removed without Close(), like crashed
+	sess.Destroy("11111")
+	sess.Take("22222")
+	sess.MemSession.Close()
+
+	sess, err = NewFileSession(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if sess.Len() != 1 || sess.GetOrRenew("33333") == nil {
+		t.Fatal("removed sessions should be written at once", sess.Len())
+	}
+}
+
+func TestSessionDeadline(t *testing.T) {
+	sess := NewMemSession()
+	defer sess.Close()
+
+	// max age
+	SESSION_MAX_AGE = time.Second
+	defer func() { SESSION_MAX_AGE = 0 }()
+	token, sd := sess.NewToken()
+	if sd.Deadline().IsZero() {
+		t.Fatal("deadline should be set by SESSION_MAX_AGE")
+	}
+	sd.SetDeadline(time.Now().Add(-1 * time.Second))
+	if sess.GetOrRenew(token) != nil {
+		t.Fatal("session should timeout after deadline even if renewed")
+	}
+
+	// fixed deadline not extended by renew
+	token, sd = sess.NewToken()
+	deadline := time.Now().Add(time.Hour)
+	sd.SetDeadline(deadline)
+	sd.Renew()
+	if sd.IsTimeout() || !sd.Deadline().Equal(deadline) {
+		t.Fatal("deadline should not change by renew", sd.Deadline(), deadline)
+	}
+
+	// take once
+	if sess.Take(token) != sd {
+		t.Fatal("should take the session")
+	}
+	if sess.Take(token) != nil || sess.GetOrRenew(token) != nil {
+		t.Fatal("session should be destroyed after take")
+	}
+}
@@ -0,0 +1,283 @@
+package tiddlywikid
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"tiddlywikid/session"
+	"tiddlywikid/utils"
+)
+
+// a login session, token is never exposed, use ID for revoke
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"` // login id
+	Name      string    `json:"name,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Remember  bool      `json:"remember,omitempty"` // "remember me" token
+	Current   bool      `json:"current,omitempty"`  // session of this request
+}
+
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// IP of client without port, real one if behind trusted proxies
+func clientIP(r *http.Request) string {
+	addr := utils.ClientAddr(r)
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return ip
+}
+
+// record client of the session
+func setSessionClient(sd *session.SessionData, r *http.Request) {
+	sd.Set("ip", clientIP(r))
+	sd.Set("ua", r.UserAgent())
+}
+
+func getString(sd *session.SessionData, k string) (string, bool) {
+	v, ok := sd.Get(k)
+	if !ok {
+		return "", false
+	}
+	str, ok := v.(string)
+	return str, ok
+}
+
+// all login sessions and "remember me" tokens, filter by login if not empty
+func (wiki *Wiki) listSessions(login string, current string) []*SessionInfo {
+	lst := make([]*SessionInfo, 0)
+	wiki.Sess.Range(func(token string, sd *session.SessionData) bool {
+		info := &SessionInfo{
+			ID:       sessionID(token),
+			Created:  sd.Created(),
+			LastSeen: sd.LastSeen(),
+			Current:  token == current,
+		}
+		if user, ok := getString(sd, "login"); ok {
+			info.User = user
+			info.Name, _ = getString(sd, "acc")
+		} else if user, ok := getString(sd, "remember-login"); ok {
+			info.User = user
+			info.Name, _ = getString(sd, "remember-acc")
+			info.Remember = true
+		} else {
+			return true // not login
+		}
+		if login != "" && info.User != login {
+			return true
+		}
+		info.IP, _ = getString(sd, "ip")
+		info.UserAgent, _ = getString(sd, "ua")
+		lst = append(lst, info)
+		return true
+	})
+	sort.Slice(lst, func(i, j int) bool {
+		return lst[i].Created.Before(lst[j].Created)
+	})
+	return lst
+}
+
+// revoke sessions by ID, all sessions of login if id is empty
+// only sessions of login can be revoked if login is not empty
+func (wiki *Wiki) revokeSessions(login string, id string) int {
+	tokens := make([]string, 0)
+	wiki.Sess.Range(func(token string, sd *session.SessionData) bool {
+		if id != "" && sessionID(token) != id {
+			return true
+		}
+		user, ok := getString(sd, "login")
+		if !ok {
+			user, ok = getString(sd, "remember-login")
+		}
+		if !ok || (login != "" && user != login) {
+			return true
+		}
+		tokens = append(tokens, token)
+		return true
+	})
+	for _, token := range tokens {
+		wiki.Sess.Destroy(token)
+	}
+	return len(tokens)
+}
+
+// revoke all sessions of a user, for user removed or password changed
+func (wiki *Wiki) RevokeUser(login string) int {
+	if login == "" {
+		return 0
+	}
+	return wiki.revokeSessions(login, "")
+}
+
+func (wiki *Wiki) sessionToken(r *http.Request) string {
+	cookie, err := r.Cookie(_SESSION_COOKIE)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// `/admin/sessions`, GET for list all, DELETE `?id=<id>` or `?user=<login>` for revoke
+func (wiki *Wiki) adminSessions(w http.ResponseWriter, r *http.Request) {
+	if !wiki.checkAdmin(w, r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Add("Allow", "GET, DELETE, OPTIONS")
+	case http.MethodGet:
+		JsonRes(w, wiki.listSessions("", wiki.sessionToken(r)), false)
+	case http.MethodDelete:
+		if r.Header.Get("X-Requested-With") != "TiddlyWiki" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		id, user := query.Get("id"), query.Get("user")
+		if id == "" && user == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		n := wiki.revokeSessions(user, id)
+		utils.Vln(3, "[sessions]admin revoke", clientIP(r), id, user, n)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// `/sessions`, sessions of the login user, GET for list, DELETE `?id=<id>` for revoke
+func (wiki *Wiki) mySessions(w http.ResponseWriter, r *http.Request) {
+	sd := wiki.getSess(w, r)
+	if sd == nil {
+		wiki.errNotLogin(w, r, sd)
+		return
+	}
+	login, ok := getString(sd, "login")
+	if !ok {
+		wiki.errNotLogin(w, r, sd)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Add("Allow", "GET, DELETE, OPTIONS")
+	case http.MethodGet:
+		JsonRes(w, wiki.listSessions(login, wiki.sessionToken(r)), false)
+	case http.MethodDelete:
+		if r.Header.Get("X-Requested-With") != "TiddlyWiki" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if wiki.revokeSessions(login, id) == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		utils.Vln(4, "[sessions]revoke", clientIP(r), login, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// `Authorization: Bearer <token>`
+func bearerToken(r *http.Request) (string, bool) {
+	hdr := r.Header.Get("Authorization")
+	if len(hdr) < 7 || !strings.EqualFold(hdr[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(hdr[7:]), true
+}
+
+// session only for this request by API token, not stored
+func (wiki *Wiki) tokenSess(r *http.Request, token string) *session.SessionData {
+	login, name, tk, ok := wiki.AuthHandler.LoginToken(token, r)
+	if !ok {
+		utils.Vln(3, "[token]invalid", clientIP(r), r.URL.Path)
+		return nil
+	}
+	sd := session.NewSessionData()
+	sd.Set("acc", name)
+	sd.Set("login", login)
+	sd.Set("via", "token")
+	sd.Set("token", tk.Name)
+	sd.Set("token-scope", tk.Scope)
+	sd.Set("token-prefix", tk.Prefix)
+	setSessionClient(sd, r)
+	utils.Vln(5, "[token]", login, tk.Name, r.Method, r.URL.Path)
+	return sd
+}
+
+// `Authorization: Basic`, only if enabled
+func (wiki *Wiki) basicAuth(r *http.Request) (user string, pwd string, ok bool) {
+	user, pwd, ok = r.BasicAuth()
+	if !ok || !wiki.AuthHandler.AllowBasicAuth(r) {
+		return "", "", false
+	}
+	return user, pwd, true
+}
+
+func (wiki *Wiki) basicChallenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="tiddlywikid", charset="UTF-8"`)
+}
+
+// session only for this request by HTTP Basic auth, not stored
+// failures are limited by LoginGuard as login
+func (wiki *Wiki) basicSess(r *http.Request, user string, pwd string) *session.SessionData {
+	ip := clientIP(r)
+	if wait, ok := wiki.LoginGuard.Allow(user, ip); !ok {
+		utils.Vln(3, "[basic]too many failures", user, ip, wait)
+		return nil
+	}
+	name, ok := wiki.AuthHandler.Login(user, pwd, r)
+	if !ok {
+		wiki.LoginGuard.Fail(user, ip)
+		utils.Vln(3, "[basic]failed", user, ip, r.URL.Path)
+		return nil
+	}
+	wiki.LoginGuard.Success(user, ip)
+
+	sd := session.NewSessionData()
+	sd.Set("acc", name)
+	sd.Set("login", user)
+	sd.Set("via", "basic")
+	setSessionClient(sd, r)
+	utils.Vln(5, "[basic]", user, r.Method, r.URL.Path)
+	return sd
+}
+
+// session only for this request by header from trusted proxy, nil if no such header
+func (wiki *Wiki) proxySess(r *http.Request) *session.SessionData {
+	login, name, role, ok := wiki.AuthHandler.LoginProxy(r)
+	if !ok {
+		return nil
+	}
+	sd := session.NewSessionData()
+	sd.Set("via", "proxy")
+	sd.Set("acc", name)
+	sd.Set("login", login)
+	sd.Set("proxy-role", role)
+	setSessionClient(sd, r)
+	utils.Vln(5, "[proxy]", login, role, r.Method, r.URL.Path)
+	return sd
+}
@@ -2,8 +2,13 @@ package store
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"sort"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -11,10 +16,21 @@ const (
 	// Max size when outputting Tiddler with its Text
 	// more than this size will output Meta only
 	ListFullTiddlerMaxSize = 32 * 1024 * 1024 // 32MB
+
+	// default number of old revisions to keep for each tiddler
+	DefaultRevisionCount = 32
 )
 
 type Store interface {
 	List(ap []*TiddlyWebJSON, full bool) []byte
+
+	// list skinny tiddlers changed after change sequence `since`
+	// deleted tiddlers output as tombstone: `{"title":"","_is_deleted":true}`
+	// return current change sequence
+	ListSince(ap []*TiddlyWebJSON, since uint64) (buf []byte, seq uint64)
+
+	// current change sequence, increase on every Put/Del
+	Seq() uint64
 	// ListStream(w io.Writer, ap []*TiddlyWebJSON)) error
 
 	// string Revision set by api handler
@@ -27,12 +43,110 @@ type Store interface {
 	// Extract external file
 	Put(key string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string)
 
+	// same as Put(), but only write when current revision (0 for not exist) and hash (empty for skip) match
+	// return current revision and hash if not match
+	PutIf(key string, ifRev uint64, ifHash string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string, ok bool)
+
 	Del(key string) (ok bool, file string)
 
+	// list all kept revisions of a tiddler, newest first, include current one
+	// `text` is not included
+	Revisions(key string) []*TiddlyWebJSON
+
+	// get a kept revision of a tiddler, same as Get() for current revision
+	GetRevision(key string, rev uint64) (tiddler *TiddlyWebJSON, hash string)
+
+	// call fn for each tiddler (with text) until fn return false
+	// fn should not call any method of the Store
+	Each(fn func(tiddler *TiddlyWebJSON, hash string) bool)
+
 	// bind external attachment to a tiddler for removing file if tiddler delete
 	AttachAttachment(key string, file string) bool
 }
 
+// store with index on tags and modified time, for cheap tag query and recent changes
+type Indexer interface {
+	// titles tagged with tag, sorted by title
+	Tagged(tag string) []string
+
+	// titles sorted by `modified` field, newest first, 0 for no limit
+	// tiddlers without `modified` field are not included
+	Recent(limit int) []string
+}
+
+// titles tagged with tag, sorted by title, by index if s is an Indexer or scan all tiddlers
+func Tagged(s Store, tag string) []string {
+	if idx, ok := s.(Indexer); ok {
+		return idx.Tagged(tag)
+	}
+	out := make([]string, 0, 8)
+	s.Each(func(tiddler *TiddlyWebJSON, hash string) bool {
+		if hasTag(tiddler, tag) {
+			out = append(out, tiddler.Title)
+		}
+		return true
+	})
+	sort.Strings(out)
+	return out
+}
+
+// titles sorted by `modified` field, newest first, 0 for no limit
+// by index if s is an Indexer or scan all tiddlers
+func Recent(s Store, limit int) []string {
+	if idx, ok := s.(Indexer); ok {
+		return idx.Recent(limit)
+	}
+	lst := make([]*TiddlyWebJSON, 0, 8)
+	s.Each(func(tiddler *TiddlyWebJSON, hash string) bool {
+		if tiddler.Modified != "" {
+			tiddler.Text = ""
+			lst = append(lst, tiddler)
+		}
+		return true
+	})
+	sort.Slice(lst, func(i, j int) bool {
+		if lst[i].Modified != lst[j].Modified {
+			return lst[i].Modified > lst[j].Modified
+		}
+		return lst[i].Title > lst[j].Title // same as index order
+	})
+	if limit > 0 && len(lst) > limit {
+		lst = lst[:limit]
+	}
+	out := make([]string, 0, len(lst))
+	for _, td := range lst {
+		out = append(out, td.Title)
+	}
+	return out
+}
+
+// store can drop deleted tiddlers and unused attachment files by RevisionPolicy
+type Sweeper interface {
+	// drop expired revisions of deleted tiddlers, and the tombstone when no revision kept
+	// return attachment files not used by any kept revision, should be removed by caller
+	Sweep() (files []string)
+
+	// change sequence of the newest dropped tombstone
+	// ListSince() with older `since` may miss deleted tiddlers, use List() instead
+	SweptSeq() uint64
+}
+
+// sweep s if it is a Sweeper
+func Sweep(s Store) []string {
+	if sw, ok := s.(Sweeper); ok {
+		return sw.Sweep()
+	}
+	return nil
+}
+
+// swept change sequence of s, 0 if it is not a Sweeper
+func SweptSeq(s Store) uint64 {
+	if sw, ok := s.(Sweeper); ok {
+		return sw.SweptSeq()
+	}
+	return 0
+}
+
 type TiddlerFields map[string]interface{}
 
 type TiddlerTags []string
@@ -70,6 +184,89 @@ type StoreTiddler struct {
 	Hash     string // md5? sha1? sha256?
 	File     string // external attachment
 	HasMacro bool   // `$:/tags/Macro` tag need to send `text` in skinny tiddler
+	Time     int64  // save time in unix nano, for revision history
+	Seq      uint64 // change sequence
+}
+
+// key of swept change sequence in tombstones, not a valid title
+var sweptKey = []byte("\x00swept")
+
+// for deleted tiddler in ListSince()
+type tombstone struct {
+	Title   string `json:"title"`
+	Deleted bool   `json:"_is_deleted"`
+}
+
+func writeTombstone(b *bytes.Buffer, title string, hasOutput bool) bool {
+	buf, err := json.Marshal(&tombstone{
+		Title:   title,
+		Deleted: true,
+	})
+	if err != nil {
+		return hasOutput
+	}
+	if hasOutput {
+		b.WriteByte(',')
+	}
+	b.Write(buf)
+	return true
+}
+
+// set revision, extract `text` field, build meta and calc hash
+// `text` of tiddler will be cleared
+func encodeMeta(tiddler *TiddlyWebJSON, rev uint64) (meta []byte, text string, hash string) {
+	// set revision
+	tiddler.Revision = fmt.Sprintf("%v", rev)
+
+	// Extract `text` field
+	text = tiddler.Text
+	tiddler.Text = ""
+
+	// build meta
+	meta, _ = json.Marshal(tiddler)
+
+	// calc hash
+	h := sha256.New()
+	h.Write(meta)
+	h.Write([]byte(text))
+	// hash = hex.EncodeToString(h.Sum(nil))
+	hash = base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+	return
+}
+
+// check current revision for PutIf()
+func revMatch(curRev uint64, curHash string, rev uint64, hash string) bool {
+	return curRev == rev && (hash == "" || curHash == hash)
+}
+
+// limit for revision history
+type RevisionPolicy struct {
+	MaxCount int           // max old revisions to keep per tiddler, 0 for disable history
+	MaxAge   time.Duration // drop old revisions older than this, 0 for no limit
+}
+
+func (p *RevisionPolicy) SetRevisionPolicy(count int, age time.Duration) {
+	if count < 0 {
+		count = 0
+	}
+	p.MaxCount = count
+	p.MaxAge = age
+}
+
+// how many oldest revisions should be dropped
+// `saved` is the save time of each revision, ordered from oldest to newest
+func (p *RevisionPolicy) dropCount(saved []int64) int {
+	drop := 0
+	if len(saved) > p.MaxCount {
+		drop = len(saved) - p.MaxCount
+	}
+	if p.MaxAge > 0 {
+		deadline := time.Now().Add(-p.MaxAge).UnixNano()
+		for drop < len(saved) && saved[drop] < deadline {
+			drop++
+		}
+	}
+	return drop
 }
 
 type ListCacheState struct {
@@ -2,8 +2,6 @@ package store
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
@@ -11,6 +9,7 @@ import (
 	"path"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"git.mills.io/prologic/bitcask"
 )
@@ -18,9 +17,17 @@ import (
 type BitcaskStore struct {
 	mx      sync.RWMutex
 	db      *bitcask.Bitcask
-	fileRef *bitcask.Bitcask
+	fileRef *bitcask.Bitcask // file -> reference count, 0 for unused file removed by Sweep()
+	history *bitcask.Bitcask
+	deleted *bitcask.Bitcask // tombstone: title -> change sequence
+
+	seq     uint64            // change sequence
+	swept   uint64            // change sequence of newest dropped tombstone
+	seqIdx  map[string]uint64 // title -> change sequence
+	tombIdx map[string]uint64 // in memory copy of `deleted`
 
 	ListCacheState
+	RevisionPolicy
 }
 
 func (s *BitcaskStore) putText(td *StoreTiddler) ([]byte, error) {
@@ -105,6 +112,52 @@ func (s *BitcaskStore) list(full bool) ([]byte, bool) {
 	return b.Bytes(), hasOutput
 }
 
+func (s *BitcaskStore) ListSince(ap []*TiddlyWebJSON, since uint64) ([]byte, uint64) {
+	var b bytes.Buffer
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	hasOutput := false
+	b.WriteByte('[')
+	for key, seq := range s.seqIdx {
+		if seq <= since {
+			continue
+		}
+		td := s.get(([]byte)(key))
+		if td == nil {
+			continue
+		}
+		buf := td.Meta
+		if td.HasMacro {
+			var err error
+			buf, err = s.putText(td)
+			if err != nil {
+				continue
+			}
+		}
+		if hasOutput {
+			b.WriteByte(',')
+		}
+		b.Write(buf)
+		hasOutput = true
+	}
+	for key, seq := range s.tombIdx {
+		if seq <= since {
+			continue
+		}
+		hasOutput = writeTombstone(&b, key, hasOutput)
+	}
+
+	return buildTiddlerList(b.Bytes(), hasOutput, ap), s.seq
+}
+
+func (s *BitcaskStore) Seq() uint64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.seq
+}
+
 func (s *BitcaskStore) Get(key string) (*TiddlyWebJSON, string) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
@@ -127,22 +180,85 @@ func (s *BitcaskStore) Get(key string) (*TiddlyWebJSON, string) {
 	return tiddler, td.Hash
 }
 
-func (s *BitcaskStore) get(key []byte) *StoreTiddler {
-	tdBuf, err := s.db.Get(key)
-	if err != nil {
+func (s *BitcaskStore) Each(fn func(tiddler *TiddlyWebJSON, hash string) bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	for key := range s.seqIdx {
+		td := s.get(([]byte)(key))
+		if td == nil {
+			continue
+		}
+		tiddler := &TiddlyWebJSON{}
+		err := json.Unmarshal(td.Meta, tiddler)
+		if err != nil {
+			continue
+		}
+		tiddler.Rev = td.Rev
+		tiddler.Text = td.Text
+		if !fn(tiddler, td.Hash) {
+			return
+		}
+	}
+}
+
+func (s *BitcaskStore) Revisions(key string) []*TiddlyWebJSON {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	keyBuf := ([]byte)(key)
+	lst := s.getHistory(keyBuf) // kept after delete
+	if td := s.get(keyBuf); td != nil {
+		lst = append(lst, td)
+	}
+	if len(lst) == 0 {
 		return nil
 	}
+	out := make([]*TiddlyWebJSON, 0, len(lst))
+	for i := len(lst) - 1; i >= 0; i-- {
+		tiddler := &TiddlyWebJSON{}
+		err := json.Unmarshal(lst[i].Meta, tiddler)
+		if err != nil {
+			continue
+		}
+		tiddler.Rev = lst[i].Rev
+		out = append(out, tiddler)
+	}
+	return out
+}
 
-	r := bytes.NewReader(tdBuf)
-	dec := gob.NewDecoder(r)
+func (s *BitcaskStore) GetRevision(key string, rev uint64) (*TiddlyWebJSON, string) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
 
-	td := &StoreTiddler{}
-	err = dec.Decode(td)
+	keyBuf := ([]byte)(key)
+	td := s.get(keyBuf)
+	if td == nil || td.Rev != rev {
+		td = s.decode(s.history.Get(historyKey(keyBuf, rev)))
+		if td == nil {
+			return nil, ""
+		}
+	}
+
+	tiddler := &TiddlyWebJSON{}
+	err := json.Unmarshal(td.Meta, tiddler)
+	if err != nil {
+		return nil, ""
+	}
+	tiddler.Rev = td.Rev
+	tiddler.Text = td.Text
+	return tiddler, td.Hash
+}
+
+func (s *BitcaskStore) get(key []byte) *StoreTiddler {
+	return s.decode(s.db.Get(key))
+}
+
+func (s *BitcaskStore) decode(tdBuf []byte, err error) *StoreTiddler {
 	if err != nil {
-		// decode error
 		return nil
 	}
-	return td
+	return decodeTiddler(tdBuf)
 }
 
 // need to do:
@@ -151,21 +267,48 @@ func (s *BitcaskStore) get(key []byte) *StoreTiddler {
 // Extract `text` field
 func (s *BitcaskStore) Put(key string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string) {
 	keyBuf := ([]byte)(key)
-	ref := 0
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.putTiddler(keyBuf, s.get(keyBuf), tiddler, hasMacro, filePath)
+}
+
+func (s *BitcaskStore) PutIf(key string, ifRev uint64, ifHash string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string, ok bool) {
+	keyBuf := ([]byte)(key)
 
 	s.mx.Lock()
 	defer s.mx.Unlock()
 
 	td := s.get(keyBuf)
+	if td != nil {
+		rev, hash = td.Rev, td.Hash
+	}
+	if !revMatch(rev, hash, ifRev, ifHash) {
+		return rev, hash, false
+	}
+	rev, hash = s.putTiddler(keyBuf, td, tiddler, hasMacro, filePath)
+	return rev, hash, true
+}
+
+// should hold write lock, td is current tiddler or nil
+func (s *BitcaskStore) putTiddler(keyBuf []byte, td *StoreTiddler, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string) {
 	if td == nil {
 		td = &StoreTiddler{}
-		ref = 1 // file ref += 1
+		if _, ok := s.tombIdx[string(keyBuf)]; ok {
+			td.Rev = s.lastRev(keyBuf) // continue revision of deleted one
+		}
+	} else {
+		// keep old revision
+		s.pushHistory(keyBuf, td)
 	}
-	rev, hash = s.putExist(td, tiddler, hasMacro, filePath, ref)
+	rev, hash = s.putExist(td, tiddler, hasMacro, filePath)
+	s.seq++
+	td.Seq = s.seq
 
-	// update file ref
-	if ref != 0 && filePath != "" {
-		s.attachRef(filePath, ref)
+	// update file ref, counted for each revision
+	if filePath != "" {
+		s.attachRef(filePath, 1)
 		// TODO: error handle
 	}
 
@@ -176,6 +319,11 @@ func (s *BitcaskStore) Put(key string, tiddler *TiddlyWebJSON, hasMacro bool, fi
 		// fmt.Println("[put]err", key, td, err)
 		return
 	}
+	s.seqIdx[string(keyBuf)] = td.Seq
+	if _, ok := s.tombIdx[string(keyBuf)]; ok {
+		delete(s.tombIdx, string(keyBuf))
+		s.deleted.Delete(keyBuf)
+	}
 
 	// flag dirty
 	s.FlagDirty()
@@ -183,18 +331,119 @@ func (s *BitcaskStore) Put(key string, tiddler *TiddlyWebJSON, hasMacro bool, fi
 }
 
 func (s *BitcaskStore) put(key []byte, td *StoreTiddler) error {
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
-	err := enc.Encode(td)
+	buf, err := encodeTiddler(td)
 	if err != nil {
 		// ???
 		return err
 	}
-	err = s.db.Put(key, b.Bytes())
+	err = s.db.Put(key, buf)
 	return err
 }
 
-func (s *BitcaskStore) putExist(td *StoreTiddler, tiddler *TiddlyWebJSON, hasMacro bool, fp string, ref int) (rev uint64, hash string) {
+func encodeTiddler(td *StoreTiddler) ([]byte, error) {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	err := enc.Encode(td)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decodeTiddler(tdBuf []byte) *StoreTiddler {
+	r := bytes.NewReader(tdBuf)
+	dec := gob.NewDecoder(r)
+
+	td := &StoreTiddler{}
+	err := dec.Decode(td)
+	if err != nil {
+		// decode error
+		return nil
+	}
+	return td
+}
+
+// key for history db: title + '\x00' + revision (big endian)
+func historyKey(key []byte, rev uint64) []byte {
+	buf := make([]byte, len(key)+1+8)
+	copy(buf, key)
+	binary.BigEndian.PutUint64(buf[len(key)+1:], rev)
+	return buf
+}
+
+func (s *BitcaskStore) historyKeys(key []byte) [][]byte {
+	prefix := make([]byte, len(key)+1)
+	copy(prefix, key)
+
+	keys := make([][]byte, 0, 8)
+	s.history.Scan(prefix, func(k []byte) error {
+		if len(k) == len(prefix)+8 {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	return keys
+}
+
+// old revisions, oldest first
+func (s *BitcaskStore) getHistory(key []byte) []*StoreTiddler {
+	keys := s.historyKeys(key)
+	lst := make([]*StoreTiddler, 0, len(keys))
+	for _, k := range keys {
+		td := s.decode(s.history.Get(k))
+		if td == nil {
+			continue
+		}
+		lst = append(lst, td)
+	}
+	return lst
+}
+
+// copy current revision into history, and drop expired revisions
+func (s *BitcaskStore) pushHistory(key []byte, td *StoreTiddler) {
+	old := *td
+	if old.Time == 0 {
+		old.Time = time.Now().UnixNano() // from old data
+	}
+	buf, err := encodeTiddler(&old)
+	if err != nil {
+		return
+	}
+	if err := s.history.Put(historyKey(key, old.Rev), buf); err != nil {
+		return
+	}
+	s.dropHistory(key)
+}
+
+// drop expired revisions by RevisionPolicy, return count of kept revisions
+func (s *BitcaskStore) dropHistory(key []byte) int {
+	lst := s.getHistory(key)
+	saved := make([]int64, len(lst))
+	for i, h := range lst {
+		saved[i] = h.Time
+	}
+	drop := s.dropCount(saved)
+	for _, h := range lst[:drop] {
+		s.history.Delete(historyKey(key, h.Rev))
+		if h.File != "" {
+			s.attachRef(h.File, -1) // unused file is removed by Sweep()
+		}
+	}
+	return len(lst) - drop
+}
+
+// newest revision in history, 0 for none
+func (s *BitcaskStore) lastRev(key []byte) uint64 {
+	rev := uint64(0)
+	for _, k := range s.historyKeys(key) {
+		if r := binary.BigEndian.Uint64(k[len(k)-8:]); r > rev {
+			rev = r
+		}
+	}
+	return rev
+}
+
+func (s *BitcaskStore) putExist(td *StoreTiddler, tiddler *TiddlyWebJSON, hasMacro bool, fp string) (rev uint64, hash string) {
 	// Remove `_is_skinny` field, and keep old text
 	if tiddler.IsSkinny != nil {
 		tiddler.IsSkinny = nil
@@ -203,26 +452,11 @@ func (s *BitcaskStore) putExist(td *StoreTiddler, tiddler *TiddlyWebJSON, hasMac
 
 	rev = atomic.AddUint64(&td.Rev, 1)
 
-	// TODO: check revision?
 	// Remove any revision field
 	// tiddler.Revision = ""
 
-	// set revision
-	tiddler.Revision = fmt.Sprintf("%v", rev)
-
-	// Extract `text` field
-	text := tiddler.Text
-	tiddler.Text = ""
-
-	// build meta
-	meta, _ := json.Marshal(tiddler)
-
-	// calc hash
-	h := sha256.New()
-	h.Write(meta)
-	h.Write([]byte(text))
-	// hash = hex.EncodeToString(h.Sum(nil))
-	hash = base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+	// set revision, extract `text` field, build meta and calc hash
+	meta, text, hash := encodeMeta(tiddler, rev)
 
 	// set back
 	td.Meta = meta
@@ -230,6 +464,7 @@ func (s *BitcaskStore) putExist(td *StoreTiddler, tiddler *TiddlyWebJSON, hasMac
 	td.HasMacro = hasMacro
 	td.Hash = hash
 	td.File = fp
+	td.Time = time.Now().UnixNano()
 
 	return rev, hash
 }
@@ -248,23 +483,71 @@ func (s *BitcaskStore) Del(key string) (bool, string) {
 	if err != nil {
 		return false, ""
 	}
+	s.pushHistory(keyBuf, td) // keep deleted revision
+
+	// tombstone
+	s.seq++
+	delete(s.seqIdx, key)
+	s.tombIdx[key] = s.seq
+	seqBuf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(seqBuf, s.seq)
+	s.deleted.Put(keyBuf, seqBuf)
 
 	// flag dirty
 	s.FlagDirty()
 
-	// skip if no file
-	if td.File == "" {
-		return true, ""
+	// remove file only if not used by any kept revision
+	if td.File != "" {
+		if countBuf, err := s.fileRef.Get([]byte(td.File)); err == nil && isZero(countBuf) {
+			s.fileRef.Delete([]byte(td.File))
+			return true, td.File
+		}
+	}
+	return true, ""
+}
+
+func (s *BitcaskStore) Sweep() []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	swept := s.swept
+	for key, seq := range s.tombIdx {
+		keyBuf := []byte(key)
+		if s.dropHistory(keyBuf) > 0 {
+			continue
+		}
+		delete(s.tombIdx, key)
+		s.deleted.Delete(keyBuf)
+		if seq > swept {
+			swept = seq
+		}
+	}
+	if swept != s.swept {
+		seqBuf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(seqBuf, swept)
+		if err := s.deleted.Put(sweptKey, seqBuf); err == nil {
+			s.swept = swept
+		}
 	}
 
-	// calc file ref
-	count, _ := s.attachRef(td.File, -1)
-	if count == 0 {
-		// delete ref key
-		s.fileRef.Delete([]byte(td.File))
-		return true, td.File
+	keys := make([][]byte, 0)
+	for fnBuf := range s.fileRef.Keys() {
+		keys = append(keys, fnBuf)
 	}
-	return true, ""
+	files := make([]string, 0)
+	for _, fnBuf := range keys {
+		if countBuf, err := s.fileRef.Get(fnBuf); err == nil && isZero(countBuf) {
+			s.fileRef.Delete(fnBuf)
+			files = append(files, string(fnBuf))
+		}
+	}
+	return files
+}
+
+func (s *BitcaskStore) SweptSeq() uint64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.swept
 }
 
 func (s *BitcaskStore) AttachAttachment(key string, file string) bool {
@@ -276,27 +559,34 @@ func (s *BitcaskStore) AttachAttachment(key string, file string) bool {
 	if td == nil {
 		return false
 	}
-	td.File = file
-
-	// calc file ref
+	// calc file ref, for current revision only
+	if td.File != "" {
+		s.attachRef(td.File, -1)
+	}
 	_, err := s.attachRef(file, 1)
 	if err != nil {
 		// ???
 		return false
 	}
+	td.File = file
 
 	err = s.put(keyBuf, td)
 	return err == nil
 }
 
+// reference count of attachment file from all kept revisions
+// unused file is kept with count 0 until Sweep()
 func (s *BitcaskStore) attachRef(file string, delta int) (int64, error) {
 	fnBuf := ([]byte)(file)
 	countBuf, err := s.fileRef.Get(fnBuf)
-	if err != nil {
+	if err != nil || len(countBuf) != 8 {
 		countBuf = make([]byte, 8)
 	}
 	count := int64(binary.LittleEndian.Uint64(countBuf))
 	count += int64(delta)
+	if count < 0 {
+		count = 0
+	}
 	binary.LittleEndian.PutUint64(countBuf, uint64(count))
 	err = s.fileRef.Put(fnBuf, countBuf)
 	if err != nil {
@@ -309,6 +599,12 @@ func (s *BitcaskStore) Merge() error {
 	if err := s.db.Merge(); err != nil {
 		return err
 	}
+	if err := s.history.Merge(); err != nil {
+		return err
+	}
+	if err := s.deleted.Merge(); err != nil {
+		return err
+	}
 	return s.fileRef.Merge()
 }
 
@@ -316,6 +612,12 @@ func (s *BitcaskStore) Close() error {
 	if err := s.db.Close(); err != nil {
 		return err
 	}
+	if err := s.history.Close(); err != nil {
+		return err
+	}
+	if err := s.deleted.Close(); err != nil {
+		return err
+	}
 	return s.fileRef.Close()
 }
 
@@ -341,11 +643,94 @@ func NewBitcaskStore(dir string) (*BitcaskStore, error) {
 		return nil, err
 	}
 
-	return &BitcaskStore{
+	// old revisions
+	history, err := bitcask.Open(
+		path.Join(dir, "history"),
+		bitcask.WithMaxDatafileSize(64*1024*1024), // 64 MB
+		bitcask.WithMaxKeySize(8192+1+8),          // for tiddler title + revision
+		bitcask.WithMaxValueSize(0),               // remove value size limit
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// tombstone for deleted tiddlers
+	deleted, err := bitcask.Open(
+		path.Join(dir, "deleted"),
+		bitcask.WithMaxDatafileSize(64*1024*1024), // 64 MB
+		bitcask.WithMaxKeySize(8192),              // for tiddler title
+		bitcask.WithMaxValueSize(8),               // for change sequence uint64
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BitcaskStore{
 		db:      db,
 		fileRef: fRef,
-	}, nil
+		history: history,
+		deleted: deleted,
+		seqIdx:  make(map[string]uint64),
+		tombIdx: make(map[string]uint64),
+		RevisionPolicy: RevisionPolicy{
+			MaxCount: DefaultRevisionCount,
+		},
+	}
+	s.loadSeq()
+	return s, nil
+}
+
+// build change sequence index, and set change sequence for old data
+func (s *BitcaskStore) loadSeq() {
+	keys := make([][]byte, 0, s.db.Len())
+	for keyBuf := range s.db.Keys() {
+		keys = append(keys, keyBuf)
+	}
+	for keyBuf := range s.deleted.Keys() {
+		seqBuf, err := s.deleted.Get(keyBuf)
+		if err != nil || len(seqBuf) != 8 {
+			continue
+		}
+		seq := binary.LittleEndian.Uint64(seqBuf)
+		if seq > s.seq {
+			s.seq = seq
+		}
+		if bytes.Equal(keyBuf, sweptKey) {
+			s.swept = seq
+			continue
+		}
+		s.tombIdx[string(keyBuf)] = seq
+	}
+
+	noSeq := make([][]byte, 0)
+	for _, keyBuf := range keys {
+		td := s.get(keyBuf)
+		if td == nil {
+			continue
+		}
+		if td.Seq == 0 {
+			noSeq = append(noSeq, keyBuf)
+			continue
+		}
+		s.seqIdx[string(keyBuf)] = td.Seq
+		if td.Seq > s.seq {
+			s.seq = td.Seq
+		}
+	}
+	for _, keyBuf := range noSeq {
+		td := s.get(keyBuf)
+		s.seq++
+		td.Seq = s.seq
+		s.put(keyBuf, td)
+		s.seqIdx[string(keyBuf)] = td.Seq
+	}
+}
+
+// zero reference count
+func isZero(countBuf []byte) bool {
+	return len(countBuf) == 8 && binary.LittleEndian.Uint64(countBuf) == 0
 }
 
-// make sure BitcaskStore implement Store
+// make sure BitcaskStore implement Store & Sweeper
 var _ Store = (*BitcaskStore)(nil)
+var _ Sweeper = (*BitcaskStore)(nil)
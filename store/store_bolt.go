@@ -0,0 +1,820 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// buckets
+var (
+	boltMeta     = []byte("meta")     // title -> meta, for skinny list
+	boltText     = []byte("text")     // title -> text
+	boltInfo     = []byte("info")     // title -> StoreTiddler without Meta and Text
+	boltMacro    = []byte("macro")    // title -> empty, tiddlers tagged `$:/tags/Macro`
+	boltHistory  = []byte("history")  // title + '\x00' + revision -> StoreTiddler
+	boltTags     = []byte("tags")     // tag + '\x00' + title -> empty
+	boltModified = []byte("modified") // modified + '\x00' + title -> empty
+	boltSeq      = []byte("seq")      // change sequence -> title, include deleted tiddlers
+	boltDeleted  = []byte("deleted")  // tombstone: title -> change sequence
+	boltAttach   = []byte("attach")   // file -> reference count, 0 for unused file removed by Sweep()
+)
+
+var boltBuckets = [][]byte{boltMeta, boltText, boltInfo, boltMacro, boltHistory, boltTags, boltModified, boltSeq, boltDeleted, boltAttach}
+
+// meta, text and info in separate buckets, so list and history do not need to read text
+// with index on tag and modified time
+type BoltStore struct {
+	db    *bolt.DB
+	wmx   sync.Mutex // serialize write transactions, for seq
+	seq   uint64     // change sequence
+	swept uint64     // change sequence of newest dropped tombstone
+
+	ListCacheState
+	RevisionPolicy
+}
+
+func (s *BoltStore) putText(meta []byte, text []byte) ([]byte, error) {
+	var js map[string]interface{}
+	err := json.Unmarshal(meta, &js)
+	if err != nil {
+		return nil, err
+	}
+	js["text"] = string(text)
+	return json.Marshal(js)
+}
+
+func (s *BoltStore) List(ap []*TiddlyWebJSON, full bool) []byte {
+	// check cache for full
+	if !full {
+		fmt.Println("[list]slim")
+		buf, hasOutput := s.list(full)
+		return buildTiddlerList(buf, hasOutput, ap)
+	}
+
+	if s.ListCacheState.IsDirty() {
+		// do full and write cache
+		buf, hasOutput := s.list(full)
+		s.Set(buf, hasOutput)
+		fmt.Println("[list]full/dirty")
+	}
+	fmt.Println("[list]full")
+
+	// just do system generated data and return
+	out, ok := s.Build(ap)
+	if !ok {
+		fmt.Println("[list]full,no-cache")
+		// no cache, we need to build one
+		buf, hasOutput := s.list(full)
+		s.Set(buf, hasOutput)
+		out, _ = s.Build(ap)
+	}
+	return out
+}
+
+func (s *BoltStore) list(full bool) ([]byte, bool) {
+	var b bytes.Buffer
+
+	hasOutput := false
+	outputFull := full
+	b.WriteByte('[')
+	s.db.View(func(tx *bolt.Tx) error {
+		textB := tx.Bucket(boltText)
+		macroB := tx.Bucket(boltMacro)
+		return tx.Bucket(boltMeta).ForEach(func(k, meta []byte) error {
+			if b.Len() >= ListFullTiddlerMaxSize {
+				outputFull = false
+			}
+			buf := meta
+			if outputFull || macroB.Get(k) != nil {
+				var err error
+				buf, err = s.putText(meta, textB.Get(k))
+				if err != nil {
+					return nil
+				}
+			}
+			if hasOutput {
+				b.WriteByte(',')
+			}
+			b.Write(buf)
+
+			// flag for ','
+			hasOutput = true
+			return nil
+		})
+	})
+
+	return b.Bytes(), hasOutput
+}
+
+func (s *BoltStore) ListSince(ap []*TiddlyWebJSON, since uint64) ([]byte, uint64) {
+	var b bytes.Buffer
+
+	hasOutput := false
+	seq := uint64(0)
+	b.WriteByte('[')
+	s.db.View(func(tx *bolt.Tx) error {
+		metaB := tx.Bucket(boltMeta)
+		textB := tx.Bucket(boltText)
+		macroB := tx.Bucket(boltMacro)
+
+		c := tx.Bucket(boltSeq).Cursor()
+		if k, _ := c.Last(); k != nil {
+			seq = binary.BigEndian.Uint64(k)
+		}
+		if v := tx.Bucket(boltDeleted).Get(sweptKey); len(v) == 8 && binary.BigEndian.Uint64(v) > seq {
+			seq = binary.BigEndian.Uint64(v) // newest tombstone may be dropped
+		}
+		for k, key := c.Seek(u64Key(since + 1)); k != nil; k, key = c.Next() {
+			meta := metaB.Get(key)
+			if meta == nil {
+				hasOutput = writeTombstone(&b, string(key), hasOutput)
+				continue
+			}
+			buf := meta
+			if macroB.Get(key) != nil {
+				var err error
+				buf, err = s.putText(meta, textB.Get(key))
+				if err != nil {
+					continue
+				}
+			}
+			if hasOutput {
+				b.WriteByte(',')
+			}
+			b.Write(buf)
+			hasOutput = true
+		}
+		return nil
+	})
+
+	return buildTiddlerList(b.Bytes(), hasOutput, ap), seq
+}
+
+func (s *BoltStore) Seq() uint64 {
+	return atomic.LoadUint64(&s.seq)
+}
+
+func (s *BoltStore) Get(key string) (tiddler *TiddlyWebJSON, hash string) {
+	s.db.View(func(tx *bolt.Tx) error {
+		tiddler, hash = s.get(tx, []byte(key), true)
+		return nil
+	})
+	return
+}
+
+// current revision of tiddler, nil if not exist
+func (s *BoltStore) get(tx *bolt.Tx, keyBuf []byte, withText bool) (*TiddlyWebJSON, string) {
+	meta := tx.Bucket(boltMeta).Get(keyBuf)
+	info := s.info(tx, keyBuf)
+	if meta == nil || info == nil {
+		return nil, ""
+	}
+	tiddler := &TiddlyWebJSON{}
+	err := json.Unmarshal(meta, tiddler)
+	if err != nil {
+		return nil, ""
+	}
+	tiddler.Rev = info.Rev
+	if withText {
+		tiddler.Text = string(tx.Bucket(boltText).Get(keyBuf))
+	}
+	return tiddler, info.Hash
+}
+
+func (s *BoltStore) info(tx *bolt.Tx, keyBuf []byte) *StoreTiddler {
+	buf := tx.Bucket(boltInfo).Get(keyBuf)
+	if buf == nil {
+		return nil
+	}
+	return decodeTiddler(buf)
+}
+
+func (s *BoltStore) Each(fn func(tiddler *TiddlyWebJSON, hash string) bool) {
+	s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltMeta).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			tiddler, hash := s.get(tx, k, true)
+			if tiddler == nil {
+				continue
+			}
+			if !fn(tiddler, hash) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Revisions(key string) []*TiddlyWebJSON {
+	var out []*TiddlyWebJSON
+	s.db.View(func(tx *bolt.Tx) error {
+		keyBuf := []byte(key)
+		lst := s.getHistory(tx, keyBuf) // kept after delete
+		out = make([]*TiddlyWebJSON, 0, len(lst)+1)
+		if tiddler, _ := s.get(tx, keyBuf, false); tiddler != nil {
+			out = append(out, tiddler)
+		}
+		for i := len(lst) - 1; i >= 0; i-- {
+			tiddler := &TiddlyWebJSON{}
+			if err := json.Unmarshal(lst[i].Meta, tiddler); err != nil {
+				continue
+			}
+			tiddler.Rev = lst[i].Rev
+			out = append(out, tiddler)
+		}
+		return nil
+	})
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func (s *BoltStore) GetRevision(key string, rev uint64) (tiddler *TiddlyWebJSON, hash string) {
+	s.db.View(func(tx *bolt.Tx) error {
+		keyBuf := []byte(key)
+		if info := s.info(tx, keyBuf); info != nil && info.Rev == rev {
+			tiddler, hash = s.get(tx, keyBuf, true)
+			return nil
+		}
+
+		buf := tx.Bucket(boltHistory).Get(historyKey(keyBuf, rev))
+		if buf == nil {
+			return nil
+		}
+		td := decodeTiddler(buf)
+		if td == nil {
+			return nil
+		}
+		tiddler = &TiddlyWebJSON{}
+		if err := json.Unmarshal(td.Meta, tiddler); err != nil {
+			tiddler = nil
+			return nil
+		}
+		tiddler.Rev = td.Rev
+		tiddler.Text = td.Text
+		hash = td.Hash
+		return nil
+	})
+	return
+}
+
+// need to do:
+// Remove any revision field
+// Remove `_is_skinny` field, and keep old text
+// Extract `text` field
+func (s *BoltStore) Put(key string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string) {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		rev, hash, err = s.put(tx, []byte(key), tiddler, hasMacro, filePath)
+		return err
+	})
+	if err != nil {
+		fmt.Println("[bolt]put err", key, err)
+		return 0, ""
+	}
+	s.FlagDirty()
+	return
+}
+
+func (s *BoltStore) PutIf(key string, ifRev uint64, ifHash string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string, ok bool) {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		keyBuf := []byte(key)
+		if info := s.info(tx, keyBuf); info != nil {
+			rev, hash = info.Rev, info.Hash
+		}
+		if !revMatch(rev, hash, ifRev, ifHash) {
+			return nil
+		}
+		var err error
+		rev, hash, err = s.put(tx, keyBuf, tiddler, hasMacro, filePath)
+		ok = err == nil
+		return err
+	})
+	if err != nil {
+		fmt.Println("[bolt]put err", key, err)
+		return 0, "", false
+	}
+	if ok {
+		s.FlagDirty()
+	}
+	return
+}
+
+// should hold wmx
+func (s *BoltStore) put(tx *bolt.Tx, keyBuf []byte, tiddler *TiddlyWebJSON, hasMacro bool, fp string) (uint64, string, error) {
+	metaB := tx.Bucket(boltMeta)
+	textB := tx.Bucket(boltText)
+
+	var oldText []byte
+	info := s.info(tx, keyBuf)
+	if info == nil {
+		info = &StoreTiddler{}
+		if del := tx.Bucket(boltDeleted).Get(keyBuf); del != nil {
+			info.Rev = s.lastRev(tx, keyBuf)        // continue revision of deleted one
+			info.Seq = binary.BigEndian.Uint64(del) // move change sequence of tombstone
+		}
+	} else {
+		oldMeta := append([]byte(nil), metaB.Get(keyBuf)...)
+		oldText = append([]byte(nil), textB.Get(keyBuf)...)
+
+		// keep old revision
+		old := *info
+		old.Meta = oldMeta
+		old.Text = string(oldText)
+		if err := s.pushHistory(tx, keyBuf, &old); err != nil {
+			return 0, "", err
+		}
+
+		oldTiddler := &TiddlyWebJSON{}
+		if err := json.Unmarshal(oldMeta, oldTiddler); err == nil {
+			if err := s.unindex(tx, keyBuf, oldTiddler); err != nil {
+				return 0, "", err
+			}
+		}
+	}
+
+	// Remove `_is_skinny` field, and keep old text
+	if tiddler.IsSkinny != nil {
+		tiddler.IsSkinny = nil
+		tiddler.Text = string(oldText)
+	}
+
+	// set revision, extract `text` field, build meta and calc hash
+	rev := info.Rev + 1
+	meta, text, hash := encodeMeta(tiddler, rev)
+	if err := s.index(tx, keyBuf, tiddler); err != nil {
+		return 0, "", err
+	}
+
+	// update file ref, counted for each revision
+	if fp != "" {
+		if _, err := s.attachRef(tx, fp, 1); err != nil {
+			return 0, "", err
+		}
+	}
+
+	seq := s.seq + 1
+	if err := s.setSeq(tx, keyBuf, info.Seq, seq); err != nil {
+		return 0, "", err
+	}
+	if err := tx.Bucket(boltDeleted).Delete(keyBuf); err != nil {
+		return 0, "", err
+	}
+
+	info.Rev = rev
+	info.Hash = hash
+	info.File = fp
+	info.HasMacro = hasMacro
+	info.Time = time.Now().UnixNano()
+	info.Seq = seq
+	if err := s.putInfo(tx, keyBuf, info); err != nil {
+		return 0, "", err
+	}
+	if err := metaB.Put(keyBuf, meta); err != nil {
+		return 0, "", err
+	}
+	if err := textB.Put(keyBuf, []byte(text)); err != nil {
+		return 0, "", err
+	}
+
+	macroB := tx.Bucket(boltMacro)
+	var err error
+	if hasMacro {
+		err = macroB.Put(keyBuf, []byte{})
+	} else {
+		err = macroB.Delete(keyBuf)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	tx.OnCommit(func() {
+		atomic.StoreUint64(&s.seq, seq)
+	})
+	return rev, hash, nil
+}
+
+func (s *BoltStore) putInfo(tx *bolt.Tx, keyBuf []byte, info *StoreTiddler) error {
+	info.Meta = nil
+	info.Text = ""
+	buf, err := encodeTiddler(info)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltInfo).Put(keyBuf, buf)
+}
+
+// move change sequence of tiddler from old to seq
+func (s *BoltStore) setSeq(tx *bolt.Tx, keyBuf []byte, old uint64, seq uint64) error {
+	seqB := tx.Bucket(boltSeq)
+	if old != 0 {
+		if err := seqB.Delete(u64Key(old)); err != nil {
+			return err
+		}
+	}
+	return seqB.Put(u64Key(seq), keyBuf)
+}
+
+// add tag and modified index
+func (s *BoltStore) index(tx *bolt.Tx, keyBuf []byte, tiddler *TiddlyWebJSON) error {
+	if tiddler.Tags != nil {
+		tagsB := tx.Bucket(boltTags)
+		for _, tag := range *tiddler.Tags {
+			if err := tagsB.Put(indexKey(tag, keyBuf), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	if tiddler.Modified != "" {
+		return tx.Bucket(boltModified).Put(indexKey(tiddler.Modified, keyBuf), []byte{})
+	}
+	return nil
+}
+
+func (s *BoltStore) unindex(tx *bolt.Tx, keyBuf []byte, tiddler *TiddlyWebJSON) error {
+	if tiddler.Tags != nil {
+		tagsB := tx.Bucket(boltTags)
+		for _, tag := range *tiddler.Tags {
+			if err := tagsB.Delete(indexKey(tag, keyBuf)); err != nil {
+				return err
+			}
+		}
+	}
+	if tiddler.Modified != "" {
+		return tx.Bucket(boltModified).Delete(indexKey(tiddler.Modified, keyBuf))
+	}
+	return nil
+}
+
+// old revisions, oldest first
+func (s *BoltStore) getHistory(tx *bolt.Tx, keyBuf []byte) []*StoreTiddler {
+	prefix := make([]byte, len(keyBuf)+1)
+	copy(prefix, keyBuf)
+
+	lst := make([]*StoreTiddler, 0, 8)
+	c := tx.Bucket(boltHistory).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if len(k) != len(prefix)+8 {
+			continue
+		}
+		if td := decodeTiddler(v); td != nil {
+			lst = append(lst, td)
+		}
+	}
+	return lst
+}
+
+// copy current revision into history, and drop expired revisions
+func (s *BoltStore) pushHistory(tx *bolt.Tx, keyBuf []byte, td *StoreTiddler) error {
+	if td.Time == 0 {
+		td.Time = time.Now().UnixNano()
+	}
+	buf, err := encodeTiddler(td)
+	if err != nil {
+		return err
+	}
+	historyB := tx.Bucket(boltHistory)
+	if err := historyB.Put(historyKey(keyBuf, td.Rev), buf); err != nil {
+		return err
+	}
+	_, err = s.dropHistory(tx, keyBuf)
+	return err
+}
+
+// drop expired revisions by RevisionPolicy, return count of kept revisions
+func (s *BoltStore) dropHistory(tx *bolt.Tx, keyBuf []byte) (int, error) {
+	historyB := tx.Bucket(boltHistory)
+	lst := s.getHistory(tx, keyBuf)
+	saved := make([]int64, len(lst))
+	for i, h := range lst {
+		saved[i] = h.Time
+	}
+	drop := s.dropCount(saved)
+	for _, h := range lst[:drop] {
+		if err := historyB.Delete(historyKey(keyBuf, h.Rev)); err != nil {
+			return 0, err
+		}
+		if h.File != "" {
+			if _, err := s.attachRef(tx, h.File, -1); err != nil { // unused file is removed by Sweep()
+				return 0, err
+			}
+		}
+	}
+	return len(lst) - drop, nil
+}
+
+// newest revision in history, 0 for none
+func (s *BoltStore) lastRev(tx *bolt.Tx, keyBuf []byte) uint64 {
+	prefix := make([]byte, len(keyBuf)+1)
+	copy(prefix, keyBuf)
+
+	rev := uint64(0)
+	c := tx.Bucket(boltHistory).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if len(k) == len(prefix)+8 {
+			rev = binary.BigEndian.Uint64(k[len(prefix):]) // ordered by key
+		}
+	}
+	return rev
+}
+
+// remove attachment file at api
+func (s *BoltStore) Del(key string) (ok bool, file string) {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		keyBuf := []byte(key)
+		info := s.info(tx, keyBuf)
+		if info == nil {
+			return nil
+		}
+
+		// keep deleted revision
+		old := *info
+		old.Meta = append([]byte(nil), tx.Bucket(boltMeta).Get(keyBuf)...)
+		old.Text = string(tx.Bucket(boltText).Get(keyBuf))
+		if err := s.pushHistory(tx, keyBuf, &old); err != nil {
+			return err
+		}
+
+		oldTiddler := &TiddlyWebJSON{}
+		if err := json.Unmarshal(old.Meta, oldTiddler); err == nil {
+			if err := s.unindex(tx, keyBuf, oldTiddler); err != nil {
+				return err
+			}
+		}
+		for _, name := range [][]byte{boltMeta, boltText, boltInfo, boltMacro} {
+			if err := tx.Bucket(name).Delete(keyBuf); err != nil {
+				return err
+			}
+		}
+
+		// tombstone
+		seq := s.seq + 1
+		if err := s.setSeq(tx, keyBuf, info.Seq, seq); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltDeleted).Put(keyBuf, u64Key(seq)); err != nil {
+			return err
+		}
+
+		// remove file only if not used by any kept revision
+		if info.File != "" && isZeroKey(tx.Bucket(boltAttach).Get([]byte(info.File))) {
+			if err := tx.Bucket(boltAttach).Delete([]byte(info.File)); err != nil {
+				return err
+			}
+			file = info.File
+		}
+
+		tx.OnCommit(func() {
+			atomic.StoreUint64(&s.seq, seq)
+		})
+		ok = true
+		return nil
+	})
+	if err != nil {
+		fmt.Println("[bolt]del err", key, err)
+		return false, ""
+	}
+
+	// flag dirty
+	if ok {
+		s.FlagDirty()
+	}
+	return ok, file
+}
+
+func (s *BoltStore) AttachAttachment(key string, file string) bool {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+
+	ok := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		keyBuf := []byte(key)
+		info := s.info(tx, keyBuf)
+		if info == nil {
+			return nil
+		}
+		// calc file ref, for current revision only
+		if info.File != "" {
+			if _, err := s.attachRef(tx, info.File, -1); err != nil {
+				return err
+			}
+		}
+		if _, err := s.attachRef(tx, file, 1); err != nil {
+			return err
+		}
+		info.File = file
+		if err := s.putInfo(tx, keyBuf, info); err != nil {
+			return err
+		}
+		ok = true
+		return nil
+	})
+	return err == nil && ok
+}
+
+// reference count of attachment file from all kept revisions
+// unused file is kept with count 0 until Sweep()
+func (s *BoltStore) attachRef(tx *bolt.Tx, file string, delta int) (int64, error) {
+	attachB := tx.Bucket(boltAttach)
+	fnBuf := []byte(file)
+	count := int64(0)
+	if buf := attachB.Get(fnBuf); len(buf) == 8 {
+		count = int64(binary.BigEndian.Uint64(buf))
+	}
+	count += int64(delta)
+	if count < 0 {
+		count = 0
+	}
+	return count, attachB.Put(fnBuf, u64Key(uint64(count)))
+}
+
+func (s *BoltStore) Sweep() (files []string) {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		files = make([]string, 0)
+		deletedB := tx.Bucket(boltDeleted)
+		seqB := tx.Bucket(boltSeq)
+		attachB := tx.Bucket(boltAttach)
+
+		// can not change bucket in ForEach
+		tombs := make([][]byte, 0)
+		deletedB.ForEach(func(k, v []byte) error {
+			if !bytes.Equal(k, sweptKey) {
+				tombs = append(tombs, append([]byte(nil), k...))
+			}
+			return nil
+		})
+
+		swept := s.swept
+		for _, keyBuf := range tombs {
+			kept, err := s.dropHistory(tx, keyBuf)
+			if err != nil {
+				return err
+			}
+			if kept > 0 {
+				continue
+			}
+			seq := binary.BigEndian.Uint64(deletedB.Get(keyBuf))
+			if err := seqB.Delete(u64Key(seq)); err != nil {
+				return err
+			}
+			if err := deletedB.Delete(keyBuf); err != nil {
+				return err
+			}
+			if seq > swept {
+				swept = seq
+			}
+		}
+		if swept != s.swept {
+			if err := deletedB.Put(sweptKey, u64Key(swept)); err != nil {
+				return err
+			}
+		}
+
+		attachB.ForEach(func(k, v []byte) error {
+			if isZeroKey(v) {
+				files = append(files, string(k))
+			}
+			return nil
+		})
+		for _, file := range files {
+			if err := attachB.Delete([]byte(file)); err != nil {
+				return err
+			}
+		}
+
+		tx.OnCommit(func() {
+			atomic.StoreUint64(&s.swept, swept)
+		})
+		return nil
+	})
+	if err != nil {
+		fmt.Println("[bolt]sweep err", err)
+		return nil
+	}
+	return files
+}
+
+func (s *BoltStore) SweptSeq() uint64 {
+	return atomic.LoadUint64(&s.swept)
+}
+
+// titles tagged with tag, sorted by title
+func (s *BoltStore) Tagged(tag string) []string {
+	out := make([]string, 0, 8)
+	s.db.View(func(tx *bolt.Tx) error {
+		prefix := indexKey(tag, nil)
+		c := tx.Bucket(boltTags).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			out = append(out, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	return out
+}
+
+// titles sorted by `modified` field, newest first, 0 for no limit
+// tiddlers without `modified` field are not included
+func (s *BoltStore) Recent(limit int) []string {
+	out := make([]string, 0, 8)
+	s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltModified).Cursor()
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			if limit > 0 && len(out) >= limit {
+				break
+			}
+			if i := bytes.IndexByte(k, 0); i >= 0 {
+				out = append(out, string(k[i+1:]))
+			}
+		}
+		return nil
+	})
+	return out
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// key for index bucket: value + '\x00' + title
+func indexKey(val string, keyBuf []byte) []byte {
+	buf := make([]byte, 0, len(val)+1+len(keyBuf))
+	buf = append(buf, val...)
+	buf = append(buf, 0)
+	return append(buf, keyBuf...)
+}
+
+// big endian for ordered key
+func u64Key(v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	return buf
+}
+
+func NewBoltStore(fp string) (*BoltStore, error) {
+	db, err := bolt.Open(fp, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BoltStore{
+		db: db,
+		RevisionPolicy: RevisionPolicy{
+			MaxCount: DefaultRevisionCount,
+		},
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		// last change sequence
+		if k, _ := tx.Bucket(boltSeq).Cursor().Last(); k != nil {
+			s.seq = binary.BigEndian.Uint64(k)
+		}
+
+		if v := tx.Bucket(boltDeleted).Get(sweptKey); len(v) == 8 {
+			s.swept = binary.BigEndian.Uint64(v)
+			if s.swept > s.seq {
+				s.seq = s.swept
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// zero reference count
+func isZeroKey(countBuf []byte) bool {
+	return len(countBuf) == 8 && binary.BigEndian.Uint64(countBuf) == 0
+}
+
+// make sure BoltStore implement Store, Indexer & Sweeper
+var _ Store = (*BoltStore)(nil)
+var _ Indexer = (*BoltStore)(nil)
+var _ Sweeper = (*BoltStore)(nil)
@@ -0,0 +1,693 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// keep revision, change sequence and deleted tiddlers, not tiddler data
+	FileStoreStateName = ".tiddlywikid.json"
+
+	// how often to write back state file
+	FileStoreStateInterval = 2 * time.Second
+
+	// max length of file name, without extension
+	FileStoreMaxNameLength = 200
+)
+
+// keep each tiddler as a `.tid` or `.json` file, same layout as `tiddlers/` folder of TiddlyWiki on Node.js
+// all tiddlers are also kept in memory, old revisions are not written to disk
+// tiddler in multi-tiddler `.json` file is moved to its own file when changed
+type FileStore struct {
+	*MemStore
+
+	dir   string
+	wmx   sync.Mutex // serialize file writes
+	state *fileStoreState
+	paths map[string]string // lower case path -> title, for unique file name
+	dirty int32             // state need write back
+	die   chan struct{}
+	done  chan struct{}
+}
+
+type fileStoreState struct {
+	Seq      uint64                `json:"seq"`
+	Tiddlers map[string]*fileState `json:"tiddlers"`
+	Deleted  map[string]uint64     `json:"deleted,omitempty"`
+	Swept    uint64                `json:"swept,omitempty"` // change sequence of newest dropped tombstone
+}
+
+type fileState struct {
+	Path   string `json:"path"`             // relative to store dir, with `/`
+	Shared bool   `json:"shared,omitempty"` // from multi-tiddler `.json` file
+	Hash   string `json:"hash"`             // hash of file content, to find out changes by other program
+	Rev    uint64 `json:"rev"`
+	Seq    uint64 `json:"seq"`
+	File   string `json:"file,omitempty"` // external attachment
+}
+
+// tiddlers read from a file
+type fileEntry struct {
+	path    string
+	shared  bool
+	hash    string
+	modTime time.Time
+	fields  map[string]string
+}
+
+func (s *FileStore) Put(key string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string) {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+	rev, hash = s.MemStore.Put(key, tiddler, hasMacro, filePath)
+	s.save(key)
+	return
+}
+
+func (s *FileStore) PutIf(key string, ifRev uint64, ifHash string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string, ok bool) {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+	rev, hash, ok = s.MemStore.PutIf(key, ifRev, ifHash, tiddler, hasMacro, filePath)
+	if ok {
+		s.save(key)
+	}
+	return
+}
+
+func (s *FileStore) Del(key string) (bool, string) {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+	ok, file := s.MemStore.Del(key)
+	if ok {
+		s.remove(key)
+	}
+	return ok, file
+}
+
+func (s *FileStore) AttachAttachment(key string, file string) bool {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+	ok := s.MemStore.AttachAttachment(key, file)
+	if st, found := s.state.Tiddlers[key]; ok && found {
+		st.File = file
+		atomic.StoreInt32(&s.dirty, 1)
+	}
+	return ok
+}
+
+// drop tombstones in state file too
+func (s *FileStore) Sweep() []string {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+	files := s.MemStore.Sweep()
+
+	s.mx.RLock()
+	for key := range s.state.Deleted {
+		if _, ok := s.deleted[key]; !ok {
+			delete(s.state.Deleted, key)
+		}
+	}
+	s.state.Swept = s.swept
+	s.mx.RUnlock()
+	atomic.StoreInt32(&s.dirty, 1)
+	return files
+}
+
+// write tiddler to file, should hold wmx
+func (s *FileStore) save(key string) {
+	s.mx.RLock()
+	td, ok := s.kv[key]
+	if !ok {
+		s.mx.RUnlock()
+		return
+	}
+	tiddler := td.toTiddler(true)
+	rev, seq, file := td.rev, td.seq, td.file
+	s.state.Seq = s.seq
+	s.mx.RUnlock()
+	if tiddler == nil {
+		return
+	}
+
+	buf, ext := encodeTiddlerFile(tiddler.ToFields())
+	st := s.state.Tiddlers[key]
+	rel := ""
+	if st != nil && !st.Shared && strings.HasSuffix(st.Path, ext) {
+		rel = st.Path
+	} else {
+		rel = s.newPath(key, ext)
+	}
+
+	err := writeFileAtomic(filepath.Join(s.dir, filepath.FromSlash(rel)), buf)
+	if err != nil {
+		fmt.Println("[files]write err", key, err)
+		return
+	}
+
+	// format changed, remove old file
+	if st != nil && st.Path != rel {
+		if st.Shared {
+			s.dropShared(st.Path, key)
+		} else {
+			s.removeFile(st.Path)
+		}
+	}
+
+	s.state.Tiddlers[key] = &fileState{
+		Path: rel,
+		Hash: hashBytes(buf),
+		Rev:  rev,
+		Seq:  seq,
+		File: file,
+	}
+	delete(s.state.Deleted, key)
+	atomic.StoreInt32(&s.dirty, 1)
+}
+
+// remove file of deleted tiddler, should hold wmx
+func (s *FileStore) remove(key string) {
+	s.mx.RLock()
+	seq := s.deleted[key]
+	s.state.Seq = s.seq
+	s.mx.RUnlock()
+
+	if st, ok := s.state.Tiddlers[key]; ok {
+		if st.Shared {
+			s.dropShared(st.Path, key)
+		} else {
+			s.removeFile(st.Path)
+		}
+		delete(s.state.Tiddlers, key)
+	}
+	s.state.Deleted[key] = seq
+	atomic.StoreInt32(&s.dirty, 1)
+}
+
+func (s *FileStore) removeFile(rel string) {
+	delete(s.paths, strings.ToLower(rel))
+	fp := filepath.Join(s.dir, filepath.FromSlash(rel))
+	if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+		fmt.Println("[files]remove err", rel, err)
+	}
+	// binary file with `.meta`
+	if strings.HasSuffix(fp, ".meta") {
+		os.Remove(strings.TrimSuffix(fp, ".meta"))
+	}
+}
+
+// remove a tiddler from multi-tiddler `.json` file, should hold wmx
+func (s *FileStore) dropShared(rel string, title string) {
+	fp := filepath.Join(s.dir, filepath.FromSlash(rel))
+	buf, err := os.ReadFile(fp)
+	if err != nil {
+		return
+	}
+	var lst []map[string]interface{}
+	if err := json.Unmarshal(buf, &lst); err != nil {
+		return
+	}
+	out := lst[:0]
+	for _, js := range lst {
+		if t, _ := js["title"].(string); t != title {
+			out = append(out, js)
+		}
+	}
+	if len(out) == 0 {
+		s.removeFile(rel)
+		return
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "    ")
+	enc.Encode(out)
+	buf = bytes.TrimRight(b.Bytes(), "\n")
+	if err := writeFileAtomic(fp, buf); err != nil {
+		fmt.Println("[files]write err", rel, err)
+		return
+	}
+
+	// other tiddlers in same file
+	hash := hashBytes(buf)
+	for t, st := range s.state.Tiddlers {
+		if st.Path == rel && t != title {
+			st.Hash = hash
+			st.Shared = len(out) > 1
+		}
+	}
+}
+
+// unique file path for title, should hold wmx
+func (s *FileStore) newPath(title string, ext string) string {
+	name := sanitizeFileName(title)
+	for i := 0; ; i++ {
+		rel := name + ext
+		if i > 0 {
+			rel = name + " " + strconv.Itoa(i) + ext
+		}
+		lower := strings.ToLower(rel)
+		owner, ok := s.paths[lower]
+		if ok && owner != title {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(s.dir, rel)); !ok && err == nil {
+			continue // not our file
+		}
+		s.paths[lower] = title
+		return rel
+	}
+}
+
+var (
+	reFileNameUnsafe = regexp.MustCompile(`[/\\<>~:"|?*^\x00-\x1f\x7f]`)
+	reFileNameDots   = regexp.MustCompile(`^[.\s]+`)
+)
+
+// same idea as `$tw.utils.generateTiddlerFilepath()` without path filters
+func sanitizeFileName(title string) string {
+	name := reFileNameUnsafe.ReplaceAllString(title, "_")
+	name = reFileNameDots.ReplaceAllStringFunc(name, func(str string) string {
+		return strings.Repeat("_", len(str))
+	})
+	name = strings.TrimSpace(name)
+	if len(name) > FileStoreMaxNameLength {
+		cut := FileStoreMaxNameLength
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = name[:cut]
+	}
+	if name == "" {
+		name = "_"
+	}
+	return name
+}
+
+// `.tid` for text tiddler, `.json` if any field can not be kept in `.tid`
+func encodeTiddlerFile(fields map[string]string) ([]byte, string) {
+	if IsTextType(fields["type"]) && !hasUnsafeFields(fields) {
+		var b bytes.Buffer
+		for _, k := range SortedFieldNames(fields) {
+			if k == "text" {
+				continue
+			}
+			b.WriteString(k)
+			b.WriteString(": ")
+			b.WriteString(fields[k])
+			b.WriteByte('\n')
+		}
+		if text := fields["text"]; text != "" {
+			b.WriteByte('\n')
+			b.WriteString(text)
+		}
+		return b.Bytes(), ".tid"
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "    ")
+	enc.Encode([]map[string]string{fields})
+	return bytes.TrimRight(b.Bytes(), "\n"), ".json"
+}
+
+// same check as TiddlyWiki on Node.js
+func hasUnsafeFields(fields map[string]string) bool {
+	for k, v := range fields {
+		if strings.Contains(k, ":") {
+			return true
+		}
+		if k == "text" {
+			continue
+		}
+		if strings.TrimSpace(v) != v {
+			return true
+		}
+		for i := 0; i < len(v); i++ {
+			if v[i] < 0x20 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var reTidSplit = regexp.MustCompile(`\r?\n\r?\n`)
+
+// header fields, blank line, then text
+func parseTid(buf []byte) map[string]string {
+	str := string(buf)
+	fields := make(map[string]string)
+	header := str
+	if loc := reTidSplit.FindStringIndex(str); loc != nil {
+		header = str[:loc[0]]
+		fields["text"] = str[loc[1]:]
+	}
+	parseFieldLines(header, fields)
+	return fields
+}
+
+// `name: value` per line, for `.tid` header and `.meta`
+func parseFieldLines(str string, fields map[string]string) {
+	for _, line := range strings.Split(str, "\n") {
+		p := strings.IndexByte(line, ':')
+		if p < 0 {
+			continue
+		}
+		k := strings.TrimSpace(line[:p])
+		if k == "" {
+			continue
+		}
+		fields[k] = strings.TrimSpace(line[p+1:])
+	}
+}
+
+func hashBytes(bufs ...[]byte) string {
+	h := sha256.New()
+	for _, buf := range bufs {
+		h.Write(buf)
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func writeFileAtomic(fp string, buf []byte) error {
+	dir, name := filepath.Split(fp)
+	tmp, err := os.CreateTemp(dir, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fp)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// read all tiddler files under dir, hidden files and folders are skipped
+func readTiddlerFiles(dir string) ([]*fileEntry, error) {
+	all := make(map[string]bool)
+	err := filepath.WalkDir(dir, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && fp != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			all[fp] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*fileEntry, 0, len(all))
+	for fp := range all {
+		if all[fp+".meta"] || filepath.Base(fp) == "tiddlywiki.files" {
+			continue // binary file read with `.meta`
+		}
+		ext := filepath.Ext(fp)
+		if ext != ".tid" && ext != ".json" && ext != ".meta" {
+			continue
+		}
+
+		info, err := os.Stat(fp)
+		if err != nil {
+			continue
+		}
+		buf, err := os.ReadFile(fp)
+		if err != nil {
+			fmt.Println("[files]read err", fp, err)
+			continue
+		}
+		rel, _ := filepath.Rel(dir, fp)
+		entry := &fileEntry{
+			path:    filepath.ToSlash(rel),
+			hash:    hashBytes(buf),
+			modTime: info.ModTime(),
+		}
+		name := strings.TrimSuffix(filepath.Base(fp), ext)
+
+		switch ext {
+		case ".tid":
+			entry.fields = parseTid(buf)
+			if entry.fields["title"] == "" {
+				entry.fields["title"] = name
+			}
+			out = append(out, entry)
+
+		case ".meta":
+			bin, err := os.ReadFile(strings.TrimSuffix(fp, ".meta"))
+			if err != nil {
+				continue
+			}
+			entry.hash = hashBytes(buf, bin)
+			entry.fields = make(map[string]string)
+			parseFieldLines(string(buf), entry.fields)
+			if entry.fields["title"] == "" {
+				entry.fields["title"] = name
+			}
+			if entry.fields["type"] == "" {
+				typ, _, _ := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(name)))
+				entry.fields["type"] = typ
+			}
+			if IsTextType(entry.fields["type"]) {
+				entry.fields["text"] = string(bin)
+			} else {
+				entry.fields["text"] = base64.StdEncoding.EncodeToString(bin)
+			}
+			out = append(out, entry)
+
+		case ".json":
+			lst, err := ParseJSONTiddlers(buf)
+			if err != nil {
+				fmt.Println("[files]parse err", fp, err)
+				continue
+			}
+			for _, fields := range lst {
+				if fields["title"] == "" {
+					continue
+				}
+				out = append(out, &fileEntry{
+					path:    entry.path,
+					shared:  len(lst) > 1,
+					hash:    entry.hash,
+					modTime: entry.modTime,
+					fields:  fields,
+				})
+			}
+		}
+	}
+	return out, nil
+}
+
+func (s *FileStore) load() error {
+	state := &fileStoreState{}
+	if buf, err := os.ReadFile(filepath.Join(s.dir, FileStoreStateName)); err == nil {
+		if err := json.Unmarshal(buf, state); err != nil {
+			fmt.Println("[files]state err", err)
+		}
+	}
+	if state.Tiddlers == nil {
+		state.Tiddlers = make(map[string]*fileState)
+	}
+	if state.Deleted == nil {
+		state.Deleted = make(map[string]uint64)
+	}
+
+	entries, err := readTiddlerFiles(s.dir)
+	if err != nil {
+		return err
+	}
+
+	// pick one file for each title: single file first, then the one in state
+	picked := make(map[string]*fileEntry)
+	for _, entry := range entries {
+		title := entry.fields["title"]
+		old, ok := picked[title]
+		if ok {
+			st := state.Tiddlers[title]
+			switch {
+			case old.shared != entry.shared:
+				ok = !old.shared
+			case st != nil && (old.path == st.Path || entry.path == st.Path):
+				ok = old.path == st.Path
+			default:
+				ok = old.path < entry.path
+			}
+		}
+		if !ok {
+			picked[title] = entry
+		}
+	}
+
+	seq := state.Seq
+	nkv := make(map[string]*memTiddler, len(picked))
+	fRef := make(map[string]int)
+	nState := make(map[string]*fileState, len(picked))
+	paths := make(map[string]string, len(picked))
+	for title, entry := range picked {
+		st := state.Tiddlers[title]
+		rev, tseq, file := uint64(1), uint64(0), ""
+		if st != nil {
+			file = st.File
+			if st.Path == entry.path && st.Hash == entry.hash {
+				rev, tseq = st.Rev, st.Seq
+			} else {
+				rev = st.Rev + 1
+			}
+		}
+		if tseq == 0 {
+			seq++
+			tseq = seq
+		}
+
+		tiddler := NewTiddlerFromFields(entry.fields)
+		meta, text, hash := encodeMeta(tiddler, rev)
+		nkv[title] = &memTiddler{
+			rev:      rev,
+			meta:     meta,
+			text:     text,
+			hash:     hash,
+			file:     file,
+			hasMacro: hasTag(tiddler, "$:/tags/Macro"),
+			time:     entry.modTime.UnixNano(),
+			seq:      tseq,
+		}
+		if file != "" {
+			fRef[file] += 1
+		}
+		nState[title] = &fileState{
+			Path:   entry.path,
+			Shared: entry.shared,
+			Hash:   entry.hash,
+			Rev:    rev,
+			Seq:    tseq,
+			File:   file,
+		}
+		paths[strings.ToLower(entry.path)] = title
+	}
+
+	// removed by other program
+	nDel := make(map[string]uint64)
+	for title, tseq := range state.Deleted {
+		if _, ok := nkv[title]; !ok {
+			nDel[title] = tseq
+		}
+	}
+	for title := range state.Tiddlers {
+		if _, ok := nkv[title]; !ok {
+			seq++
+			nDel[title] = seq
+		}
+	}
+
+	if state.Swept > seq {
+		seq = state.Swept
+	}
+	state.Seq = seq
+	state.Tiddlers = nState
+	state.Deleted = nDel
+
+	s.mx.Lock()
+	s.kv = nkv
+	s.fileRef = fRef
+	s.deleted = nDel
+	s.gone = make(map[string]*memTiddler) // old revisions are not kept on disk
+	s.seq = seq
+	s.swept = state.Swept
+	s.mx.Unlock()
+	s.FlagDirty()
+
+	s.state = state
+	s.paths = paths
+	return s.saveState()
+}
+
+func (s *FileStore) saveState() error {
+	s.wmx.Lock()
+	buf, err := json.MarshalIndent(s.state, "", "\t")
+	s.wmx.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, FileStoreStateName), buf)
+}
+
+func (s *FileStore) loop() {
+	defer close(s.done)
+	ticker := time.NewTicker(FileStoreStateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if atomic.CompareAndSwapInt32(&s.dirty, 1, 0) {
+				if err := s.saveState(); err != nil {
+					fmt.Println("[files]state err", err)
+				}
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// write back state file
+func (s *FileStore) Close() error {
+	close(s.die)
+	<-s.done
+	return s.saveState()
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{
+		MemStore: NewMemStore(),
+		dir:      dir,
+		die:      make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+	go s.loop()
+	return s, nil
+}
+
+// make sure FileStore implement Store
+var _ Store = (*FileStore)(nil)
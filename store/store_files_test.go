@@ -0,0 +1,166 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openFileStore(t *testing.T, dir string) *FileStore {
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func writeTestFile(t *testing.T, fp string, data string) {
+	if err := os.WriteFile(fp, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileExist(dir string, rel string) bool {
+	_, err := os.Stat(filepath.Join(dir, rel))
+	return err == nil
+}
+
+func TestFileStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStore(t, dir)
+	s.Put("A", &TiddlyWebJSON{Title: "A", Text: "a"}, false, "")
+	s.Put("B", &TiddlyWebJSON{Title: "B", Text: "b"}, false, "")
+	s.Close()
+
+	// edit by other program
+	writeTestFile(t, filepath.Join(dir, "A.tid"), "title: A\n\nedited")
+	s = openFileStore(t, dir)
+	a, _ := s.Get("A")
+	if a == nil || a.Text != "edited" || a.Rev != 2 {
+		t.Fatal("edited file should be loaded as new revision", a)
+	}
+	if b, _ := s.Get("B"); b == nil || b.Rev != 1 {
+		t.Fatal("unchanged file should keep revision", b)
+	}
+	buf, seq := s.ListSince(nil, 2)
+	if lst := listTitles(t, buf); seq != 3 || len(lst) != 1 || lst["A"] == nil {
+		t.Fatal("edited one should be listed as changed", string(buf), seq)
+	}
+	s.Close()
+
+	// removed by other program
+	os.Remove(filepath.Join(dir, "B.tid"))
+	s = openFileStore(t, dir)
+	defer s.Close()
+	if b, _ := s.Get("B"); b != nil {
+		t.Fatal("removed file should not be loaded", b)
+	}
+	if buf, _ := s.ListSince(nil, 3); string(buf) != `[{"title":"B","_is_deleted":true}]` {
+		t.Fatal("removed one should be listed as deleted", string(buf))
+	}
+}
+
+func TestFileStoreDropShared(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "all.json"), `[{"title":"A","text":"a"},{"title":"B","text":"b"},{"title":"C","text":"c"}]`)
+	titles := func() []string {
+		buf, err := os.ReadFile(filepath.Join(dir, "all.json"))
+		if err != nil {
+			return nil
+		}
+		var lst []map[string]string
+		if err := json.Unmarshal(buf, &lst); err != nil {
+			t.Fatal("bad shared file", string(buf), err)
+		}
+		out := make([]string, 0, len(lst))
+		for _, fields := range lst {
+			out = append(out, fields["title"])
+		}
+		return out
+	}
+
+	s := openFileStore(t, dir)
+	if c, _ := s.Get("C"); c == nil || c.Text != "c" {
+		t.Fatal("tiddler in shared file should be loaded", c)
+	}
+
+	// changed one is moved to its own file
+	s.Put("A", &TiddlyWebJSON{Title: "A", Text: "a2"}, false, "")
+	if lst := titles(); len(lst) != 2 || lst[0] != "B" || lst[1] != "C" || !fileExist(dir, "A.tid") {
+		t.Fatal("A should be moved out of shared file", lst)
+	}
+	s.Del("B")
+	if lst := titles(); len(lst) != 1 || lst[0] != "C" {
+		t.Fatal("B should be dropped from shared file", lst)
+	}
+	s.Close()
+
+	// rest one is not changed by rewrite of shared file
+	s = openFileStore(t, dir)
+	defer s.Close()
+	if c, _ := s.Get("C"); c == nil || c.Rev != 1 {
+		t.Fatal("revision should be kept after shared file rewrite", c)
+	}
+	s.Del("C")
+	if fileExist(dir, "all.json") {
+		t.Fatal("empty shared file should be removed")
+	}
+}
+
+func TestFileStoreFormat(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStore(t, dir)
+	s.Put("A", &TiddlyWebJSON{Title: "A", Text: "a"}, false, "")
+	if !fileExist(dir, "A.tid") {
+		t.Fatal("text tiddler should be saved as .tid")
+	}
+
+	// binary type can not be kept in `.tid`
+	s.Put("A", &TiddlyWebJSON{Title: "A", Text: "cG5n", Type: "image/png"}, false, "")
+	if !fileExist(dir, "A.json") || fileExist(dir, "A.tid") {
+		t.Fatal("binary tiddler should be saved as .json only")
+	}
+	s.Put("A", &TiddlyWebJSON{Title: "A", Text: "a"}, false, "")
+	if !fileExist(dir, "A.tid") || fileExist(dir, "A.json") {
+		t.Fatal("text tiddler should be saved as .tid only")
+	}
+	s.Close()
+
+	s = openFileStore(t, dir)
+	defer s.Close()
+	if a, _ := s.Get("A"); a == nil || a.Text != "a" || a.Rev != 3 {
+		t.Fatal("tiddler should be kept after format change", a)
+	}
+}
+
+func TestFileStoreMeta(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "logo.png"), "png")
+	writeTestFile(t, filepath.Join(dir, "logo.png.meta"), "title: Logo\ntags: image\n")
+	writeTestFile(t, filepath.Join(dir, "note.txt"), "plain")
+	writeTestFile(t, filepath.Join(dir, "note.txt.meta"), "title: Note\n")
+
+	s := openFileStore(t, dir)
+	defer s.Close()
+	logo, _ := s.Get("Logo")
+	if logo == nil || logo.Type != "image/png" || logo.Text != "cG5n" {
+		t.Fatal("binary file should be loaded as base64 with type from extension", logo)
+	}
+	if note, _ := s.Get("Note"); note == nil || note.Text != "plain" {
+		t.Fatal("text file should be loaded as is", note)
+	}
+	if lst := listTitles(t, s.List(nil, false)); len(lst) != 2 {
+		t.Fatal("binary file should not be loaded alone", lst)
+	}
+
+	// both files are removed
+	s.Del("Logo")
+	if fileExist(dir, "logo.png.meta") || fileExist(dir, "logo.png") {
+		t.Fatal("binary file and .meta should be removed")
+	}
+	s.Put("Note", &TiddlyWebJSON{Title: "Note", Text: "edited", Type: "text/plain"}, false, "")
+	if fileExist(dir, "note.txt.meta") || fileExist(dir, "note.txt") || !fileExist(dir, "Note.tid") {
+		t.Fatal("changed one should be moved to .tid")
+	}
+}
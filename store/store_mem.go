@@ -2,22 +2,28 @@ package store
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // for early stage dev only
 type MemStore struct {
 	mx      sync.RWMutex
 	kv      map[string]*memTiddler
-	fileRef map[string]int
+	fileRef map[string]int    // 0 for unused file, removed by Sweep()
+	deleted map[string]uint64 // tombstone: title -> change sequence
+	seq     uint64            // change sequence
+	swept   uint64            // change sequence of newest dropped tombstone
+
+	// deleted tiddlers with kept old revisions, only rev and history are set
+	gone map[string]*memTiddler
 
 	ListCacheState
+	RevisionPolicy
 }
 
 // meta should contain `title` (the key)
@@ -28,6 +34,11 @@ type dumpTiddler struct {
 	HasMacro bool   `json:"macro,omitempty"`
 	Hash     string `json:"hash,omitempty"`
 	File     string `json:"file,omitempty"`
+	Time     int64  `json:"time,omitempty"`
+	Seq      uint64 `json:"seq,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"` // tombstone
+
+	History []*dumpTiddler `json:"history,omitempty"` // old revisions, oldest first
 }
 
 type memTiddler struct {
@@ -37,6 +48,26 @@ type memTiddler struct {
 	hash     string // md5? sha1? sha256?
 	file     string // external attachment
 	hasMacro bool   // `$:/tags/Macro` tag need to send `text` in skinny tiddler
+	time     int64  // save time in unix nano
+	seq      uint64 // change sequence
+
+	history []*memTiddler // old revisions, oldest first
+}
+
+func (td *memTiddler) toTiddler(withText bool) *TiddlyWebJSON {
+	tiddler := &TiddlyWebJSON{}
+	err := json.Unmarshal(td.meta, tiddler)
+	if err != nil {
+		// ????
+		return nil
+	}
+
+	// set default value & add text back
+	tiddler.Rev = td.rev
+	if withText {
+		tiddler.Text = td.text
+	}
+	return tiddler
 }
 
 func (s *MemStore) putText(td *memTiddler) ([]byte, error) {
@@ -116,6 +147,48 @@ func (s *MemStore) list(full bool) ([]byte, bool) {
 	return b.Bytes(), hasOutput
 }
 
+func (s *MemStore) ListSince(ap []*TiddlyWebJSON, since uint64) ([]byte, uint64) {
+	var b bytes.Buffer
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	hasOutput := false
+	b.WriteByte('[')
+	for _, td := range s.kv {
+		if td.seq <= since {
+			continue
+		}
+		buf := td.meta
+		if td.hasMacro {
+			var err error
+			buf, err = s.putText(td)
+			if err != nil {
+				continue
+			}
+		}
+		if hasOutput {
+			b.WriteByte(',')
+		}
+		b.Write(buf)
+		hasOutput = true
+	}
+	for key, seq := range s.deleted {
+		if seq <= since {
+			continue
+		}
+		hasOutput = writeTombstone(&b, key, hasOutput)
+	}
+
+	return buildTiddlerList(b.Bytes(), hasOutput, ap), s.seq
+}
+
+func (s *MemStore) Seq() uint64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.seq
+}
+
 func (s *MemStore) Get(key string) (*TiddlyWebJSON, string) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
@@ -125,16 +198,10 @@ func (s *MemStore) Get(key string) (*TiddlyWebJSON, string) {
 		return nil, ""
 	}
 
-	tiddler := &TiddlyWebJSON{}
-	err := json.Unmarshal(td.meta, tiddler)
-	if err != nil {
-		// ????
+	tiddler := td.toTiddler(true)
+	if tiddler == nil {
 		return nil, ""
 	}
-
-	// set default value & add text back
-	tiddler.Rev = td.rev
-	tiddler.Text = td.text
 	// if tiddler.Bag == "" {
 	// 	tiddler.Bag = "default"
 	// }
@@ -145,63 +212,144 @@ func (s *MemStore) Get(key string) (*TiddlyWebJSON, string) {
 	return tiddler, td.hash
 }
 
+func (s *MemStore) Each(fn func(tiddler *TiddlyWebJSON, hash string) bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	for _, td := range s.kv {
+		tiddler := td.toTiddler(true)
+		if tiddler == nil {
+			continue
+		}
+		if !fn(tiddler, td.hash) {
+			return
+		}
+	}
+}
+
+func (s *MemStore) Revisions(key string) []*TiddlyWebJSON {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	td, ok := s.kv[key]
+	if !ok {
+		td, ok = s.gone[key]
+		if !ok || len(td.history) == 0 {
+			return nil
+		}
+	}
+
+	out := make([]*TiddlyWebJSON, 0, len(td.history)+1)
+	if td.meta != nil {
+		if tiddler := td.toTiddler(false); tiddler != nil {
+			out = append(out, tiddler)
+		}
+	}
+	for i := len(td.history) - 1; i >= 0; i-- {
+		if tiddler := td.history[i].toTiddler(false); tiddler != nil {
+			out = append(out, tiddler)
+		}
+	}
+	return out
+}
+
+func (s *MemStore) GetRevision(key string, rev uint64) (*TiddlyWebJSON, string) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	cur, ok := s.kv[key]
+	if !ok {
+		cur, ok = s.gone[key]
+		if !ok {
+			return nil, ""
+		}
+	}
+	td := cur
+	if cur.rev != rev || cur.meta == nil {
+		td = nil
+		for _, old := range cur.history {
+			if old.rev == rev {
+				td = old
+				break
+			}
+		}
+		if td == nil {
+			return nil, ""
+		}
+	}
+
+	tiddler := td.toTiddler(true)
+	if tiddler == nil {
+		return nil, ""
+	}
+	return tiddler, td.hash
+}
+
 // need to do:
 // Remove any revision field
 // Remove `_is_skinny` field, and keep old text
 // Extract `text` field
 func (s *MemStore) Put(key string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string) {
-	s.mx.RLock()
+	// need write lock for revision history
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.put(key, tiddler, hasMacro, filePath)
+}
+
+func (s *MemStore) PutIf(key string, ifRev uint64, ifHash string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string, ok bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
 	if td, ok := s.kv[key]; ok {
-		rev, hash = s.putExist(td, tiddler, hasMacro, filePath, 0)
-		s.mx.RUnlock()
-		return
+		rev, hash = td.rev, td.hash
 	}
-	s.mx.RUnlock()
+	if !revMatch(rev, hash, ifRev, ifHash) {
+		return rev, hash, false
+	}
+	rev, hash = s.put(key, tiddler, hasMacro, filePath)
+	return rev, hash, true
+}
 
-	s.mx.Lock()
-	// double check
-	ref := 0
+// should hold write lock
+func (s *MemStore) put(key string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string) {
 	td, ok := s.kv[key]
 	if !ok {
 		td = &memTiddler{}
+		if old, ok := s.gone[key]; ok {
+			// continue revision and history of deleted one
+			td.rev = old.rev
+			td.history = old.history
+			delete(s.gone, key)
+		}
 		s.kv[key] = td
-		ref = 1 // file ref += 1
 	}
-	rev, hash = s.putExist(td, tiddler, hasMacro, filePath, ref)
+	rev, hash = s.putExist(td, tiddler, hasMacro, filePath)
+	s.seq++
+	td.seq = s.seq
+	delete(s.deleted, key)
 	s.FlagDirty() // flag dirty
-	s.mx.Unlock()
 	return
 }
 
-func (s *MemStore) putExist(td *memTiddler, tiddler *TiddlyWebJSON, hasMacro bool, fp string, ref int) (rev uint64, hash string) {
+func (s *MemStore) putExist(td *memTiddler, tiddler *TiddlyWebJSON, hasMacro bool, fp string) (rev uint64, hash string) {
 	// Remove `_is_skinny` field, and keep old text
 	if tiddler.IsSkinny != nil {
 		tiddler.IsSkinny = nil
 		tiddler.Text = td.text
 	}
 
+	// keep old revision, nothing to keep for new or re-created one
+	if td.meta != nil {
+		s.pushHistory(td)
+	}
+
 	rev = atomic.AddUint64(&td.rev, 1)
 
-	// TODO: check revision?
 	// Remove any revision field
 	// tiddler.Revision = ""
 
-	// set revision
-	tiddler.Revision = fmt.Sprintf("%v", rev)
-
-	// Extract `text` field
-	text := tiddler.Text
-	tiddler.Text = ""
-
-	// build meta
-	meta, _ := json.Marshal(tiddler)
-
-	// calc hash
-	h := sha256.New()
-	h.Write(meta)
-	h.Write([]byte(text))
-	// hash = hex.EncodeToString(h.Sum(nil))
-	hash = base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+	// set revision, extract `text` field, build meta and calc hash
+	meta, text, hash := encodeMeta(tiddler, rev)
 
 	// set back
 	td.meta = meta
@@ -209,15 +357,61 @@ func (s *MemStore) putExist(td *memTiddler, tiddler *TiddlyWebJSON, hasMacro boo
 	td.hasMacro = hasMacro
 	td.hash = hash
 	td.file = fp
+	td.time = time.Now().UnixNano()
 
-	// update file ref
-	if ref != 0 && fp != "" {
-		s.fileRef[fp] += ref
-	}
+	// update file ref, counted for each revision
+	s.attachRef(fp, 1)
 
 	return rev, hash
 }
 
+// copy current revision into history, and drop expired revisions
+func (s *MemStore) pushHistory(td *memTiddler) {
+	old := &memTiddler{
+		rev:      td.rev,
+		meta:     td.meta,
+		text:     td.text,
+		hash:     td.hash,
+		file:     td.file,
+		hasMacro: td.hasMacro,
+		time:     td.time,
+	}
+	if old.time == 0 {
+		old.time = time.Now().UnixNano() // from old data
+	}
+	td.history = append(td.history, old)
+	s.dropHistory(td)
+}
+
+// drop expired revisions by RevisionPolicy
+func (s *MemStore) dropHistory(td *memTiddler) {
+	saved := make([]int64, len(td.history))
+	for i, h := range td.history {
+		saved[i] = h.time
+	}
+	drop := s.dropCount(saved)
+	for _, h := range td.history[:drop] {
+		s.attachRef(h.file, -1) // unused file is removed by Sweep()
+	}
+	if drop > 0 {
+		td.history = append(td.history[:0:0], td.history[drop:]...)
+	}
+}
+
+// reference count of attachment file from all kept revisions, should hold write lock
+// unused file is kept with count 0 until Sweep()
+func (s *MemStore) attachRef(file string, delta int) int {
+	if file == "" {
+		return 0
+	}
+	count := s.fileRef[file] + delta
+	if count < 0 {
+		count = 0
+	}
+	s.fileRef[file] = count
+	return count
+}
+
 // TODO: remove attachment file
 func (s *MemStore) Del(key string) (bool, string) {
 	s.mx.Lock()
@@ -227,23 +421,56 @@ func (s *MemStore) Del(key string) (bool, string) {
 		return false, ""
 	}
 	delete(s.kv, key)
+	s.seq++
+	s.deleted[key] = s.seq
+
+	// keep deleted revision in history
+	s.pushHistory(td)
+	s.gone[key] = &memTiddler{
+		rev:     td.rev,
+		history: td.history,
+	}
 	s.FlagDirty() // flag dirty
 
-	// skip if no file
-	if td.file == "" {
-		return true, ""
+	// remove file only if not used by any kept revision
+	if count, ok := s.fileRef[td.file]; ok && count == 0 {
+		delete(s.fileRef, td.file)
+		return true, td.file
 	}
+	return true, ""
+}
 
-	// calc file ref
-	if _, ok := s.fileRef[td.file]; ok {
-		s.fileRef[td.file] -= 1
+func (s *MemStore) Sweep() []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for key, seq := range s.deleted {
+		if td, ok := s.gone[key]; ok {
+			s.dropHistory(td)
+			if len(td.history) > 0 {
+				continue
+			}
+			delete(s.gone, key)
+		}
+		delete(s.deleted, key)
+		if seq > s.swept {
+			s.swept = seq
+		}
+	}
 
-		if s.fileRef[td.file] == 0 {
-			delete(s.fileRef, td.file)
-			return true, td.file
+	files := make([]string, 0)
+	for file, count := range s.fileRef {
+		if count == 0 {
+			files = append(files, file)
+			delete(s.fileRef, file)
 		}
 	}
-	return true, ""
+	return files
+}
+
+func (s *MemStore) SweptSeq() uint64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.swept
 }
 
 func (s *MemStore) AttachAttachment(key string, file string) bool {
@@ -253,28 +480,73 @@ func (s *MemStore) AttachAttachment(key string, file string) bool {
 	if !ok {
 		return false
 	}
+	// count file, for current revision only
+	s.attachRef(td.file, -1)
+	s.attachRef(file, 1)
 	td.file = file
 
-	// count file
-	s.fileRef[file] += 1
-
 	return true
 }
 
+func (td *memTiddler) dump() *dumpTiddler {
+	return &dumpTiddler{
+		Meta:     string(td.meta),
+		Text:     td.text,
+		Rev:      td.rev,
+		HasMacro: td.hasMacro,
+		Hash:     td.hash,
+		File:     td.file,
+		Time:     td.time,
+		Seq:      td.seq,
+	}
+}
+
+func (dtd *dumpTiddler) load() *memTiddler {
+	return &memTiddler{
+		meta:     []byte(dtd.Meta),
+		text:     dtd.Text,
+		rev:      dtd.Rev,
+		hasMacro: dtd.HasMacro,
+		hash:     dtd.Hash,
+		file:     dtd.File,
+		time:     dtd.Time,
+		seq:      dtd.Seq,
+	}
+}
+
 func (s *MemStore) MarshalJSON() ([]byte, error) {
 	aux := make([]*dumpTiddler, 0, len(s.kv))
 	s.mx.RLock()
 	for _, td := range s.kv {
+		dtd := td.dump()
+		for _, old := range td.history {
+			dtd.History = append(dtd.History, old.dump())
+		}
+		aux = append(aux, dtd)
+	}
+	for key, seq := range s.deleted {
+		meta, _ := json.Marshal(&tombstone{Title: key})
 		dtd := &dumpTiddler{
-			Meta:     string(td.meta),
-			Text:     td.text,
-			Rev:      td.rev,
-			HasMacro: td.hasMacro,
-			Hash:     td.hash,
-			File:     td.file,
+			Meta:    string(meta),
+			Seq:     seq,
+			Deleted: true,
+		}
+		if td, ok := s.gone[key]; ok {
+			dtd.Rev = td.rev
+			for _, old := range td.history {
+				dtd.History = append(dtd.History, old.dump())
+			}
 		}
 		aux = append(aux, dtd)
 	}
+	if s.swept != 0 {
+		meta, _ := json.Marshal(&tombstone{Title: string(sweptKey)})
+		aux = append(aux, &dumpTiddler{
+			Meta:    string(meta),
+			Seq:     s.swept,
+			Deleted: true,
+		})
+	}
 	s.mx.RUnlock()
 
 	// v, _ := json.Marshal(aux)
@@ -296,6 +568,9 @@ func (s *MemStore) UnmarshalJSON(buf []byte) error {
 	getk := &getKey{}
 	nkv := make(map[string]*memTiddler)
 	fRef := make(map[string]int)
+	nDel := make(map[string]uint64)
+	nGone := make(map[string]*memTiddler)
+	seq, swept := uint64(0), uint64(0)
 	for _, dtd := range aux {
 		meta := []byte(dtd.Meta)
 		err := json.Unmarshal(meta, &getk)
@@ -307,14 +582,29 @@ func (s *MemStore) UnmarshalJSON(buf []byte) error {
 		if key == "" {
 			continue
 		}
+		if dtd.Seq > seq {
+			seq = dtd.Seq
+		}
+		if key == string(sweptKey) {
+			swept = dtd.Seq
+			continue
+		}
+		if dtd.Deleted {
+			nDel[key] = dtd.Seq
+			if dtd.Rev != 0 {
+				td := &memTiddler{rev: dtd.Rev}
+				for _, old := range dtd.History {
+					td.history = append(td.history, old.load())
+				}
+				nGone[key] = td
+				countHistoryRef(fRef, td)
+			}
+			continue
+		}
 
-		td := &memTiddler{
-			meta:     meta,
-			text:     dtd.Text,
-			rev:      dtd.Rev,
-			hasMacro: dtd.HasMacro,
-			hash:     dtd.Hash,
-			file:     dtd.File,
+		td := dtd.load()
+		for _, old := range dtd.History {
+			td.history = append(td.history, old.load())
 		}
 		nkv[key] = td
 
@@ -322,16 +612,38 @@ func (s *MemStore) UnmarshalJSON(buf []byte) error {
 		if td.file != "" {
 			fRef[td.file] += 1
 		}
+		countHistoryRef(fRef, td)
+	}
+
+	// set change sequence for old data
+	for _, td := range nkv {
+		if td.seq == 0 {
+			seq++
+			td.seq = seq
+		}
 	}
 
 	s.mx.Lock()
 	s.kv = nkv
 	s.fileRef = fRef
+	s.deleted = nDel
+	s.gone = nGone
+	s.seq = seq
+	s.swept = swept
 	s.mx.Unlock()
 
 	return nil
 }
 
+// count attachment files of old revisions
+func countHistoryRef(fRef map[string]int, td *memTiddler) {
+	for _, old := range td.history {
+		if old.file != "" {
+			fRef[old.file] += 1
+		}
+	}
+}
+
 func (s *MemStore) Load(fp string) error {
 	fd, err := os.Open(fp)
 	if err != nil {
@@ -349,6 +661,10 @@ func (s *MemStore) Load(fp string) error {
 	s.mx.Lock()
 	s.kv = ns.kv
 	s.fileRef = ns.fileRef
+	s.deleted = ns.deleted
+	s.gone = ns.gone
+	s.seq = ns.seq
+	s.swept = ns.swept
 	s.mx.Unlock()
 
 	return nil
@@ -375,8 +691,14 @@ func NewMemStore() *MemStore {
 	return &MemStore{
 		kv:      make(map[string]*memTiddler),
 		fileRef: make(map[string]int),
+		deleted: make(map[string]uint64),
+		gone:    make(map[string]*memTiddler),
+		RevisionPolicy: RevisionPolicy{
+			MaxCount: DefaultRevisionCount,
+		},
 	}
 }
 
-// make sure MemStore implement Store
+// make sure MemStore implement Store & Sweeper
 var _ Store = (*MemStore)(nil)
+var _ Sweeper = (*MemStore)(nil)
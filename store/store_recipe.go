@@ -0,0 +1,411 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+var (
+	ErrNoBag       = errors.New("recipe without bag")
+	ErrBagNotFound = errors.New("bag not found")
+)
+
+// a bag is a Store with name
+type Bag struct {
+	Name  string
+	Store Store
+}
+
+// layered Store over bags, like the recipe of TiddlyWeb
+// later bag override earlier one when reading, write to the `write` bag only
+// change sequence is the sum of all bags
+type RecipeStore struct {
+	bags  []*Bag // ordered, the last one has highest priority
+	write int    // index of bag to write
+
+	cached atomic.Value // *recipeListCache, for full list
+}
+
+type recipeListCache struct {
+	seq       uint64
+	buf       []byte
+	hasOutput bool
+}
+
+// entry in output of List() or ListSince()
+type listEntry struct {
+	Title   string `json:"title"`
+	Deleted bool   `json:"_is_deleted"`
+}
+
+func (s *RecipeStore) Bags() []*Bag {
+	return s.bags
+}
+
+func (s *RecipeStore) Bag(name string) *Bag {
+	for _, bag := range s.bags {
+		if bag.Name == name {
+			return bag
+		}
+	}
+	return nil
+}
+
+func (s *RecipeStore) WriteBag() *Bag {
+	return s.bags[s.write]
+}
+
+// find the bag of a tiddler, from highest priority, only search bags before `below` (exclusive)
+func (s *RecipeStore) find(key string, below int) (idx int, tiddler *TiddlyWebJSON, hash string) {
+	for i := below - 1; i >= 0; i-- {
+		tiddler, hash = s.bags[i].Store.Get(key)
+		if tiddler != nil {
+			tiddler.Bag = s.bags[i].Name
+			return i, tiddler, hash
+		}
+	}
+	return -1, nil, ""
+}
+
+func (s *RecipeStore) List(ap []*TiddlyWebJSON, full bool) []byte {
+	if !full {
+		buf, hasOutput := s.list(full)
+		return buildTiddlerList(buf, hasOutput, ap)
+	}
+
+	seq := s.Seq()
+	c, ok := s.cached.Load().(*recipeListCache)
+	if !ok || c.seq != seq {
+		buf, hasOutput := s.list(full)
+		c = &recipeListCache{
+			seq:       seq,
+			buf:       buf,
+			hasOutput: hasOutput,
+		}
+		s.cached.Store(c)
+	}
+	return buildTiddlerList(c.buf, c.hasOutput, ap)
+}
+
+// merge list of all bags, skip overridden tiddlers
+func (s *RecipeStore) list(full bool) ([]byte, bool) {
+	var b bytes.Buffer
+	seen := make(map[string]bool)
+	hasOutput := false
+	b.WriteByte('[')
+	for i := len(s.bags) - 1; i >= 0; i-- {
+		bag := s.bags[i]
+		entries, err := splitList(bag.Store.List(nil, full))
+		if err != nil {
+			continue
+		}
+		for _, raw := range entries {
+			var e listEntry
+			if err := json.Unmarshal(raw, &e); err != nil || seen[e.Title] {
+				continue
+			}
+			seen[e.Title] = true
+			hasOutput = writeEntry(&b, raw, bag.Name, hasOutput)
+		}
+	}
+	return b.Bytes(), hasOutput
+}
+
+// since of each bag is unknown, use the lower bound: changes of other bags are at most their current sequence
+// client may get some changes again but never miss
+func (s *RecipeStore) ListSince(ap []*TiddlyWebJSON, since uint64) ([]byte, uint64) {
+	seqs := make([]uint64, len(s.bags))
+	seq := uint64(0)
+	for i, bag := range s.bags {
+		seqs[i] = bag.Store.Seq()
+		seq += seqs[i]
+	}
+
+	var b bytes.Buffer
+	seen := make(map[string]bool)
+	hasOutput := false
+	b.WriteByte('[')
+	for i := len(s.bags) - 1; i >= 0; i-- {
+		bag := s.bags[i]
+		others := seq - seqs[i]
+		bagSince := uint64(0)
+		if since > others {
+			bagSince = since - others
+		}
+		buf, _ := bag.Store.ListSince(nil, bagSince)
+		entries, err := splitList(buf)
+		if err != nil {
+			continue
+		}
+		for _, raw := range entries {
+			var e listEntry
+			if err := json.Unmarshal(raw, &e); err != nil || seen[e.Title] {
+				continue
+			}
+			seen[e.Title] = true
+
+			// overridden by upper bag
+			if idx, _, _ := s.find(e.Title, len(s.bags)); idx > i {
+				continue
+			}
+			if !e.Deleted {
+				hasOutput = writeEntry(&b, raw, bag.Name, hasOutput)
+				continue
+			}
+
+			// deleted, but still in lower bag, skinny as other entries
+			if idx, tiddler, _ := s.find(e.Title, i); tiddler != nil {
+				tiddler.Text = ""
+				tiddler.Bag = ""
+				buf, err := json.Marshal(tiddler)
+				if err != nil {
+					continue
+				}
+				hasOutput = writeEntry(&b, buf, s.bags[idx].Name, hasOutput)
+				continue
+			}
+			hasOutput = writeTombstone(&b, e.Title, hasOutput)
+		}
+	}
+	return buildTiddlerList(b.Bytes(), hasOutput, ap), seq
+}
+
+func (s *RecipeStore) Seq() uint64 {
+	seq := uint64(0)
+	for _, bag := range s.bags {
+		seq += bag.Store.Seq()
+	}
+	return seq
+}
+
+func (s *RecipeStore) Get(key string) (*TiddlyWebJSON, string) {
+	_, tiddler, hash := s.find(key, len(s.bags))
+	return tiddler, hash
+}
+
+func (s *RecipeStore) Put(key string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (uint64, string) {
+	tiddler.Bag = ""
+	return s.WriteBag().Store.Put(key, tiddler, hasMacro, filePath)
+}
+
+// revision and hash can be from lower bag before the first write
+func (s *RecipeStore) PutIf(key string, ifRev uint64, ifHash string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (uint64, string, bool) {
+	tiddler.Bag = ""
+	wbag := s.WriteBag().Store
+	if cur, _ := wbag.Get(key); cur == nil {
+		idx, cur, curHash := s.find(key, len(s.bags))
+		if idx >= 0 {
+			if !revMatch(cur.Rev, curHash, ifRev, ifHash) {
+				return cur.Rev, curHash, false
+			}
+			ifRev, ifHash = 0, ""
+		}
+	}
+	return wbag.PutIf(key, ifRev, ifHash, tiddler, hasMacro, filePath)
+}
+
+// only delete from the write bag, tiddler in lower bag will show again
+func (s *RecipeStore) Del(key string) (bool, string) {
+	return s.WriteBag().Store.Del(key)
+}
+
+// bag of current tiddler, or the write bag for deleted one
+func (s *RecipeStore) revisionBag(key string) int {
+	idx, _, _ := s.find(key, len(s.bags))
+	if idx < 0 {
+		return s.write
+	}
+	return idx
+}
+
+// revisions from the bag of current tiddler
+func (s *RecipeStore) Revisions(key string) []*TiddlyWebJSON {
+	idx := s.revisionBag(key)
+	lst := s.bags[idx].Store.Revisions(key)
+	for _, td := range lst {
+		td.Bag = s.bags[idx].Name
+	}
+	return lst
+}
+
+func (s *RecipeStore) GetRevision(key string, rev uint64) (*TiddlyWebJSON, string) {
+	idx := s.revisionBag(key)
+	tiddler, hash := s.bags[idx].Store.GetRevision(key, rev)
+	if tiddler != nil {
+		tiddler.Bag = s.bags[idx].Name
+	}
+	return tiddler, hash
+}
+
+func (s *RecipeStore) Each(fn func(tiddler *TiddlyWebJSON, hash string) bool) {
+	seen := make(map[string]bool)
+	for i := len(s.bags) - 1; i >= 0; i-- {
+		next := true
+		s.bags[i].Store.Each(func(tiddler *TiddlyWebJSON, hash string) bool {
+			if seen[tiddler.Title] {
+				return true
+			}
+			seen[tiddler.Title] = true
+			tiddler.Bag = s.bags[i].Name
+			next = fn(tiddler, hash)
+			return next
+		})
+		if !next {
+			return
+		}
+	}
+}
+
+func (s *RecipeStore) AttachAttachment(key string, file string) bool {
+	return s.WriteBag().Store.AttachAttachment(key, file)
+}
+
+// only sweep the write bag, other bags are swept by recipes writing to them
+func (s *RecipeStore) Sweep() []string {
+	return Sweep(s.WriteBag().Store)
+}
+
+// same lower bound as ListSince(): `since` of a bag is at least `since` minus current sequence of other bags
+func (s *RecipeStore) SweptSeq() uint64 {
+	seqs := make([]uint64, len(s.bags))
+	seq := uint64(0)
+	for i, bag := range s.bags {
+		seqs[i] = bag.Store.Seq()
+		seq += seqs[i]
+	}
+	floor := uint64(0)
+	for i, bag := range s.bags {
+		swept := SweptSeq(bag.Store)
+		if swept == 0 {
+			continue
+		}
+		if f := swept + seq - seqs[i]; f > floor {
+			floor = f
+		}
+	}
+	return floor
+}
+
+// watch all bags, only changes visible in this recipe are notified
+func (s *RecipeStore) Watch(fn func(ev *ChangeEvent)) func() {
+	cancels := make([]func(), 0, len(s.bags))
+	for i, bag := range s.bags {
+		w, ok := bag.Store.(Watcher)
+		if !ok {
+			continue
+		}
+		i := i
+		cancels = append(cancels, w.Watch(func(ev *ChangeEvent) {
+			// overridden by upper bag
+			if idx, _, _ := s.find(ev.Title, len(s.bags)); idx > i {
+				return
+			}
+			if ev.Op != EventDel {
+				fn(ev)
+				return
+			}
+
+			// deleted, but still in lower bag
+			if _, tiddler, hash := s.find(ev.Title, i); tiddler != nil {
+				fn(&ChangeEvent{
+					Op:       EventPut,
+					Title:    ev.Title,
+					Revision: fmt.Sprintf("%v", tiddler.Rev),
+					Hash:     hash,
+					Modifier: tiddler.Modifier,
+				})
+				return
+			}
+			fn(ev)
+		}))
+	}
+	return func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+}
+
+// bags are ordered from lowest to highest priority
+// `write` is the name of bag to write, empty for the last one
+func NewRecipeStore(bags []*Bag, write string) (*RecipeStore, error) {
+	if len(bags) == 0 {
+		return nil, ErrNoBag
+	}
+	s := &RecipeStore{
+		bags:  bags,
+		write: len(bags) - 1,
+	}
+	if write != "" {
+		s.write = -1
+		for i, bag := range bags {
+			if bag.Name == write {
+				s.write = i
+				break
+			}
+		}
+		if s.write < 0 {
+			return nil, ErrBagNotFound
+		}
+	}
+	return s, nil
+}
+
+// split JSON array output of List() or ListSince()
+func splitList(buf []byte) ([]json.RawMessage, error) {
+	var lst []json.RawMessage
+	err := json.Unmarshal(buf, &lst)
+	return lst, err
+}
+
+// set `bag` field by appending it, replace the one already in entry, skip for empty bag
+func writeEntry(b *bytes.Buffer, raw []byte, bag string, hasOutput bool) bool {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) < 2 || raw[len(raw)-1] != '}' {
+		return hasOutput
+	}
+	if bag != "" && bytes.Contains(raw, []byte(`"bag"`)) {
+		raw = dropField(raw, "bag")
+	}
+	if hasOutput {
+		b.WriteByte(',')
+	}
+	if bag == "" {
+		b.Write(raw)
+		return true
+	}
+	name, _ := json.Marshal(bag)
+	b.Write(raw[:len(raw)-1])
+	if len(bytes.TrimSpace(raw[1:len(raw)-1])) > 0 {
+		b.WriteByte(',')
+	}
+	b.WriteString(`"bag":`)
+	b.Write(name)
+	b.WriteByte('}')
+	return true
+}
+
+// remove a top level field of JSON object, keep as is if not an object
+func dropField(raw []byte, field string) []byte {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return raw
+	}
+	if _, ok := obj[field]; !ok {
+		return raw
+	}
+	delete(obj, field)
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		return raw
+	}
+	return buf
+}
+
+// make sure RecipeStore implement Store & Watcher
+var _ Store = (*RecipeStore)(nil)
+var _ Watcher = (*RecipeStore)(nil)
+var _ Sweeper = (*RecipeStore)(nil)
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func listTitles(t *testing.T, buf []byte) map[string]*TiddlyWebJSON {
+	var lst []*TiddlyWebJSON
+	if err := json.Unmarshal(buf, &lst); err != nil {
+		t.Fatal("list not JSON", string(buf), err)
+	}
+	out := make(map[string]*TiddlyWebJSON)
+	for _, td := range lst {
+		out[td.Title] = td
+	}
+	return out
+}
+
+func TestRecipeStore(t *testing.T) {
+	shared := NewWatchStore(NewMemStore())
+	own := NewWatchStore(NewMemStore())
+	shared.Put("A", &TiddlyWebJSON{Title: "A", Text: "shared a"}, false, "")
+	shared.Put("B", &TiddlyWebJSON{Title: "B", Text: "shared b"}, false, "")
+
+	s, err := NewRecipeStore([]*Bag{{Name: "shared", Store: shared}, {Name: "own", Store: own}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRecipeStore([]*Bag{{Name: "shared", Store: shared}}, "own"); err != ErrBagNotFound {
+		t.Fatal("should be ErrBagNotFound, got", err)
+	}
+
+	events := make([]*ChangeEvent, 0)
+	cancel := s.Watch(func(ev *ChangeEvent) {
+		events = append(events, ev)
+	})
+	defer cancel()
+
+	// write to own bag with etag of shared one
+	cur, hash := s.Get("A")
+	if cur == nil || cur.Bag != "shared" {
+		t.Fatal("A should be in shared bag", cur)
+	}
+	since := s.Seq()
+	if _, _, ok := s.PutIf("A", cur.Rev, hash, &TiddlyWebJSON{Title: "A", Text: "own a"}, false, ""); !ok {
+		t.Fatal("PutIf with etag from shared bag should succeed")
+	}
+	if td, _ := shared.Get("A"); td.Text != "shared a" {
+		t.Fatal("shared bag should not change", td.Text)
+	}
+	if td, _ := s.Get("A"); td.Bag != "own" || td.Text != "own a" {
+		t.Fatal("A should be overridden by own bag", td)
+	}
+
+	lst := listTitles(t, s.List(nil, true))
+	if len(lst) != 2 || lst["A"].Bag != "own" || lst["B"].Bag != "shared" || lst["A"].Text != "own a" {
+		t.Fatal("bad merged list", lst)
+	}
+	lst = listTitles(t, s.List(nil, true)) // cached
+	if len(lst) != 2 || lst["A"].Bag != "own" {
+		t.Fatal("bad cached list", lst)
+	}
+
+	// change in shared bag is hidden, unchanged one may be listed again
+	shared.Put("A", &TiddlyWebJSON{Title: "A", Text: "shared a2"}, false, "")
+	buf, seq := s.ListSince(nil, since)
+	lst = listTitles(t, buf)
+	if seq != s.Seq() || lst["A"] == nil || lst["A"].Bag != "own" {
+		t.Fatal("bad list since", string(buf))
+	}
+
+	// delete from own bag, shared one show again
+	since = s.Seq()
+	if ok, _ := s.Del("B"); ok {
+		t.Fatal("should not delete from shared bag")
+	}
+	if ok, _ := s.Del("A"); !ok {
+		t.Fatal("delete from own bag failed")
+	}
+	buf, _ = s.ListSince(nil, since)
+	lst = listTitles(t, buf)
+	if lst["A"] == nil || lst["A"].Bag != "shared" || lst["A"].Text != "" || bytes.Count(buf, []byte(`"bag"`)) != 1 {
+		t.Fatal("bad list since after delete", string(buf))
+	}
+
+	if len(events) != 2 || events[0].Op != EventPut || events[1].Op != EventPut {
+		t.Fatal("bad events", events)
+	}
+}
+
+func TestWriteEntry(t *testing.T) {
+	var testCase = []struct {
+		Raw string
+		Bag string
+		Out string
+	}{
+		{`{"title":"A"}`, "own", `{"title":"A","bag":"own"}`},
+		{`{}`, "own", `{"bag":"own"}`},
+		{`{"title":"A"}`, "", `{"title":"A"}`},
+		{`{"bag":"old","title":"A"}`, "own", `{"title":"A","bag":"own"}`},
+		{`{"title":"A","text":"has \"bag\""}`, "own", `{"title":"A","text":"has \"bag\"","bag":"own"}`},
+	}
+	for _, tc := range testCase {
+		var b bytes.Buffer
+		writeEntry(&b, []byte(tc.Raw), tc.Bag, false)
+		if b.String() != tc.Out {
+			t.Fatal("writeEntry", tc.Raw, "should be", tc.Out, "got", b.String())
+		}
+	}
+}
+
+func TestRecipeListSinceBound(t *testing.T) {
+	shared := NewMemStore()
+	own := NewMemStore()
+	s, err := NewRecipeStore([]*Bag{{Name: "shared", Store: shared}, {Name: "own", Store: own}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared.Put("A", &TiddlyWebJSON{Title: "A"}, false, "")
+	shared.Put("B", &TiddlyWebJSON{Title: "B"}, false, "")
+	own.Put("C", &TiddlyWebJSON{Title: "C"}, false, "")
+
+	// seq is sum of bags, every change after `since` should be listed from any bag
+	since := s.Seq()
+	if since != 3 {
+		t.Fatal("seq should be sum of bags", since)
+	}
+	shared.Put("D", &TiddlyWebJSON{Title: "D"}, false, "")
+	own.Put("E", &TiddlyWebJSON{Title: "E"}, false, "")
+	own.Del("C")
+	buf, seq := s.ListSince(nil, since)
+	lst := listTitles(t, buf)
+	if seq != since+3 || lst["D"] == nil || lst["E"] == nil || !bytes.Contains(buf, []byte(`{"title":"C","_is_deleted":true}`)) {
+		t.Fatal("changes of all bags should be listed", string(buf), seq)
+	}
+
+	// not listed only when no bag can change after it
+	for i := uint64(0); i <= seq; i++ {
+		buf, _ := s.ListSince(nil, i)
+		if lst := listTitles(t, buf); i < seq && lst["C"] == nil {
+			t.Fatal("last change should be listed since", i, string(buf))
+		}
+	}
+	if buf, _ := s.ListSince(nil, seq); string(buf) != "[]" {
+		t.Fatal("nothing should be listed since current seq", string(buf))
+	}
+}
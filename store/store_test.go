@@ -0,0 +1,371 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stores with revision history
+func testStores(t *testing.T) map[string]Store {
+	dir := t.TempDir()
+	bc, err := NewBitcaskStore(filepath.Join(dir, "bitcask"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, err := NewBoltStore(filepath.Join(dir, "bolt.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFileStore(filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bc.Close()
+		bt.Close()
+		fs.Close()
+	})
+	return map[string]Store{
+		"mem":     NewMemStore(),
+		"bitcask": bc,
+		"bolt":    bt,
+		"files":   fs,
+	}
+}
+
+func revList(lst []*TiddlyWebJSON) []uint64 {
+	out := make([]uint64, 0, len(lst))
+	for _, td := range lst {
+		out = append(out, td.Rev)
+	}
+	return out
+}
+
+func sameRevs(a []uint64, b ...uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRevisionsAfterDel(t *testing.T) {
+	for name, s := range testStores(t) {
+		s.Put("A", &TiddlyWebJSON{Title: "A", Text: "v1"}, false, "")
+		s.Put("A", &TiddlyWebJSON{Title: "A", Text: "v2"}, false, "")
+		if ok, _ := s.Del("A"); !ok {
+			t.Fatal(name, "delete failed")
+		}
+
+		if revs := revList(s.Revisions("A")); !sameRevs(revs, 2, 1) {
+			t.Fatal(name, "revisions after delete should be [2 1], got", revs)
+		}
+		if td, _ := s.GetRevision("A", 2); td == nil || td.Text != "v2" {
+			t.Fatal(name, "deleted revision should be kept", td)
+		}
+		if s.Revisions("B") != nil {
+			t.Fatal(name, "revisions of not exist tiddler should be nil")
+		}
+
+		// re-created one continue revision
+		if rev, _ := s.Put("A", &TiddlyWebJSON{Title: "A", Text: "v3"}, false, ""); rev != 3 {
+			t.Fatal(name, "revision should continue after delete, got", rev)
+		}
+		if revs := revList(s.Revisions("A")); !sameRevs(revs, 3, 2, 1) {
+			t.Fatal(name, "revisions should be [3 2 1], got", revs)
+		}
+		if td, _ := s.GetRevision("A", 1); td == nil || td.Text != "v1" {
+			t.Fatal(name, "old revision lost", td)
+		}
+	}
+}
+
+func TestMemStoreDumpDeleted(t *testing.T) {
+	s := NewMemStore()
+	s.Put("A", &TiddlyWebJSON{Title: "A", Text: "v1"}, false, "")
+	s.Del("A")
+
+	buf, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := &MemStore{}
+	if err := json.Unmarshal(buf, ns); err != nil {
+		t.Fatal(err)
+	}
+	if td, _ := ns.GetRevision("A", 1); td == nil || td.Text != "v1" {
+		t.Fatal("history of deleted tiddler should be dumped", string(buf))
+	}
+	if rev, _ := ns.Put("A", &TiddlyWebJSON{Title: "A", Text: "v2"}, false, ""); rev != 2 {
+		t.Fatal("revision should continue after load, got", rev)
+	}
+}
+
+func TestAttachRefHistory(t *testing.T) {
+	for name, s := range testStores(t) {
+		// file of old revision is kept after delete
+		s.Put("A", &TiddlyWebJSON{Title: "A", Text: "v1"}, false, "f1")
+		s.Put("A", &TiddlyWebJSON{Title: "A", Text: "v2"}, false, "")
+		if ok, file := s.Del("A"); !ok || file != "" {
+			t.Fatal(name, "file should not be removed", ok, file)
+		}
+
+		// replaced by upload, both files are referenced by revisions
+		s.Put("B", &TiddlyWebJSON{Title: "B", Text: "v1"}, false, "f2")
+		s.Put("B", &TiddlyWebJSON{Title: "B"}, false, "")
+		s.AttachAttachment("B", "f3")
+		s.Put("C", &TiddlyWebJSON{Title: "C"}, false, "f3")
+		if ok, file := s.Del("C"); !ok || file != "" {
+			t.Fatal(name, "file used by other tiddler should not be removed", ok, file)
+		}
+		if _, file := s.Del("B"); file != "" {
+			t.Fatal(name, "file should be kept by deleted revision", file)
+		}
+	}
+
+	// no history, file is removed on delete
+	for name, s := range testStores(t) {
+		s.(interface {
+			SetRevisionPolicy(count int, age time.Duration)
+		}).SetRevisionPolicy(0, 0)
+		s.Put("A", &TiddlyWebJSON{Title: "A", Text: "v1"}, false, "f1")
+		s.Put("A", &TiddlyWebJSON{Title: "A", Text: "v2"}, false, "f2")
+		if ok, file := s.Del("A"); !ok || file != "f2" {
+			t.Fatal(name, "file should be removed without history", ok, file)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	for name, s := range testStores(t) {
+		policy := s.(interface {
+			SetRevisionPolicy(count int, age time.Duration)
+		})
+		policy.SetRevisionPolicy(1, 0)
+
+		// file of dropped revision is returned once
+		s.Put("A", &TiddlyWebJSON{Title: "A"}, false, "f1")
+		s.Put("A", &TiddlyWebJSON{Title: "A"}, false, "f2")
+		s.Put("A", &TiddlyWebJSON{Title: "A"}, false, "f3")
+		if files := Sweep(s); fmt.Sprint(files) != "[f1]" {
+			t.Fatal(name, "file of dropped revision should be swept, got", files)
+		}
+		if files := Sweep(s); len(files) != 0 {
+			t.Fatal(name, "file should be swept once, got", files)
+		}
+
+		// deleted tiddler with kept revision is not dropped
+		if _, file := s.Del("A"); file != "" {
+			t.Fatal(name, "file should be kept by deleted revision", file)
+		}
+		if files := Sweep(s); fmt.Sprint(files) != "[f2]" {
+			t.Fatal(name, "file of dropped revision should be swept, got", files)
+		}
+		if SweptSeq(s) != 0 {
+			t.Fatal(name, "tombstone should be kept")
+		}
+
+		// all revisions expired, tombstone is dropped
+		seq := s.Seq()
+		policy.SetRevisionPolicy(1, time.Nanosecond)
+		time.Sleep(time.Millisecond)
+		if files := Sweep(s); fmt.Sprint(files) != "[f3]" {
+			t.Fatal(name, "file of expired revision should be swept, got", files)
+		}
+		if swept := SweptSeq(s); swept != seq {
+			t.Fatal(name, "swept sequence should be", seq, "got", swept)
+		}
+		if s.Seq() != seq {
+			t.Fatal(name, "sequence should not change", s.Seq())
+		}
+		if s.Revisions("A") != nil {
+			t.Fatal(name, "revisions should be dropped")
+		}
+		if buf, _ := s.ListSince(nil, 0); string(buf) != "[]" {
+			t.Fatal(name, "tombstone should be dropped", string(buf))
+		}
+		if rev, _ := s.Put("A", &TiddlyWebJSON{Title: "A"}, false, ""); rev != 1 {
+			t.Fatal(name, "revision should start again, got", rev)
+		}
+	}
+}
+
+func TestSweptSeqReopen(t *testing.T) {
+	dir := t.TempDir()
+	reopen := map[string]func(s Store) Store{
+		"mem": func(s Store) Store {
+			fp := filepath.Join(dir, "mem.json")
+			s.(*MemStore).Dump(fp)
+			ns := NewMemStore()
+			ns.Load(fp)
+			return ns
+		},
+		"bitcask": func(s Store) Store {
+			s.(*BitcaskStore).Close()
+			ns, err := NewBitcaskStore(filepath.Join(dir, "bitcask"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ns
+		},
+		"bolt": func(s Store) Store {
+			s.(*BoltStore).Close()
+			ns, err := NewBoltStore(filepath.Join(dir, "bolt.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ns
+		},
+		"files": func(s Store) Store {
+			s.(*FileStore).Close()
+			ns, err := NewFileStore(filepath.Join(dir, "files"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ns
+		},
+	}
+	bc, err := NewBitcaskStore(filepath.Join(dir, "bitcask"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, err := NewBoltStore(filepath.Join(dir, "bolt.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFileStore(filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]Store{"mem": NewMemStore(), "bitcask": bc, "bolt": bt, "files": fs}
+	for name, s := range stores {
+		s.(interface {
+			SetRevisionPolicy(count int, age time.Duration)
+		}).SetRevisionPolicy(0, 0)
+		s.Put("A", &TiddlyWebJSON{Title: "A"}, false, "")
+		s.Put("B", &TiddlyWebJSON{Title: "B"}, false, "")
+		s.Del("B")
+		Sweep(s)
+
+		// newest change is the dropped tombstone
+		ns := reopen[name](s)
+		if ns.Seq() != 3 || SweptSeq(ns) != 3 {
+			t.Fatal(name, "sequence should be kept after reopen, got", ns.Seq(), SweptSeq(ns))
+		}
+		if buf, seq := ns.ListSince(nil, 3); string(buf) != "[]" || seq != 3 {
+			t.Fatal(name, "nothing changed after swept sequence", string(buf), seq)
+		}
+		if c, ok := ns.(interface{ Close() error }); ok {
+			c.Close()
+		}
+	}
+}
+
+func TestTaggedRecent(t *testing.T) {
+	for name, s := range testStores(t) {
+		tags := TiddlerTags{"todo"}
+		s.Put("B", &TiddlyWebJSON{Title: "B", Modified: "20230102000000000", Tags: &tags}, false, "")
+		s.Put("A", &TiddlyWebJSON{Title: "A", Modified: "20230103000000000", Tags: &tags}, false, "")
+		s.Put("C", &TiddlyWebJSON{Title: "C", Modified: "20230101000000000"}, false, "")
+		s.Put("D", &TiddlyWebJSON{Title: "D"}, false, "")
+
+		// index follow changes
+		s.Put("C", &TiddlyWebJSON{Title: "C", Modified: "20230104000000000", Tags: &tags}, false, "")
+		s.Del("B")
+
+		if lst := Tagged(s, "todo"); fmt.Sprint(lst) != "[A C]" {
+			t.Fatal(name, "bad tagged", lst)
+		}
+		if lst := Tagged(s, "none"); len(lst) != 0 {
+			t.Fatal(name, "bad tagged", lst)
+		}
+		if lst := Recent(s, 0); fmt.Sprint(lst) != "[C A]" {
+			t.Fatal(name, "bad recent", lst)
+		}
+		if lst := Recent(s, 1); fmt.Sprint(lst) != "[C]" {
+			t.Fatal(name, "bad recent with limit", lst)
+		}
+	}
+}
+
+func TestPutIf(t *testing.T) {
+	for name, s := range testStores(t) {
+		// create only
+		rev, hash, ok := s.PutIf("A", 0, "", &TiddlyWebJSON{Title: "A", Text: "v1"}, false, "")
+		if !ok || rev != 1 {
+			t.Fatal(name, "create should be written", rev, ok)
+		}
+		if cur, curHash, ok := s.PutIf("A", 0, "", &TiddlyWebJSON{Title: "A", Text: "x"}, false, ""); ok || cur != 1 || curHash != hash {
+			t.Fatal(name, "create only should fail on exist tiddler", cur, ok)
+		}
+
+		// match by revision, and by revision and hash
+		rev, hash, ok = s.PutIf("A", 1, "", &TiddlyWebJSON{Title: "A", Text: "v2"}, false, "")
+		if !ok || rev != 2 {
+			t.Fatal(name, "match revision should be written", rev, ok)
+		}
+		rev, hash, ok = s.PutIf("A", 2, hash, &TiddlyWebJSON{Title: "A", Text: "v3"}, false, "")
+		if !ok || rev != 3 {
+			t.Fatal(name, "match revision and hash should be written", rev, ok)
+		}
+
+		// mismatch return current one
+		if cur, curHash, ok := s.PutIf("A", 2, "", &TiddlyWebJSON{Title: "A", Text: "x"}, false, ""); ok || cur != 3 || curHash != hash {
+			t.Fatal(name, "stale revision should fail", cur, ok)
+		}
+		if cur, curHash, ok := s.PutIf("A", 3, "other", &TiddlyWebJSON{Title: "A", Text: "x"}, false, ""); ok || cur != 3 || curHash != hash {
+			t.Fatal(name, "other hash should fail", cur, ok)
+		}
+		if td, _ := s.Get("A"); td == nil || td.Text != "v3" {
+			t.Fatal(name, "failed PutIf should not write", td)
+		}
+
+		// deleted one is not exist, create continue its revision
+		s.Del("A")
+		if cur, _, ok := s.PutIf("A", 3, "", &TiddlyWebJSON{Title: "A", Text: "x"}, false, ""); ok || cur != 0 {
+			t.Fatal(name, "revision of deleted tiddler should not match", cur, ok)
+		}
+		if rev, _, ok := s.PutIf("A", 0, "", &TiddlyWebJSON{Title: "A", Text: "v4"}, false, ""); !ok || rev != 4 {
+			t.Fatal(name, "create should continue revision of deleted one", rev, ok)
+		}
+	}
+}
+
+func TestListSince(t *testing.T) {
+	for name, s := range testStores(t) {
+		s.Put("A", &TiddlyWebJSON{Title: "A", Text: "a"}, false, "")
+		s.Put("B", &TiddlyWebJSON{Title: "B", Text: "b"}, false, "")
+		since := s.Seq()
+		s.Put("C", &TiddlyWebJSON{Title: "C", Text: "c"}, false, "")
+		s.Del("B")
+
+		buf, seq := s.ListSince(nil, since)
+		if seq != s.Seq() || seq != since+2 {
+			t.Fatal(name, "bad seq", seq, s.Seq())
+		}
+		var lst []map[string]interface{}
+		if err := json.Unmarshal(buf, &lst); err != nil || len(lst) != 2 {
+			t.Fatal(name, "should list changed and deleted only", string(buf), err)
+		}
+		if !bytes.Contains(buf, []byte(`{"title":"B","_is_deleted":true}`)) {
+			t.Fatal(name, "deleted one should be a tombstone with title only", string(buf))
+		}
+		if !bytes.Contains(buf, []byte(`"title":"C"`)) || bytes.Contains(buf, []byte(`"text"`)) {
+			t.Fatal(name, "changed one should be listed skinny", string(buf))
+		}
+
+		// since from future (other store, or lost data) list nothing, client should check returned seq
+		buf, seq = s.ListSince(nil, s.Seq()+10)
+		if seq != s.Seq() || string(buf) != "[]" {
+			t.Fatal(name, "since after current seq should list nothing", string(buf), seq)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	EventPut = "put"
+	EventDel = "del"
+)
+
+// notify after tiddler changed
+type ChangeEvent struct {
+	Op       string `json:"-"` // EventPut or EventDel
+	Title    string `json:"title"`
+	Revision string `json:"revision,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+	Modifier string `json:"modifier,omitempty"`
+}
+
+type Watcher interface {
+	// fn will be called after Put/Del succeed, should not block
+	Watch(fn func(ev *ChangeEvent)) (cancel func())
+}
+
+// wrap a Store for change notify
+type WatchStore struct {
+	Store
+
+	mx     sync.RWMutex
+	nextID uint64
+	fns    map[uint64]func(ev *ChangeEvent)
+}
+
+func (s *WatchStore) Watch(fn func(ev *ChangeEvent)) func() {
+	s.mx.Lock()
+	id := s.nextID
+	s.nextID++
+	s.fns[id] = fn
+	s.mx.Unlock()
+
+	return func() {
+		s.mx.Lock()
+		delete(s.fns, id)
+		s.mx.Unlock()
+	}
+}
+
+func (s *WatchStore) emit(ev *ChangeEvent) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	for _, fn := range s.fns {
+		fn(ev)
+	}
+}
+
+func (s *WatchStore) Put(key string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string) {
+	rev, hash = s.Store.Put(key, tiddler, hasMacro, filePath)
+	s.emit(&ChangeEvent{
+		Op:       EventPut,
+		Title:    key,
+		Revision: fmt.Sprintf("%v", rev),
+		Hash:     hash,
+		Modifier: tiddler.Modifier,
+	})
+	return
+}
+
+func (s *WatchStore) PutIf(key string, ifRev uint64, ifHash string, tiddler *TiddlyWebJSON, hasMacro bool, filePath string) (rev uint64, hash string, ok bool) {
+	rev, hash, ok = s.Store.PutIf(key, ifRev, ifHash, tiddler, hasMacro, filePath)
+	if !ok {
+		return
+	}
+	s.emit(&ChangeEvent{
+		Op:       EventPut,
+		Title:    key,
+		Revision: fmt.Sprintf("%v", rev),
+		Hash:     hash,
+		Modifier: tiddler.Modifier,
+	})
+	return
+}
+
+func (s *WatchStore) Del(key string) (ok bool, file string) {
+	ok, file = s.Store.Del(key)
+	if !ok {
+		return
+	}
+	s.emit(&ChangeEvent{
+		Op:    EventDel,
+		Title: key,
+	})
+	return
+}
+
+func (s *WatchStore) Tagged(tag string) []string {
+	return Tagged(s.Store, tag)
+}
+
+func (s *WatchStore) Recent(limit int) []string {
+	return Recent(s.Store, limit)
+}
+
+func (s *WatchStore) Sweep() []string {
+	return Sweep(s.Store)
+}
+
+func (s *WatchStore) SweptSeq() uint64 {
+	return SweptSeq(s.Store)
+}
+
+func NewWatchStore(s Store) *WatchStore {
+	return &WatchStore{
+		Store: s,
+		fns:   make(map[uint64]func(ev *ChangeEvent)),
+	}
+}
+
+// make sure WatchStore implement Store & Watcher
+var _ Store = (*WatchStore)(nil)
+var _ Watcher = (*WatchStore)(nil)
+var _ Indexer = (*WatchStore)(nil)
+var _ Sweeper = (*WatchStore)(nil)
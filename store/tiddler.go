@@ -0,0 +1,245 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// convert between TiddlyWeb format and TiddlyWiki format (all fields are string at top level)
+// https://tiddlywiki.com/#TiddlerFields
+
+// TiddlyWeb only fields, not output to TiddlyWiki format
+var tiddlyWebOnlyFields = map[string]bool{
+	"bag":         true,
+	"recipe":      true,
+	"revision":    true,
+	"permissions": true,
+	"uri":         true,
+	"_is_skinny":  true,
+}
+
+// all fields as string, TiddlyWeb only fields are skipped
+func (td *TiddlyWebJSON) ToFields() map[string]string {
+	out := make(map[string]string)
+	if td.Fields != nil {
+		for k, v := range *td.Fields {
+			out[k] = fieldString(v)
+		}
+	}
+	set := func(k string, v string) {
+		if v != "" {
+			out[k] = v
+		}
+	}
+	set("title", td.Title)
+	set("created", td.Created)
+	set("modified", td.Modified)
+	set("modifier", td.Modifier)
+	set("type", td.Type)
+	set("text", td.Text)
+	if td.Tags != nil && len(*td.Tags) > 0 {
+		out["tags"] = StringifyList(*td.Tags)
+	}
+	for k := range tiddlyWebOnlyFields {
+		delete(out, k)
+	}
+	return out
+}
+
+// build from TiddlyWiki format, TiddlyWeb only fields are skipped
+func NewTiddlerFromFields(fields map[string]string) *TiddlyWebJSON {
+	td := &TiddlyWebJSON{}
+	custom := make(TiddlerFields)
+	for k, v := range fields {
+		switch k {
+		case "title":
+			td.Title = v
+		case "created":
+			td.Created = v
+		case "modified":
+			td.Modified = v
+		case "modifier":
+			td.Modifier = v
+		case "type":
+			td.Type = v
+		case "text":
+			td.Text = v
+		case "tags":
+			tags := TiddlerTags(ParseStringArray(v))
+			if len(tags) > 0 {
+				td.Tags = &tags
+			}
+		default:
+			if tiddlyWebOnlyFields[k] {
+				continue
+			}
+			custom[k] = v
+		}
+	}
+	if len(custom) > 0 {
+		td.Fields = &custom
+	}
+	return td
+}
+
+// parse JSON array of tiddlers or single tiddler in TiddlyWiki format, all fields as string
+func ParseJSONTiddlers(buf []byte) ([]map[string]string, error) {
+	buf = bytes.TrimSpace(buf)
+	var lst []map[string]interface{}
+	if len(buf) > 0 && buf[0] == '{' {
+		var one map[string]interface{}
+		if err := json.Unmarshal(buf, &one); err != nil {
+			return nil, err
+		}
+		lst = append(lst, one)
+	} else {
+		if err := json.Unmarshal(buf, &lst); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]map[string]string, 0, len(lst))
+	for _, js := range lst {
+		fields := make(map[string]string, len(js))
+		for k, v := range js {
+			fields[k] = fieldString(v)
+		}
+		out = append(out, fields)
+	}
+	return out, nil
+}
+
+// sorted field names
+func SortedFieldNames(fields map[string]string) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func fieldString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []interface{}:
+		lst := make([]string, 0, len(val))
+		for _, item := range val {
+			lst = append(lst, fieldString(item))
+		}
+		return StringifyList(lst)
+	case nil:
+		return ""
+	case float64, bool:
+		return fmt.Sprint(val)
+	}
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}
+
+// same as `$tw.utils.stringifyList()`
+func StringifyList(lst []string) string {
+	out := make([]string, len(lst))
+	for i, item := range lst {
+		if strings.IndexFunc(item, isListSpace) >= 0 {
+			out[i] = "[[" + item + "]]"
+		} else {
+			out[i] = item
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// same as `$tw.utils.parseStringArray()`, duplicate items are removed
+func ParseStringArray(str string) []string {
+	out := make([]string, 0, 4)
+	seen := make(map[string]struct{})
+	add := func(item string) {
+		if item == "" {
+			return
+		}
+		if _, ok := seen[item]; ok {
+			return
+		}
+		seen[item] = struct{}{}
+		out = append(out, item)
+	}
+
+	for i := 0; i < len(str); {
+		// skip spaces
+		r, sz := utf8.DecodeRuneInString(str[i:])
+		if isListSpace(r) {
+			i += sz
+			continue
+		}
+
+		// `[[item with space]]`, should follow by space or end
+		if strings.HasPrefix(str[i:], "[[") {
+			found := -1
+			for j := i + 2; ; {
+				k := strings.Index(str[j:], "]]")
+				if k < 0 {
+					break
+				}
+				after := j + k + 2
+				r, _ := utf8.DecodeRuneInString(str[after:])
+				if after == len(str) || isListSpace(r) {
+					found = j + k
+					break
+				}
+				j += k + 1
+			}
+			if found >= 0 {
+				add(str[i+2 : found])
+				i = found + 2
+				continue
+			}
+		}
+
+		// until space
+		end := strings.IndexFunc(str[i:], isListSpace)
+		if end < 0 {
+			add(str[i:])
+			break
+		}
+		add(str[i : i+end])
+		i += end
+	}
+	return out
+}
+
+// white space but not non-breaking space
+func isListSpace(r rune) bool {
+	return r != ' ' && unicode.IsSpace(r)
+}
+
+// `type` of tiddler is text or not, empty for "text/vnd.tiddlywiki"
+func IsTextType(typ string) bool {
+	switch {
+	case typ == "":
+		return true
+	case strings.HasPrefix(typ, "text/"):
+		return true
+	case typ == "application/json", typ == "application/javascript", typ == "application/x-tiddler-dictionary":
+		return true
+	}
+	return false
+}
+
+func hasTag(td *TiddlyWebJSON, tag string) bool {
+	if td.Tags == nil {
+		return false
+	}
+	for _, t := range *td.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
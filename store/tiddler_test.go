@@ -0,0 +1,77 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStringArray(t *testing.T) {
+	var testCase = []struct {
+		In  string
+		Out []string
+	}{
+		{"a b [[c d]] e", []string{"a", "b", "c d", "e"}},
+		{"[[x]]y]] z", []string{"x]]y", "z"}},
+		{"a a [[a]]", []string{"a"}},
+		{"[[]] \t", []string{}},
+		{"a b", []string{"a b"}},
+	}
+
+	for _, test := range testCase {
+		out := ParseStringArray(test.In)
+		if !reflect.DeepEqual(out, test.Out) {
+			t.Fatal("ParseStringArray", test.In, "should be", test.Out, "got", out)
+		}
+	}
+}
+
+func TestStringifyList(t *testing.T) {
+	out := StringifyList([]string{"a", "b c", "$:/tags/Macro"})
+	if out != "a [[b c]] $:/tags/Macro" {
+		t.Fatal("StringifyList got", out)
+	}
+}
+
+func TestTidRoundTrip(t *testing.T) {
+	fields := map[string]string{
+		"title":    "$:/foo/Bar",
+		"tags":     "a [[b c]]",
+		"modified": "20230101000000000",
+		"text":     "line1\n\nline2",
+	}
+	buf, ext := encodeTiddlerFile(fields)
+	if ext != ".tid" {
+		t.Fatal("should be .tid, got", ext)
+	}
+	if out := parseTid(buf); !reflect.DeepEqual(out, fields) {
+		t.Fatal("should be", fields, "got", out)
+	}
+
+	fields["x"] = " leading space"
+	if _, ext := encodeTiddlerFile(fields); ext != ".json" {
+		t.Fatal("should be .json, got", ext)
+	}
+	fields["type"] = "image/png"
+	delete(fields, "x")
+	if _, ext := encodeTiddlerFile(fields); ext != ".json" {
+		t.Fatal("should be .json, got", ext)
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	var testCase = []struct {
+		In  string
+		Out string
+	}{
+		{"$:/foo/Bar", "$__foo_Bar"},
+		{"..hidden", "__hidden"},
+		{"a<b>?", "a_b__"},
+		{"", "_"},
+	}
+
+	for _, test := range testCase {
+		if out := sanitizeFileName(test.In); out != test.Out {
+			t.Fatal("sanitizeFileName", test.In, "should be", test.Out, "got", out)
+		}
+	}
+}
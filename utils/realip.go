@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+var trustedProxies atomic.Value // []netip.Prefix
+
+// IP or CIDR like "127.0.0.1", "10.0.0.0/8"
+func ParsePrefixList(lst []string) ([]netip.Prefix, error) {
+	prefixs := make([]netip.Prefix, 0, len(lst))
+	for _, str := range lst {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		if !strings.Contains(str, "/") {
+			addr, err := netip.ParseAddr(str)
+			if err != nil {
+				return nil, err
+			}
+			prefixs = append(prefixs, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(str)
+		if err != nil {
+			return nil, err
+		}
+		prefixs = append(prefixs, prefix.Masked())
+	}
+	return prefixs, nil
+}
+
+// reverse proxies to trust forwarding headers from, empty for not trust any
+func SetTrustedProxies(prefixs []netip.Prefix) {
+	trustedProxies.Store(prefixs)
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	prefixs, _ := trustedProxies.Load().([]netip.Prefix)
+	for _, prefix := range prefixs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// "1.2.3.4", "1.2.3.4:80", "[::1]:80", `"[::1]:80"` (quoted in `Forwarded`)
+func parseAddr(str string) (netip.Addr, bool) {
+	str = strings.Trim(strings.TrimSpace(str), `"`)
+	if ap, err := netip.ParseAddrPort(str); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	str = strings.TrimSuffix(strings.TrimPrefix(str, "["), "]")
+	addr, err := netip.ParseAddr(str)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// addresses from forwarding headers, client first
+// `Forwarded` is used if exist, then `X-Forwarded-For`, then `X-Real-IP`
+func forwardedFor(hdr http.Header) []string {
+	if lst := hdr.Values("Forwarded"); len(lst) > 0 {
+		hops := make([]string, 0, len(lst))
+		for _, line := range lst {
+			for _, elem := range strings.Split(line, ",") {
+				hop := ""
+				for _, pair := range strings.Split(elem, ";") {
+					k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(k, "for") {
+						hop = v
+					}
+				}
+				hops = append(hops, hop) // empty for unknown hop
+			}
+		}
+		return hops
+	}
+	if lst := hdr.Values("X-Forwarded-For"); len(lst) > 0 {
+		hops := make([]string, 0, len(lst))
+		for _, line := range lst {
+			hops = append(hops, strings.Split(line, ",")...)
+		}
+		return hops
+	}
+	if ip := hdr.Get("X-Real-IP"); ip != "" {
+		return []string{ip}
+	}
+	return nil
+}
+
+// address of client, from forwarding headers if connected from trusted proxies
+// walk from the nearest hop, the first not trusted one is the client
+// RemoteAddr (with port) if not from trusted proxy, or IP only if from forwarding headers
+func ClientAddr(r *http.Request) string {
+	addr, ok := parseAddr(r.RemoteAddr)
+	if !ok || !isTrustedProxy(addr) {
+		return r.RemoteAddr
+	}
+	client := r.RemoteAddr
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseAddr(hops[i])
+		if !ok {
+			break // obfuscated or bad one, stop at the last known
+		}
+		client = addr.String()
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return client
+}
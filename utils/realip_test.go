@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	proxies, err := ParsePrefixList([]string{"127.0.0.1", "10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTrustedProxies(proxies)
+	defer SetTrustedProxies(nil)
+
+	var testCase = []struct {
+		Remote string
+		Header map[string]string
+		Addr   string
+	}{
+		// not from proxy
+		{"1.2.3.4:5678", nil, "1.2.3.4:5678"},
+		{"1.2.3.4:5678", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "1.2.3.4:5678"},
+
+		// from proxy without header
+		{"127.0.0.1:5678", nil, "127.0.0.1:5678"},
+
+		// X-Forwarded-For, spoofed ones before the nearest untrusted are ignored
+		{"127.0.0.1:5678", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "5.6.7.8"},
+		{"127.0.0.1:5678", map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.1.2.3"}, "5.6.7.8"},
+		{"[::1]:5678", map[string]string{"X-Forwarded-For": "2001:db8::1"}, "2001:db8::1"},
+		{"127.0.0.1:5678", map[string]string{"X-Forwarded-For": "10.1.2.3"}, "10.1.2.3"}, // all trusted
+		{"127.0.0.1:5678", map[string]string{"X-Forwarded-For": "5.6.7.8, bad"}, "127.0.0.1:5678"},
+
+		// Forwarded first
+		{"127.0.0.1:5678", map[string]string{"Forwarded": `for=5.6.7.8;proto=https, for="[2001:db8::1]:4711"`, "X-Forwarded-For": "9.9.9.9"}, "2001:db8::1"},
+		{"127.0.0.1:5678", map[string]string{"Forwarded": `for=5.6.7.8, for=_hidden`}, "127.0.0.1:5678"},
+		{"127.0.0.1:5678", map[string]string{"Forwarded": `For="5.6.7.8:1234"`}, "5.6.7.8"},
+
+		// X-Real-IP last
+		{"127.0.0.1:5678", map[string]string{"X-Real-IP": "5.6.7.8"}, "5.6.7.8"},
+	}
+	for i, tc := range testCase {
+		r := &http.Request{RemoteAddr: tc.Remote, Header: make(http.Header)}
+		for k, v := range tc.Header {
+			r.Header.Set(k, v)
+		}
+		if addr := ClientAddr(r); addr != tc.Addr {
+			t.Fatal(i, "ClientAddr() should be", tc.Addr, "got", addr)
+		}
+	}
+
+	if _, err := ParsePrefixList([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("ParsePrefixList() should fail")
+	}
+}